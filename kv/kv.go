@@ -0,0 +1,311 @@
+// Package kv is a small embedded key-value store that keeps all its data
+// in a single file.
+//
+// The file is an append-only log. Every change is appended as an entry
+// and flushed to disk before Put or Delete returns. When the store is
+// opened, the log is read back into memory. An entry that was only partly
+// written when the server crashed is detected by its length and checksum.
+// If it is the last entry, the log is truncated to the entry before it.
+// The log is copied aside first. Damage before the last entry can't be a
+// crash, so then the store refuses to open rather than throw away the
+// entries after it. The space of overwritten and deleted values is
+// reclaimed by Compact, which rewrites the log into a new file and
+// renames it over the old one.
+//
+// An entry is a header line followed by the key and the value:
+//
+//	P <key length> <value length> <crc32 of key and value>\n<key><value>\n
+//	D <key length> 0 <crc32 of key>\n<key>\n
+package kv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/beoran/woe/monolog"
+)
+
+var ErrClosed = errors.New("kv: store is closed")
+
+// A key-value store in a single file.
+type Store struct {
+	path  string
+	file  *os.File
+	data  map[string][]byte
+	size  int64 // Size of the log.
+	live  int64 // Size the log would have after compaction.
+	mutex sync.Mutex
+}
+
+// Returns the size of the entry for the key and value in the log.
+func entrySize(op byte, key string, value []byte) int64 {
+	header := fmt.Sprintf("%c %d %d %d\n", op, len(key), len(value), checksum(key, value))
+	return int64(len(header) + len(key) + len(value) + 1)
+}
+
+func checksum(key string, value []byte) uint32 {
+	crc := crc32.ChecksumIEEE([]byte(key))
+	return crc32.Update(crc, crc32.IEEETable, value)
+}
+
+func writeEntry(writer io.Writer, op byte, key string, value []byte) (err error) {
+	_, err = fmt.Fprintf(writer, "%c %d %d %d\n%s%s\n", op, len(key), len(value),
+		checksum(key, value), key, value)
+	return err
+}
+
+// Reads one entry, with remaining the amount of bytes left in the log.
+// Returns io.EOF at the end of the log, io.ErrUnexpectedEOF if the entry
+// is incomplete, and another error if it is damaged. The size of a damaged
+// entry is returned as far as it could be read.
+func readEntry(reader *bufio.Reader, remaining int64) (op byte, key string, value []byte, size int64, err error) {
+	header, err := reader.ReadString('\n')
+	if err == io.EOF && header == "" {
+		return 0, "", nil, 0, io.EOF
+	} else if err != nil {
+		return 0, "", nil, 0, io.ErrUnexpectedEOF
+	}
+	var klen, vlen int
+	var crc uint32
+	if _, err = fmt.Sscanf(header, "%c %d %d %d\n", &op, &klen, &vlen, &crc); err != nil {
+		return 0, "", nil, int64(len(header)), fmt.Errorf("kv: bad entry header %q", header)
+	}
+	if (op != 'P' && op != 'D') || klen < 0 || vlen < 0 {
+		return 0, "", nil, int64(len(header)), fmt.Errorf("kv: bad entry header %q", header)
+	}
+	// Check the lengths before allocating, so a damaged header can't
+	// make a huge allocation.
+	left := remaining - int64(len(header))
+	if int64(klen) > left || int64(vlen) > left-int64(klen)-1 {
+		return 0, "", nil, 0, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, klen+vlen+1)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		return 0, "", nil, 0, io.ErrUnexpectedEOF
+	}
+	key = string(body[:klen])
+	value = body[klen : klen+vlen]
+	size = int64(len(header) + len(body))
+	if body[klen+vlen] != '\n' || checksum(key, value) != crc {
+		return 0, "", nil, size, fmt.Errorf("kv: damaged entry for %q", key)
+	}
+	return op, key, value, size, nil
+}
+
+// Opens the store in the file at path, creating it if needed.
+func Open(path string) (me *Store, err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	me = &Store{path: path, file: file, data: make(map[string][]byte)}
+	if err = me.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return me, nil
+}
+
+// Reads the log into memory. A damaged last entry is cut off, other
+// damage is an error.
+func (me *Store) load() (err error) {
+	info, err := me.file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(me.file)
+	for {
+		op, key, value, size, err := readEntry(reader, info.Size()-me.size)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if err != io.ErrUnexpectedEOF && me.size+size < info.Size() {
+				return fmt.Errorf("kv: %s is damaged after %d bytes: %v", me.path, me.size, err)
+			}
+			// A damaged length can also look like an incomplete entry,
+			// so keep a copy of what is cut off.
+			saved, serr := me.saveDamaged(info.Size())
+			if serr != nil {
+				return serr
+			}
+			monolog.Warning("Truncating %s after %d bytes, saved it as %s: %v", me.path, me.size, saved, err)
+			if err = me.file.Truncate(me.size); err != nil {
+				return err
+			}
+			break
+		}
+		me.apply(op, key, value)
+		me.size += size
+	}
+	_, err = me.file.Seek(me.size, io.SeekStart)
+	return err
+}
+
+// Copies the whole log to a new file next to it, before a damaged tail is
+// cut off. Returns the name of the copy.
+func (me *Store) saveDamaged(size int64) (name string, err error) {
+	copied, err := os.CreateTemp(filepath.Dir(me.path), filepath.Base(me.path)+".damaged*")
+	if err != nil {
+		return "", err
+	}
+	defer copied.Close()
+	if _, err = io.Copy(copied, io.NewSectionReader(me.file, 0, size)); err != nil {
+		return "", err
+	}
+	return copied.Name(), copied.Sync()
+}
+
+// Applies an entry to the data in memory.
+func (me *Store) apply(op byte, key string, value []byte) {
+	if old, ok := me.data[key]; ok {
+		me.live -= entrySize('P', key, old)
+	}
+	if op == 'D' {
+		delete(me.data, key)
+		return
+	}
+	me.data[key] = value
+	me.live += entrySize('P', key, value)
+}
+
+// Appends an entry to the log, flushes it to disk, and applies it.
+func (me *Store) append(op byte, key string, value []byte) (err error) {
+	if me.file == nil {
+		return ErrClosed
+	}
+	writer := bufio.NewWriter(me.file)
+	if err = writeEntry(writer, op, key, value); err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = me.file.Sync()
+	}
+	if err != nil {
+		// Cut off what was written of the entry, so the log stays valid.
+		me.file.Truncate(me.size)
+		me.file.Seek(me.size, io.SeekStart)
+		return err
+	}
+	me.size += entrySize(op, key, value)
+	me.apply(op, key, value)
+	return nil
+}
+
+// Returns the value of the key, and whether it exists.
+func (me *Store) Get(key string) (value []byte, ok bool) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	value, ok = me.data[key]
+	return value, ok
+}
+
+// Sets the value of the key.
+func (me *Store) Put(key string, value []byte) error {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.append('P', key, append([]byte(nil), value...))
+}
+
+// Deletes the key. Deleting a key that doesn't exist is not an error.
+func (me *Store) Delete(key string) error {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if _, ok := me.data[key]; !ok {
+		return nil
+	}
+	return me.append('D', key, nil)
+}
+
+// Returns the keys that start with the prefix, sorted.
+func (me *Store) Keys(prefix string) (keys []string) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	for key := range me.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the amount of keys in the store.
+func (me *Store) Len() int {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return len(me.data)
+}
+
+// Rewrites the log with only the current values.
+func (me *Store) Compact() (err error) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if me.file == nil {
+		return ErrClosed
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(me.path), "."+filepath.Base(me.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+	keys := make([]string, 0, len(me.data))
+	for key := range me.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writer := bufio.NewWriter(file)
+	for _, key := range keys {
+		if err = writeEntry(writer, 'P', key, me.data[key]); err != nil {
+			return err
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(file.Name(), me.path); err != nil {
+		return err
+	}
+	me.file.Close()
+	me.file = file
+	me.size = me.live
+	_, err = me.file.Seek(me.size, io.SeekStart)
+	return err
+}
+
+// Closes the store. The log is compacted first if more than half of it
+// is wasted.
+func (me *Store) Close() (err error) {
+	if me.file == nil {
+		return ErrClosed
+	}
+	if me.size > 2*me.live {
+		if err = me.Compact(); err != nil {
+			monolog.Warning("Could not compact %s: %v", me.path, err)
+		}
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	err = me.file.Close()
+	me.file = nil
+	return err
+}
@@ -0,0 +1,143 @@
+package kv
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStore(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "woe.kv")
+	store, err := Open(path)
+	if err != nil {
+		test.Fatalf("Open: %v", err)
+	}
+	store.Put("account/alice", []byte("name:Alice\n"))
+	store.Put("account/bob", []byte("name:Bob\n"))
+	store.Put("account/alice", []byte("name:Alice\nmulti\nline\n"))
+	store.Put("room/town", []byte{})
+	store.Delete("account/bob")
+	if err = store.Close(); err != nil {
+		test.Fatalf("Close: %v", err)
+	}
+
+	store, err = Open(path)
+	if err != nil {
+		test.Fatalf("Open: %v", err)
+	}
+	defer store.Close()
+	if value, ok := store.Get("account/alice"); !ok || string(value) != "name:Alice\nmulti\nline\n" {
+		test.Errorf("Wrong value %q %v", value, ok)
+	}
+	if _, ok := store.Get("account/bob"); ok {
+		test.Errorf("Deleted key still exists")
+	}
+	if keys := store.Keys("account/"); !reflect.DeepEqual(keys, []string{"account/alice"}) {
+		test.Errorf("Wrong keys %v", keys)
+	}
+	if value, ok := store.Get("room/town"); !ok || len(value) != 0 {
+		test.Errorf("Empty value lost: %q %v", value, ok)
+	}
+}
+
+func TestStoreDamagedTail(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "woe.kv")
+	store, _ := Open(path)
+	store.Put("a", []byte("one"))
+	store.Put("b", []byte("two"))
+	store.Close()
+
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-2)
+	store, err := Open(path)
+	if err != nil {
+		test.Fatalf("Open: %v", err)
+	}
+	if _, ok := store.Get("b"); ok {
+		test.Errorf("Partly written entry was loaded")
+	}
+	if value, _ := store.Get("a"); string(value) != "one" {
+		test.Errorf("Complete entry was lost: %q", value)
+	}
+	store.Put("c", []byte("three"))
+	store.Close()
+
+	store, _ = Open(path)
+	defer store.Close()
+	if store.Len() != 2 {
+		test.Errorf("Expected 2 keys after recovery, got %d", store.Len())
+	}
+	if saved, _ := filepath.Glob(path + ".damaged*"); len(saved) != 1 {
+		test.Errorf("Expected a copy of the damaged log, got %v", saved)
+	}
+}
+
+func TestStoreDamagedMiddle(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "woe.kv")
+	store, _ := Open(path)
+	store.Put("a", []byte("one"))
+	store.Put("b", []byte("two"))
+	store.Close()
+
+	// Damage the value of the first entry.
+	data, _ := os.ReadFile(path)
+	damaged := bytes.Replace(data, []byte("one"), []byte("ONE"), 1)
+	os.WriteFile(path, damaged, 0600)
+	if _, err := Open(path); err == nil {
+		test.Errorf("Open should fail on damage before the last entry")
+	}
+	if data, _ = os.ReadFile(path); !bytes.Equal(data, damaged) {
+		test.Errorf("Damaged log was changed")
+	}
+}
+
+func TestStoreDamagedHeader(test *testing.T) {
+	for _, header := range []string{
+		"P 9223372036854775807 1 0\nabc",
+		"P 1 9223372036854775807 0\nabc",
+		"P 4611686018427387904 4611686018427387904 0\nabc",
+		"P 100 100 0\nabc",
+	} {
+		path := filepath.Join(test.TempDir(), "woe.kv")
+		store, _ := Open(path)
+		store.Put("a", []byte("one"))
+		store.Close()
+		file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		file.WriteString(header)
+		file.Close()
+
+		store, err := Open(path)
+		if err != nil {
+			test.Fatalf("Open with header %q: %v", header, err)
+		}
+		if value, _ := store.Get("a"); string(value) != "one" || store.Len() != 1 {
+			test.Errorf("Wrong data after header %q: %q %d", header, value, store.Len())
+		}
+		store.Close()
+	}
+}
+
+func TestStoreCompact(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "woe.kv")
+	store, _ := Open(path)
+	for index := 0; index < 10; index++ {
+		store.Put("key", []byte("some value"))
+	}
+	before, _ := os.Stat(path)
+	if err := store.Compact(); err != nil {
+		test.Fatalf("Compact: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		test.Errorf("Log did not shrink: %d >= %d", after.Size(), before.Size())
+	}
+	store.Put("other", []byte("value"))
+	store.Close()
+	store, _ = Open(path)
+	defer store.Close()
+	if value, _ := store.Get("key"); string(value) != "some value" || store.Len() != 2 {
+		test.Errorf("Wrong data after compaction: %q %d", value, store.Len())
+	}
+}
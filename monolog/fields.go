@@ -0,0 +1,115 @@
+package monolog
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "runtime"
+)
+
+// Fields are key/value pairs that describe the context of a log message,
+// such as the client or account it is about. A FieldLogger logs them
+// separately, other loggers after the message as key=value.
+type Fields map[string]interface{}
+
+// Returns the keys of the fields, sorted.
+func (me Fields) Keys() (keys []string) {
+    for key := range me {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// Returns the fields as " key=value key=value", sorted by key, or "" if
+// there are none. Values with spaces are quoted.
+func (me Fields) String() string {
+    var result strings.Builder
+    for _, key := range me.Keys() {
+        value := fmt.Sprint(me[key])
+        if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+            value = fmt.Sprintf("%q", value)
+        }
+        fmt.Fprintf(&result, " %s=%s", key, value)
+    }
+    return result.String()
+}
+
+// An Entry logs messages with fields to a log book.
+type Entry struct {
+    book          * Logbook
+    fields          Fields
+}
+
+// Returns an entry that logs with the field to the log book.
+func (me * Logbook) With(key string, value interface{}) * Entry {
+    return &Entry{me, Fields{key: value}}
+}
+
+// Returns an entry that logs with the fields to the log book.
+func (me * Logbook) WithFields(fields Fields) * Entry {
+    return (&Entry{me, nil}).WithFields(fields)
+}
+
+// Returns a new entry with the field added.
+func (me * Entry) With(key string, value interface{}) * Entry {
+    return me.WithFields(Fields{key: value})
+}
+
+// Returns a new entry with the fields added.
+func (me * Entry) WithFields(fields Fields) * Entry {
+    result := &Entry{me.book, make(Fields, len(me.fields) + len(fields))}
+    for key, value := range me.fields {
+        result.fields[key] = value
+    }
+    for key, value := range fields {
+        result.fields[key] = value
+    }
+    return result
+}
+
+// Returns the fields of the entry.
+func (me * Entry) Fields() Fields {
+    return me.fields
+}
+
+func (me * Entry) WriteLog(depth int, level string, format string, args ... interface{}) {
+    _ ,file, line, ok := runtime.Caller(depth)
+    if !ok {
+        file = "unknown"
+        line = 0
+    }
+    me.book.LogFields(level, file, line, me.fields, format, args...)
+}
+
+func (me * Entry) Log(name string, format string, args ... interface{}) {
+    me.WriteLog(2, name, format, args...)
+}
+
+func (me * Entry) Info(format string, args ... interface{}) {
+    me.WriteLog(2, "INFO", format, args...)
+}
+
+func (me * Entry) Warning(format string, args ... interface{}) {
+    me.WriteLog(2, "WARNING", format, args...)
+}
+
+func (me * Entry) Error(format string, args ... interface{}) {
+    me.WriteLog(2, "ERROR", format, args...)
+}
+
+func (me * Entry) Fatal(format string, args ... interface{}) {
+    me.WriteLog(2, "FATAL", format, args...)
+}
+
+func (me * Entry) Debug(format string, args ... interface{}) {
+    me.WriteLog(2, "DEBUG", format, args...)
+}
+
+func With(key string, value interface{}) * Entry {
+    return DefaultLog.With(key, value)
+}
+
+func WithFields(fields Fields) * Entry {
+    return DefaultLog.WithFields(fields)
+}
@@ -0,0 +1,100 @@
+package monolog
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "sync"
+    "time"
+    "path/filepath"
+)
+
+// Logs one JSON object per line, for tools that process logs. An object
+// has the keys time, level, file, line and message, followed by the
+// fields of the message. A field with the same name as one of those
+// keys is left out.
+type JSONLogger struct {
+    filename      string
+    out           io.Writer
+    closer        io.Closer
+    mutex         sync.Mutex
+}
+
+// Makes a JSON logger that writes to the file, rotated as described by rotation.
+func NewJSONLogger(filename string, rotation Rotation) (logger Logger, err error) {
+    file, err := OpenRotatingFile(filename, rotation)
+    if err != nil {
+        return nil, err
+    }
+    return &JSONLogger{filename: filename, out: file, closer: file}, nil
+}
+
+// Makes a JSON logger that writes to out, and never closes it.
+func NewJSONWriterLogger(out io.Writer) * JSONLogger {
+    return &JSONLogger{out: out}
+}
+
+var jsonReserved = map[string]bool{
+    "time": true, "level": true, "file": true, "line": true, "message": true,
+}
+
+// Writes "key":value to the buffer. Values that can't be encoded as JSON
+// are written as their string form.
+func writeJSONPair(buffer * bytes.Buffer, key string, value interface{}) {
+    encoded, err := json.Marshal(value)
+    if err != nil {
+        encoded, _ = json.Marshal(fmt.Sprint(value))
+    }
+    name, _ := json.Marshal(key)
+    buffer.Write(name)
+    buffer.WriteByte(':')
+    buffer.Write(encoded)
+}
+
+func (me * JSONLogger) Log(level string, file string, line int, format string, args...interface{}) {
+    me.LogFields(level, file, line, nil, format, args...)
+}
+
+func (me * JSONLogger) LogFields(level string, file string, line int, fields Fields, format string, args...interface{}) {
+    var buffer bytes.Buffer
+    buffer.WriteByte('{')
+    writeJSONPair(&buffer, "time", time.Now().Format(time.RFC3339Nano))
+    buffer.WriteByte(',')
+    writeJSONPair(&buffer, "level", level)
+    buffer.WriteByte(',')
+    writeJSONPair(&buffer, "file", filepath.Base(file))
+    buffer.WriteByte(',')
+    writeJSONPair(&buffer, "line", line)
+    buffer.WriteByte(',')
+    writeJSONPair(&buffer, "message", formatMessage(format, args...))
+    for _, key := range fields.Keys() {
+        if jsonReserved[key] {
+            continue
+        }
+        buffer.WriteByte(',')
+        writeJSONPair(&buffer, key, fields[key])
+    }
+    buffer.WriteString("}\n")
+
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    if me.out != nil {
+        me.out.Write(buffer.Bytes())
+    }
+}
+
+// Returns the name of the file logged to, if any.
+func (me * JSONLogger) String() string {
+    return me.filename
+}
+
+func (me * JSONLogger) Close() {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    if me.closer != nil {
+        me.closer.Close()
+    }
+    me.closer = nil
+    me.out = nil
+}
@@ -4,8 +4,12 @@ package monolog
 
 import (
     "os"
+    "io"
     "fmt"
     "time"
+    "sort"
+    "sync"
+    "bytes"
     "runtime"
     "path/filepath"
     "unicode"
@@ -18,6 +22,12 @@ type Logger interface {
     Close()
 }
 
+// A logger that can log the fields of a message separately.
+type FieldLogger interface {
+    Logger
+    LogFields(level string, file string, line int, fields Fields, format string, args...interface{})
+}
+
 
 func GetCallerName(depth int) {
     pc := make([]uintptr, depth+1)
@@ -68,73 +78,130 @@ func (me * FileLogger) Debug(format string, args ... interface{}) {
     me.WriteLog(2, "DEBUG", format, args...)
 }
 
- 
+
+// Logs lines of text to a file. A log line has the form
+// "time: level: file: line: message", followed by the fields, if any.
 type FileLogger struct {
     filename      string
-    file        * os.File
+    out           io.Writer
+    closer        io.Closer
+    mutex         sync.Mutex
 }
 
 func (me * FileLogger) Close() {
-    if (me.file != nil) { 
-        me.file.Close()
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    if (me.closer != nil) {
+        me.closer.Close()
     }
-    me.file = nil
+    me.closer = nil
+    me.out    = io.Discard
 }
 
 func (me * FileLogger) Log(level string, file string, line int, format string, args...interface{}) {
+    me.LogFields(level, file, line, nil, format, args...)
+}
+
+func (me * FileLogger) LogFields(level string, file string, line int, fields Fields, format string, args...interface{}) {
+    text := FormatLine(level, file, line, fields, format, args...) + "\n"
+    // Write the line at once, so lines from different goroutines
+    // don't get mixed up, and a rotating file is rotated between lines.
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    me.out.Write([]byte(text))
+}
+
+// Returns the name of the file logged to.
+func (me * FileLogger) String() string {
+    return me.filename
+}
+
+// Formats a log line as the FileLogger writes it, without the newline.
+func FormatLine(level string, file string, line int, fields Fields, format string, args...interface{}) string {
+    var buffer bytes.Buffer
     fileshort := filepath.Base(file)
     now := time.Now().Format(time.RFC3339)
-    fmt.Fprintf(me.file, "%s: %s: %s: %d: ", now, level, fileshort, line)
+    fmt.Fprintf(&buffer, "%s: %s: %s: %d: ", now, level, fileshort, line)
+    buffer.WriteString(formatMessage(format, args...))
+    buffer.WriteString(fields.String())
+    return buffer.String()
+}
+
+// Formats a log message. Without arguments, the format is used as is.
+func formatMessage(format string, args...interface{}) string {
     if args != nil && len(args) > 0 { 
-        fmt.Fprintf(me.file, format, args...)
-    } else {
-        fmt.Fprint(me.file, format)
+        return fmt.Sprintf(format, args...)
     }
-    fmt.Fprint(me.file, "\n")
+    return format
 }
 
-
 func NewFileLogger(filename string) (logger Logger, err error) {
-    file, err := os.OpenFile(filename, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0660) 
-    
+    return NewRotatingFileLogger(filename, Rotation{})
+}    
+
+// Makes a file logger that rotates the file as described by rotation.
+func NewRotatingFileLogger(filename string, rotation Rotation) (logger Logger, err error) {
+    file, err := OpenRotatingFile(filename, rotation)
     if err != nil { 
         return nil, err
     }
-    
-    return &FileLogger{filename, file}, nil
+    return &FileLogger{filename: filename, out: file, closer: file}, nil
 }    
 
 func NewStderrLogger() (logger Logger, err error) {    
-    return &FileLogger{"/dev/stderr", os.Stderr}, nil
+    return &FileLogger{filename: "/dev/stderr", out: os.Stderr, closer: os.Stderr}, nil
 }
 
 
 func NewStdoutLogger() (logger Logger, err error) {    
-    return &FileLogger{"/dev/stderr", os.Stdout}, nil
+    return &FileLogger{filename: "/dev/stdout", out: os.Stdout, closer: os.Stdout}, nil
 }
 
-type Logbook struct {
-    loggers          [] Logger
-    levels  map[string] bool
+// Levels that are enabled for a new logger.
+var DefaultLevels = []string{"FATAL", "ERROR", "WARNING", "INFO"}
+
+// A set of enabled log levels. It is safe for concurrent use.
+type Levels struct {
+    enabled         map[string] bool
+    mutex           sync.RWMutex
 }
 
+// Makes a set of levels with the given levels enabled.
+func NewLevels(levels ... string) * Levels {
+    me := &Levels{enabled: make(map[string] bool)}
+    for _, level := range levels {
+        me.enabled[level] = true
+    }
+    return me
+}
 
-func NewLog() * Logbook {
-    loggers :=  make([] Logger, 32)
-    levels  :=  make(map[string] bool)
-    return &Logbook{loggers, levels}
+func (me * Levels) Enable(level string) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    me.enabled[level] = true
 }
 
-func (me * Logbook) AddLogger(logger Logger) {
-    me.loggers = append(me.loggers, logger)
+func (me * Levels) Disable(level string) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    delete(me.enabled, level)
 }
 
-func (me * Logbook) EnableLevel(level string) {
-    me.levels[level] = true
+func (me * Levels) IsEnabled(level string) bool {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    return me.enabled[level]
 }
 
-func (me * Logbook) DisableLevel(level string) {
-    me.levels[level] = false
+// Returns the enabled levels, sorted.
+func (me * Levels) List() (levels []string) {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    for level := range me.enabled {
+        levels = append(levels, level)
+    }
+    sort.Strings(levels)
+    return levels
 }
 
 func enableDisableSplitter(c rune) (bool) {
@@ -144,44 +211,151 @@ func enableDisableSplitter(c rune) (bool) {
         return ok
 }
 
+// Splits a list of levels such as "INFO,DEBUG".
+func SplitLevels(list string) []string {
+    return strings.FieldsFunc(list, enableDisableSplitter)
+}
+
+// A logger and the levels it logs.
+type filter struct {
+    logger          Logger
+    levels        * Levels
+}
+
+// A Logbook sends log messages to its loggers. Every logger has its own
+// levels, so, for example, debug messages can go to a file but not to
+// the console.
+type Logbook struct {
+    filters          [] filter
+    mutex               sync.RWMutex
+}
+
+
+func NewLog() * Logbook {
+    return &Logbook{}
+}
+
+// Adds a logger that logs the DefaultLevels.
+func (me * Logbook) AddLogger(logger Logger) {
+    me.AddLoggerLevels(logger, NewLevels(DefaultLevels...))
+}
+
+// Adds a logger that logs the given levels.
+func (me * Logbook) AddLoggerLevels(logger Logger, levels * Levels) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    me.filters = append(me.filters, filter{logger, levels})
+}
+
+// Removes the logger from the log book, without closing it.
+func (me * Logbook) RemoveLogger(logger Logger) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    for index, filter := range me.filters {
+        if filter.logger == logger {
+            me.filters = append(me.filters[:index], me.filters[index+1:]...)
+            return
+        }
+    }
+}
+
+// Returns the loggers in the log book.
+func (me * Logbook) Loggers() (loggers []Logger) {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    for _, filter := range me.filters {
+        loggers = append(loggers, filter.logger)
+    }
+    return loggers
+}
+
+// Returns the levels of the logger, or nil if it is not in the log book.
+func (me * Logbook) LevelsOf(logger Logger) * Levels {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    for _, filter := range me.filters {
+        if filter.logger == logger {
+            return filter.levels
+        }
+    }
+    return nil
+}
+
+// Enables the level for all loggers.
+func (me * Logbook) EnableLevel(level string) {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    for _, filter := range me.filters {
+        filter.levels.Enable(level)
+    }
+}
+
+// Disables the level for all loggers.
+func (me * Logbook) DisableLevel(level string) {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    for _, filter := range me.filters {
+        filter.levels.Disable(level)
+    }
+}
+
+// Returns true if any logger logs the level.
+func (me * Logbook) IsEnabled(level string) bool {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    for _, filter := range me.filters {
+        if filter.levels.IsEnabled(level) {
+            return true
+        }
+    }
+    return false
+}
 
 func (me * Logbook) EnableLevels(list string) {    
-    to_enable := strings.FieldsFunc(list, enableDisableSplitter)
-    for _, level := range to_enable {
+    for _, level := range SplitLevels(list) {
         me.EnableLevel(level)
     }
 }
 
     
 func (me * Logbook) DisableLevels(list string) {    
-    to_disable := strings.FieldsFunc(list, enableDisableSplitter)
-    for _, level := range to_disable {
+    for _, level := range SplitLevels(list) {
         me.DisableLevel(level)
     }
 }
 
 
 func (me * Logbook) LogVa(name string, file string, line int, format string, args...interface{}) {
-    enabled, ok := me.levels[name]
-    
-    if (!ok) || (!enabled) {
-        return
-    }
-    
-    for _ , logger := range me.loggers {
-        if (logger != nil) {
-            logger.Log(name, file, line, format, args...)
+    me.LogFields(name, file, line, nil, format, args...)
+}
+
+// Logs a message with fields. Loggers that aren't a FieldLogger get the
+// fields after the message.
+func (me * Logbook) LogFields(name string, file string, line int, fields Fields, format string, args...interface{}) {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    for _ , filter := range me.filters {
+        if !filter.levels.IsEnabled(name) {
+            continue
+        }
+        if logger, ok := filter.logger.(FieldLogger) ; ok {
+            logger.LogFields(name, file, line, fields, format, args...)
+        } else if len(fields) > 0 {
+            message := formatMessage(format, args...) + fields.String()
+            filter.logger.Log(name, file, line, "%s", message)
+        } else {
+            filter.logger.Log(name, file, line, format, args...)
         }
     }
 }
 
 func (me * Logbook) Close() {    
-    for index , logger := range me.loggers {
-        if logger != nil {
-            logger.Close()
-            me.loggers[index] = nil
-        }
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    for _ , filter := range me.filters {
+        filter.logger.Close()
     }
+    me.filters = nil
 }
 
 var DefaultLog * Logbook
@@ -214,10 +388,27 @@ func AddLogger(logger Logger, err error) {
     }
 }
 
+func Loggers() []Logger {
+    return DefaultLog.Loggers()
+}
+
+func LevelsOf(logger Logger) * Levels {
+    return DefaultLog.LevelsOf(logger)
+}
+
+func IsEnabled(level string) bool {
+    return DefaultLog.IsEnabled(level)
+}
+
 
 func Setup(name string, stderr bool, stdout bool) {    
+    SetupRotating(name, Rotation{}, stderr, stdout)
+}
+
+// Like Setup, but the log file is rotated as described by rotation.
+func SetupRotating(name string, rotation Rotation, stderr bool, stdout bool) {    
     if name != "" {
-        AddLogger(NewFileLogger(name))
+        AddLogger(NewRotatingFileLogger(name, rotation))
     }
     
     if stderr { 
@@ -227,11 +418,6 @@ func Setup(name string, stderr bool, stdout bool) {
     if stdout { 
         AddLogger(NewStdoutLogger())
     }
-    
-    EnableLevel("INFO")
-    EnableLevel("WARNING")
-    EnableLevel("ERROR")
-    EnableLevel("FATAL")    
 }     
 
 func Close() {
@@ -249,7 +435,7 @@ func WriteLog(depth int, name string, format string, args ... interface{}) {
 }
 
 func Log(name string, format string, args ...interface{}) {
-    WriteLog(2, name, format, args)
+    WriteLog(2, name, format, args...)
 }
 
 func Info(format string, args ...interface{}) {
@@ -0,0 +1,167 @@
+package monolog
+
+import (
+    "bytes"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Logger that remembers the messages it got.
+type testLogger struct {
+    messages []string
+}
+
+func (me * testLogger) Log(level string, file string, line int, format string, args...interface{}) {
+    me.messages = append(me.messages, level + " " + formatMessage(format, args...))
+}
+
+func (me * testLogger) Close() {
+}
+
+func TestLevelsPerLogger(test *testing.T) {
+    book := NewLog()
+    all := &testLogger{}
+    errors := &testLogger{}
+    book.AddLoggerLevels(all, NewLevels("INFO", "ERROR"))
+    book.AddLoggerLevels(errors, NewLevels("ERROR"))
+    book.LogVa("INFO", "x.go", 1, "hello %d", 1)
+    book.LogVa("ERROR", "x.go", 2, "oops")
+    book.LogVa("DEBUG", "x.go", 3, "hidden")
+    if strings.Join(all.messages, "|") != "INFO hello 1|ERROR oops" {
+        test.Errorf("wrong messages %v", all.messages)
+    }
+    if strings.Join(errors.messages, "|") != "ERROR oops" {
+        test.Errorf("wrong messages %v", errors.messages)
+    }
+
+    book.EnableLevels("DEBUG,WARNING")
+    book.LevelsOf(errors).Disable("ERROR")
+    if strings.Join(book.LevelsOf(errors).List(), " ") != "DEBUG WARNING" {
+        test.Errorf("wrong levels %v", book.LevelsOf(errors).List())
+    }
+    if !book.IsEnabled("ERROR") || book.IsEnabled("FATAL") {
+        test.Errorf("IsEnabled is wrong")
+    }
+
+    book.WithFields(Fields{"client": 7, "account": "Alice"}).WriteLog(1, "DEBUG", "traced")
+    if last := all.messages[len(all.messages) - 1]; last != "DEBUG traced account=Alice client=7" {
+        test.Errorf("wrong message with fields %q", last)
+    }
+}
+
+func TestJSONLogger(test *testing.T) {
+    var out bytes.Buffer
+    book := NewLog()
+    book.AddLogger(NewJSONWriterLogger(&out))
+    book.With("client", 7).With("account", "Alice").With("level", "x").Info("Hello %s", "world")
+    var object map[string]interface{}
+    if err := json.Unmarshal(out.Bytes(), &object); err != nil {
+        test.Fatalf("not JSON: %v: %s", err, out.String())
+    }
+    if object["message"] != "Hello world" || object["level"] != "INFO" ||
+        object["client"] != 7.0 || object["account"] != "Alice" {
+        test.Errorf("wrong object %v", object)
+    }
+    if object["file"] != "monolog_test.go" {
+        test.Errorf("wrong caller %v", object["file"])
+    }
+    if !strings.HasPrefix(out.String(), `{"time":`) || !strings.HasSuffix(out.String(), "}\n") {
+        test.Errorf("wrong line %q", out.String())
+    }
+}
+
+func TestRotatingFile(test *testing.T) {
+    dirname := test.TempDir()
+    filename := filepath.Join(dirname, "test.log")
+    file, err := OpenRotatingFile(filename, Rotation{MaxSize: 20, Keep: 2})
+    if err != nil {
+        test.Fatalf("could not open: %v", err)
+    }
+    for _, line := range []string{"first line\n", "second line\n", "third line\n", "fourth line\n"} {
+        if _, err = file.Write([]byte(line)); err != nil {
+            test.Fatalf("could not write: %v", err)
+        }
+    }
+    file.Close()
+
+    rotated := RotatedFiles(filename)
+    if len(rotated) != 2 {
+        test.Fatalf("wrong rotated files %v", rotated)
+    }
+    expected := []string{"second line\n", "third line\n"}
+    for index, path := range rotated {
+        data, _ := os.ReadFile(path)
+        if string(data) != expected[index] {
+            test.Errorf("rotated file %s has %q", path, data)
+        }
+    }
+    data, _ := os.ReadFile(filename)
+    if string(data) != "fourth line\n" {
+        test.Errorf("current file has %q", data)
+    }
+}
+
+func TestRotatingFileInterval(test *testing.T) {
+    filename := filepath.Join(test.TempDir(), "test.log")
+    os.WriteFile(filename, []byte("old\n"), 0660)
+    yesterday := time.Now().Add(-25 * time.Hour)
+    os.Chtimes(filename, yesterday, yesterday)
+    file, err := OpenRotatingFile(filename, Rotation{Interval: 24 * time.Hour})
+    if err != nil {
+        test.Fatalf("could not open: %v", err)
+    }
+    file.Write([]byte("new\n"))
+    file.Close()
+    if rotated := RotatedFiles(filename); len(rotated) != 1 {
+        test.Errorf("wrong rotated files %v", rotated)
+    }
+}
+
+func TestRotatingFileMoved(test *testing.T) {
+    filename := filepath.Join(test.TempDir(), "test.log")
+    file, err := OpenRotatingFile(filename, Rotation{})
+    if err != nil {
+        test.Fatalf("could not open: %v", err)
+    }
+    file.Write([]byte("one\n"))
+    os.Rename(filename, filename + ".old")
+    file.Write([]byte("two\n"))
+    file.Close()
+    if data, _ := os.ReadFile(filename); string(data) != "two\n" {
+        test.Errorf("file was not reopened: %q", data)
+    }
+}
+
+func TestRingLogger(test *testing.T) {
+    ring := NewRingLogger(3)
+    book := NewLog()
+    book.AddLogger(ring)
+    book.LogVa("INFO", "x.go", 1, "one")
+    if lines := ring.Lines(10); len(lines) != 1 || !strings.HasSuffix(lines[0], ": INFO: x.go: 1: one") {
+        test.Errorf("wrong lines %v", lines)
+    }
+    watcher := ring.Watch()
+    for _, message := range []string{"two", "three", "four"} {
+        book.LogVa("INFO", "x.go", 1, "%s", message)
+    }
+    lines := ring.Lines(0)
+    if len(lines) != 3 || !strings.HasSuffix(lines[0], "two") || !strings.HasSuffix(lines[2], "four") {
+        test.Errorf("wrong lines %v", lines)
+    }
+    if lines = ring.Lines(2); len(lines) != 2 || !strings.HasSuffix(lines[0], "three") {
+        test.Errorf("wrong last lines %v", lines)
+    }
+    if line := <-watcher; !strings.HasSuffix(line, "two") {
+        test.Errorf("watcher got %q", line)
+    }
+    ring.Unwatch(watcher)
+    <-watcher
+    <-watcher
+    if _, ok := <-watcher; ok {
+        test.Errorf("watcher not closed")
+    }
+}
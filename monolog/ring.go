@@ -0,0 +1,101 @@
+package monolog
+
+import (
+    "fmt"
+    "sync"
+)
+
+// Keeps the last lines logged in memory, so they can be shown without
+// reading the log file, and passes new lines on to watchers.
+type RingLogger struct {
+    lines         []string
+    // Index where the next line goes.
+    next            int
+    full            bool
+    watchers        map[chan string] bool
+    mutex           sync.Mutex
+}
+
+// Amount of lines a watcher may fall behind before lines are dropped.
+const RING_WATCH_BUFFER = 256
+
+// Makes a ring logger that keeps the last size lines.
+func NewRingLogger(size int) * RingLogger {
+    if size < 1 {
+        size = 1
+    }
+    return &RingLogger{lines: make([]string, size), watchers: make(map[chan string] bool)}
+}
+
+func (me * RingLogger) Log(level string, file string, line int, format string, args...interface{}) {
+    me.LogFields(level, file, line, nil, format, args...)
+}
+
+func (me * RingLogger) LogFields(level string, file string, line int, fields Fields, format string, args...interface{}) {
+    text := FormatLine(level, file, line, fields, format, args...)
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    me.lines[me.next] = text
+    me.next = (me.next + 1) % len(me.lines)
+    me.full = me.full || me.next == 0
+    for watcher := range me.watchers {
+        // A watcher that doesn't keep up misses lines, rather than
+        // blocking everything that logs.
+        select {
+        case watcher <- text:
+        default:
+        }
+    }
+}
+
+// Returns the last n lines, oldest first. With n < 1 it returns all lines.
+func (me * RingLogger) Lines(n int) []string {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    count := me.next
+    if me.full {
+        count = len(me.lines)
+    }
+    if n < 1 || n > count {
+        n = count
+    }
+    result := make([]string, 0, n)
+    for index := me.next - n ; index < me.next ; index++ {
+        result = append(result, me.lines[(index + len(me.lines)) % len(me.lines)])
+    }
+    return result
+}
+
+// Returns a channel that receives the lines logged from now on,
+// until it is passed to Unwatch.
+func (me * RingLogger) Watch() chan string {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    watcher := make(chan string, RING_WATCH_BUFFER)
+    me.watchers[watcher] = true
+    return watcher
+}
+
+// Stops sending lines to the watcher and closes it.
+func (me * RingLogger) Unwatch(watcher chan string) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    if me.watchers[watcher] {
+        delete(me.watchers, watcher)
+        close(watcher)
+    }
+}
+
+func (me * RingLogger) String() string {
+    return fmt.Sprintf("memory (%d lines)", len(me.lines))
+}
+
+// Stops all watchers. The lines are kept.
+func (me * RingLogger) Close() {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    for watcher := range me.watchers {
+        delete(me.watchers, watcher)
+        close(watcher)
+    }
+}
@@ -0,0 +1,229 @@
+package monolog
+
+import (
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+    "time"
+    "path/filepath"
+)
+
+// Log files are rotated when they grow too large, or when a new period of
+// time starts, for example every day. The current file is then renamed to
+// filename.YYYYMMDD-HHMMSS, with the time of the rotation, and a new file
+// is started. Only the newest Keep rotated files are kept.
+//
+// If the file is renamed or removed by another process, such as the
+// supervisor or logrotate, it is opened again before the next write.
+
+// How a log file is rotated. The zero value never rotates.
+type Rotation struct {
+    // Rotate when the file would grow larger than this many bytes, 0 for no limit.
+    MaxSize     int64
+    // Rotate when the file was last written in an earlier period
+    // of this length, 0 to not rotate by time.
+    Interval    time.Duration
+    // Number of rotated files to keep, 0 to keep all.
+    Keep        int
+}
+
+// Layout of the time in the names of rotated files.
+const ROTATED_LAYOUT = "20060102-150405"
+
+// A log file that rotates itself. It is safe for concurrent use.
+type RotatingFile struct {
+    Rotation
+    filename      string
+    file        * os.File
+    // Size of the file and the time of its last write.
+    size          int64
+    written       time.Time
+    mutex         sync.Mutex
+}
+
+// Opens the log file, appending to it if it exists.
+func OpenRotatingFile(filename string, rotation Rotation) (me * RotatingFile, err error) {
+    me = &RotatingFile{Rotation: rotation, filename: filename}
+    if err = me.open() ; err != nil {
+        return nil, err
+    }
+    return me, nil
+}
+
+func (me * RotatingFile) open() error {
+    file, err := os.OpenFile(me.filename, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0660)
+    if err != nil {
+        return err
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return err
+    }
+    me.file = file
+    me.size = info.Size()
+    me.written = info.ModTime()
+    return nil
+}
+
+// Returns true if the open file is no longer the one at the file name.
+func (me * RotatingFile) moved() bool {
+    info, err := os.Stat(me.filename)
+    if err != nil {
+        return true
+    }
+    opened, err := me.file.Stat()
+    return err != nil || !os.SameFile(info, opened)
+}
+
+// Returns true if the file must be rotated before writing size bytes at now.
+func (me * RotatingFile) mustRotate(size int, now time.Time) bool {
+    if me.size == 0 {
+        return false
+    }
+    if me.MaxSize > 0 && me.size + int64(size) > me.MaxSize {
+        return true
+    }
+    if me.Interval > 0 && !now.Truncate(me.Interval).Equal(me.written.Truncate(me.Interval)) {
+        return true
+    }
+    return false
+}
+
+// Writes to the file, rotating it first if needed. Write the whole
+// line at once, so rotation never splits it.
+func (me * RotatingFile) Write(data []byte) (written int, err error) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    if me.file == nil {
+        return 0, os.ErrClosed
+    }
+    if me.moved() {
+        me.file.Close()
+        if err = me.open() ; err != nil {
+            me.file = nil
+            return 0, err
+        }
+    }
+    now := time.Now()
+    if me.mustRotate(len(data), now) {
+        if err = me.rotate(now) ; err != nil {
+            // Keep logging to the current file rather than losing messages.
+            fmt.Fprintf(os.Stderr, "monolog: could not rotate %s: %v\n", me.filename, err)
+        }
+    }
+    written, err = me.file.Write(data)
+    me.size += int64(written)
+    me.written = now
+    return written, err
+}
+
+// Rotates the file now.
+func (me * RotatingFile) Rotate() error {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    if me.file == nil {
+        return os.ErrClosed
+    }
+    return me.rotate(time.Now())
+}
+
+func (me * RotatingFile) rotate(now time.Time) error {
+    rotated := me.filename + "." + now.Format(ROTATED_LAYOUT)
+    // Don't overwrite a file rotated earlier in the same second.
+    for n := 1 ; fileExists(rotated) ; n++ {
+        rotated = fmt.Sprintf("%s.%s.%d", me.filename, now.Format(ROTATED_LAYOUT), n)
+    }
+    if err := os.Rename(me.filename, rotated) ; err != nil {
+        return err
+    }
+    me.file.Close()
+    if err := me.open() ; err != nil {
+        me.file = nil
+        return err
+    }
+    return me.removeOld()
+}
+
+func fileExists(filename string) bool {
+    _, err := os.Stat(filename)
+    return err == nil
+}
+
+// Removes the oldest rotated files, so only Keep of them are left.
+func (me * RotatingFile) removeOld() error {
+    if me.Keep < 1 {
+        return nil
+    }
+    rotated := RotatedFiles(me.filename)
+    if len(rotated) <= me.Keep {
+        return nil
+    }
+    for _, old := range rotated[:len(rotated) - me.Keep] {
+        if err := os.Remove(old) ; err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Returns the rotated files of the log file, oldest first.
+func RotatedFiles(filename string) (rotated []string) {
+    paths, _ := filepath.Glob(filename + ".*")
+    prefix := len(filename) + 1
+    for _, path := range paths {
+        if len(path) < prefix + len(ROTATED_LAYOUT) {
+            continue
+        }
+        stamp := path[prefix:prefix + len(ROTATED_LAYOUT)]
+        rest := path[prefix + len(ROTATED_LAYOUT):]
+        if _, err := time.Parse(ROTATED_LAYOUT, stamp) ; err != nil {
+            continue
+        }
+        if rest != "" && !isNumberSuffix(rest) {
+            continue
+        }
+        rotated = append(rotated, path)
+    }
+    sort.Slice(rotated, func(i, j int) bool {
+        return rotatedLess(rotated[i][prefix:], rotated[j][prefix:])
+    })
+    return rotated
+}
+
+// Returns true if the suffix is of the form .N.
+func isNumberSuffix(suffix string) bool {
+    if len(suffix) < 2 || suffix[0] != '.' {
+        return false
+    }
+    for _, c := range suffix[1:] {
+        if c < '0' || c > '9' {
+            return false
+        }
+    }
+    return true
+}
+
+// Compares the suffixes of rotated files, so stamp.10 comes after stamp.9.
+func rotatedLess(a string, b string) bool {
+    stampa, stampb := a[:len(ROTATED_LAYOUT)], b[:len(ROTATED_LAYOUT)]
+    if stampa != stampb {
+        return stampa < stampb
+    }
+    if len(a) != len(b) {
+        return len(a) < len(b)
+    }
+    return a < b
+}
+
+func (me * RotatingFile) Close() error {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    if me.file == nil {
+        return os.ErrClosed
+    }
+    err := me.file.Close()
+    me.file = nil
+    return err
+}
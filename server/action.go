@@ -3,7 +3,9 @@ package server
 import "bytes"
 import "errors"
 import "regexp"
-// import "github.com/beoran/woe/telnet"
+import "sort"
+import "strings"
+import "github.com/beoran/woe/telnet"
 import "github.com/beoran/woe/world"
 import "github.com/beoran/woe/monolog"
 
@@ -30,29 +32,115 @@ type Action struct {
     Name        string
     Privilege   world.Privilege
     Handler     ActionHandler
+    // Arguments of the action, shown in the help.
+    Usage       string
+    // Short description of the action.
+    Short       string
+    // If an abbreviation matches several actions, the one with the
+    // highest priority is used. Common verbs should have a high priority.
+    Priority    int
 }
 
+/* Returned by a handler if the arguments are wrong, so the usage 
+ * of the action is shown. */
+var ErrUsage = errors.New("Wrong arguments.")
+
 
 var ActionMap map[string] Action
 
-func AddAction(name string, privilege world.Privilege, handler ActionHandler) {
+func AddAction(name string, privilege world.Privilege, priority int, 
+    usage string, short string, handler ActionHandler) {
     monolog.Info("Adding new action %s with privilege %d", name, privilege)
-    action := Action{name, privilege, handler}
+    action := Action{name, privilege, handler, usage, short, priority}
     ActionMap[name] = action
 }
 
+/* Actions can be used as AskOptions, for listing and help. */
+func (me Action) AskName() string {
+    return me.Name
+}
+
+func (me Action) AskShort() string {
+    return me.Short
+}
+
+func (me Action) AskLong() string {
+    return me.Short + "\nUsage: " + strings.TrimSpace(me.Name + " " + me.Usage)
+}
+
+func (me Action) AskPrivilege() world.Privilege {
+    return me.Privilege
+}
+
+/* Returns all actions as an AskOptionList, sorted by name. */
+func ActionList() AskOptionList {
+    return actionList(ActionMap)
+}
+
+/* Returns the actions in the map as an AskOptionList, sorted by name. */
+func actionList(actions map[string] Action) AskOptionList {
+    names := make([]string, 0, len(actions))
+    for name := range actions {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    list := make(AskOptionSlice, 0, len(names))
+    for _, name := range names {
+        list = append(list, actions[name])
+    }
+    return list
+}
+
+/* Finds the action for a command, which may be abbreviated. If the 
+ * abbreviation is ambiguous, the action with the highest priority is used, 
+ * and if there is none, candidates lists the actions that match. Only 
+ * actions allowed by the privilege are considered. */
+func FindAction(command string, privilege world.Privilege) (action * Action, candidates []string) {
+    return findAction(ActionMap, command, privilege)
+}
+
+/* Finds the action for a command in the map, see FindAction. */
+func findAction(actions map[string] Action, command string, 
+    privilege world.Privilege) (action * Action, candidates []string) {
+    allowed := AskOptionListFilterPrivilege(actionList(actions), privilege)
+    var best * Action
+    tie := false
+    for index := 0; index < allowed.AskOptionListLen(); index++ {
+        found := allowed.AskOptionListGet(index).(Action)
+        if found.Name == command {
+            return &found, nil
+        }
+        if !strings.HasPrefix(found.Name, command) {
+            continue
+        }
+        candidates = append(candidates, found.Name)
+        if best == nil || found.Priority > best.Priority {
+            best = &found
+            tie  = false
+        } else if found.Priority == best.Priority {
+            tie  = true
+        }
+    }
+    if best == nil || tie {
+        return nil, candidates
+    }
+    return best, nil
+}
+
 func doShout(data * ActionData) (err error) {
       data.Server.Broadcast("Client said %s\r\n", data.Rest)
       return nil  
 }
 
 func doShutdown(data * ActionData) (err error) {    
+    data.Client.Audit("shut down the server")
     data.Server.Broadcast("Shutting down server NOW!\n")
-    data.Server.Restart();
+    data.Server.Shutdown();
     return nil
 }
 
 func doRestart(data * ActionData) (err error) {
+    data.Client.Audit("restarted the server")
     data.Server.Broadcast("Restarting server NOW!\n")
     data.Server.Restart();
     return nil
@@ -64,19 +152,252 @@ func doQuit(data * ActionData) (err error) {
     return nil
 }
 
-func doEnableLog(data * ActionData) (err error) {  
-    // strings. string(data.Rest)
+func doLook(data * ActionData) (err error) {
+    client := data.Client
+    if client.character == nil || client.character.Room == nil {
+        client.Printf("You are nowhere.\n")
+        return nil
+    }
+    room := client.character.Room
+    client.MXPPrintf("%s\n%s\n", client.MXPText(room.Name), client.MXPText(room.Long))
+    
+    directions := make([]string, 0, len(room.Exits))
+    for direction := range room.Exits {
+        directions = append(directions, string(direction))
+    }
+    sort.Strings(directions)
+    exits := make([]string, 0, len(directions))
+    for _, direction := range directions {
+        exits = append(exits, client.MXPExit(direction))
+    }
+    if len(exits) < 1 {
+        client.Printf("There are no exits.\n")
+    } else {
+        client.MXPPrintf("Exits: %s\n", strings.Join(exits, " "))
+    }
+    
+    others := make([]string, 0)
+    for _, other := range data.Server.Clients() {
+        if other != client && other.IsLoginFinished() && other.character.Room == room {
+            others = append(others, client.MXPCharacter(other.character))
+        }
+    }
+    if len(others) > 0 {
+        client.MXPPrintf("Also here: %s\n", strings.Join(others, ", "))
+    }
+    return nil
+}
+
+// Lists what the character carries, with MXP menus on the item names.
+func doInventory(data * ActionData) (err error) {
+    client := data.Client
+    if client.character == nil {
+        return nil
+    }
+    items := client.character.Items()
+    if len(items) < 1 {
+        client.Printf("You carry nothing.\n")
+        return nil
+    }
+    names := make([]string, 0, len(items))
+    for _, item := range items {
+        names = append(names, client.MXPItem(item))
+    }
+    client.MXPPrintf("You carry: %s\n", strings.Join(names, ", "))
+    return nil
+}
+
+func doSound(data * ActionData) (err error) {
+    client := data.Client
+    switch strings.ToLower(string(data.Rest)) {
+        case "on":
+            client.SetSound(true)
+        case "off":
+            client.SetSound(false)
+        case "":
+        default:
+            return ErrUsage
+    }
+    if data.Account.IsDirty() {
+        if err = data.Account.Save(data.Server.Storage()); err != nil {
+            return err
+        }
+    }
+    
+    if !client.info.msp {
+        client.Printf("Your client does not support MSP sounds.\n")
+    } else if client.UseMSP() {
+        client.Printf("Sounds are on.\n")
+    } else {
+        client.Printf("Sounds are off.\n")
+    }
+    return nil
+}
+
+func doCharset(data * ActionData) (err error) {
+    client  := data.Client
+    account := data.Account
+    name    := string(data.Rest)
+    
+    if name == "" {
+        client.Printf("Your character set is %s.\n", client.EncodingName())
+        client.Printf("Supported: %s\n", strings.Join(telnet.CharsetNames(), ", "))
+        client.Printf("Use charset auto to negotiate it with your client.\n")
+        return nil
+    }
+    
+    if strings.EqualFold(name, "auto") {
+        account.Change(func() { account.Charset = "" })
+        client.Printf("Your character set will be negotiated at the next login.\n")
+    } else {
+        charset := telnet.FindCharset(name)
+        if charset == nil {
+            client.Printf("Character set %s is not supported.\n", name)
+            return nil
+        }
+        client.SetEncoding(charset.Name)
+        account.Change(func() { account.Charset = charset.Name })
+        client.Printf("Your character set is now %s.\n", charset.Name)
+    }
+    return account.Save(data.Server.Storage())
+}
+
+func doAlias(data * ActionData) (err error) {
+    client    := data.Client
+    character := client.character
+    if character == nil {
+        return nil
+    }
+    
+    fields := strings.SplitN(string(data.Rest), " ", 2)
+    name   := fields[0]
+    if name == "" {
+        if len(character.Aliases) < 1 {
+            client.Printf("You have no aliases.\n")
+        }
+        for _, alias := range character.AliasNames() {
+            client.Printf("%s: %s\n", alias, character.Aliases[alias])
+        }
+        return nil
+    }
+    
+    if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+        expansion, ok := character.Aliases[name]
+        if !ok {
+            client.Printf("You have no alias %s.\n", name)
+        } else {
+            client.Printf("%s: %s\n", name, expansion)
+        }
+        return nil
+    }
+    
+    if name == "alias" || name == "unalias" {
+        client.Printf("You can't use %s as an alias.\n", name)
+        return nil
+    }
+    if !world.ValidAliasName(name) {
+        client.Printf("Alias names may only have letters, digits and _.\n")
+        return nil
+    }
+    
+    character.SetAlias(name, strings.TrimSpace(fields[1]))
+    client.Printf("Alias %s set.\n", name)
+    return character.Save(data.Server.Storage())
+}
+
+func doUnalias(data * ActionData) (err error) {
+    client    := data.Client
+    character := client.character
+    name      := string(data.Rest)
+    if character == nil {
+        return nil
+    }
+    if name == "" {
+        return ErrUsage
+    }
+    if _, ok := character.Aliases[name]; !ok {
+        client.Printf("You have no alias %s.\n", name)
+        return nil
+    }
+    character.SetAlias(name, "")
+    client.Printf("Alias %s removed.\n", name)
+    return character.Save(data.Server.Storage())
+}
+
+func doCommands(data * ActionData) (err error) {
+    client  := data.Client
+    allowed := AskOptionListFilterPrivilege(ActionList(), data.Account.Privilege)
+    client.Printf("Commands:\n")
+    for index := 0; index < allowed.AskOptionListLen(); index++ {
+        action := allowed.AskOptionListGet(index)
+        client.MXPPrintf("%s: %s\n", 
+            client.MXPCommand(action.AskName(), "Help on " + action.AskName(), 
+                "help " + action.AskName()),
+            client.MXPText(action.AskShort()))
+    }
+    client.Printf("Commands may be abbreviated. Use help <command> for more.\n")
     return nil
 }
 
+func printHelp(client * Client, name string, body string, seeAlso []string) {
+    client.Printf("Help on %s:\n%s\n", name, body)
+    if len(seeAlso) > 0 {
+        links := make([]string, 0, len(seeAlso))
+        for _, see := range seeAlso {
+            links = append(links, client.MXPCommand(see, "Help on " + see, "help " + see))
+        }
+        client.MXPPrintf("See also: %s\n", strings.Join(links, ", "))
+    }
+}
+
+func doHelp(data * ActionData) (err error) {
+    client    := data.Client
+    topic     := strings.ToLower(string(data.Rest))
+    privilege := data.Account.Privilege
+    if topic == "" {
+        doCommands(data)
+        client.Printf("Other help topics are skills, techniques, arts, kins and jobs.\n")
+        return nil
+    }
+    
+    help, helpCandidates     := data.World.Help(topic, privilege)
+    action, actionCandidates := FindAction(topic, privilege)
+    if action != nil && action.Name == topic {
+        /* A help entry for a command adds to the usage. */
+        if help != nil && help.AskName() == topic {
+            printHelp(client, action.Name, action.AskLong() + "\n\n" + help.Body, help.SeeAlso)
+        } else {
+            printHelp(client, action.Name, action.AskLong(), nil)
+        }
+        return nil
+    } else if help != nil {
+        printHelp(client, help.AskName(), help.Body, help.SeeAlso)
+        return nil
+    } else if action != nil {
+        printHelp(client, action.Name, action.AskLong(), nil)
+        return nil
+    }
+    
+    candidates := append(actionCandidates, helpCandidates...)
+    if len(candidates) < 1 {
+        for _, found := range data.World.SearchHelp(topic, privilege) {
+            candidates = append(candidates, found.AskName())
+        }
+    }
+    if len(candidates) > 0 {
+        client.Printf("No help on %s. Perhaps you mean: %s?\n", topic, 
+            strings.Join(candidates, ", "))
+    } else {
+        client.Printf("No help available on %s.\n", topic)
+    }
+    return nil
+}
 
 func ParseCommand(command []byte, data * ActionData) (err error) {
     /* strip any leading blanks  */
     trimmed    := bytes.TrimLeft(command, " \t")
     re         := regexp.MustCompile("[^ \t,]+")
-    parts      := re.FindAll(command, -1)
-    
-    bytes.SplitN(trimmed, []byte(" \t,"), 2)  
+    parts      := re.FindAll(trimmed, -1)
     
     if len(parts) < 1 {
         data.Command = nil
@@ -84,7 +405,7 @@ func ParseCommand(command []byte, data * ActionData) (err error) {
     }
     data.Command = parts[0]
     if len(parts) > 1 { 
-        data.Rest    = parts[1]
+        data.Rest    = bytes.TrimSpace(trimmed[len(parts[0]):])
         data.Argv    = parts
     } else {
         data.Rest    = nil
@@ -96,36 +417,95 @@ func ParseCommand(command []byte, data * ActionData) (err error) {
 
 func init() {
     ActionMap = make(map[string] Action)
-    AddAction("/shutdown"   , world.PRIVILEGE_LORD, doShutdown)
-    AddAction("/restart"    , world.PRIVILEGE_LORD, doRestart)
-    AddAction("/quit"       , world.PRIVILEGE_ZERO, doQuit)
+    AddAction("/shutdown"   , world.PRIVILEGE_LORD, 0, "", 
+        "Shuts down the server.", doShutdown)
+    AddAction("/restart"    , world.PRIVILEGE_LORD, 0, "", 
+        "Restarts the server.", doRestart)
+    AddAction("/promote"    , world.PRIVILEGE_LORD, 0, "account [privilege]", 
+        "Raises the privilege of an account.", doPromote)
+    AddAction("/demote"     , world.PRIVILEGE_LORD, 0, "account [privilege]", 
+        "Lowers the privilege of an account.", doDemote)
+    AddAction("/who"        , world.PRIVILEGE_MASTER, 0, "[-all]", 
+        "Lists the connected clients, with -all also those not logged in.", doAdminWho)
+    AddAction("/kick"       , world.PRIVILEGE_MASTER, 0, "name [reason]", 
+        "Disconnects a player.", doKick)
+    AddAction("/ban"        , world.PRIVILEGE_LORD, 0, "[account|address[/bits] [reason]]", 
+        "Bans an account or IP range, or lists the bans.", doBan)
+    AddAction("/unban"      , world.PRIVILEGE_LORD, 0, "account|address[/bits]", 
+        "Removes a ban.", doUnban)
+    AddAction("/snoop"      , world.PRIVILEGE_LORD, 0, "[name]", 
+        "Shows you what a player sees and types, or stops snooping.", doSnoop)
+    AddAction("/force"      , world.PRIVILEGE_IMPLEMENTOR, 0, "name command", 
+        "Makes a player perform a command.", doForce)
+    AddAction("/log"        , world.PRIVILEGE_IMPLEMENTOR, 0, "enable|disable level [logger]|list", 
+        "Enables or disables a log level, or lists the loggers and their levels.", doLog)
+    AddAction("/trace"      , world.PRIVILEGE_IMPLEMENTOR, 0, "[name|id [on|off]]", 
+        "Logs the telnet traffic of a client at level TRACE, or lists the traced clients.", doTrace)
+    AddAction("/tail"       , world.PRIVILEGE_IMPLEMENTOR, 0, "[lines|off]", 
+        "Shows the recent log lines and follows the log, or stops following it.", doTail)
+    AddAction("redit"       , world.PRIVILEGE_MASTER, 0, 
+        "[new [id]|name text|short text|long text|zone id|exit direction [room]]", 
+        "Shows or changes the room you are in, or creates a new room.", doRedit)
+    AddAction("zedit"       , world.PRIVILEGE_MASTER, 0, 
+        "[zone [new [name]|name text|short text|long text]]", 
+        "Lists, shows, changes or creates zones.", doZedit)
+    AddAction("dig"         , world.PRIVILEGE_MASTER, 0, "direction [room]", 
+        "Makes a two way exit to a new or existing room.", doDig)
+    AddAction("goto"        , world.PRIVILEGE_MASTER, 0, "room", 
+        "Takes you to a room.", doGoto)
+    AddAction("/quit"       , world.PRIVILEGE_ZERO, 0, "", 
+        "Leaves the game.", doQuit)
+    AddAction("look"        , world.PRIVILEGE_ZERO, 100, "", 
+        "Looks around you.", doLook)
+    AddAction("inventory"   , world.PRIVILEGE_ZERO, 80, "", 
+        "Lists what you carry.", doInventory)
+    AddAction("who"         , world.PRIVILEGE_ZERO, 60, "", 
+        "Lists the players that are online.", doWho)
+    AddAction("finger"      , world.PRIVILEGE_ZERO, 0, "name", 
+        "Shows information about a character, even if offline.", doFinger)
+    AddAction("help"        , world.PRIVILEGE_ZERO, 90, "[command|topic]", 
+        "Shows help on a command or topic, or lists the commands.", doHelp)
+    AddAction("commands"    , world.PRIVILEGE_ZERO, 50, "", 
+        "Lists the commands you can use.", doCommands)
+    AddAction("sound"       , world.PRIVILEGE_ZERO, 0, "[on|off]", 
+        "Turns MSP sounds on or off.", doSound)
+    AddAction("charset"     , world.PRIVILEGE_ZERO, 0, "[name|auto]", 
+        "Shows or sets the character set of your client.", doCharset)
+    AddAction("alias"       , world.PRIVILEGE_ZERO, 10, "[name [commands]]", 
+        "Lists, shows or sets aliases. Use $1 to $9 and $* for arguments, ; to separate commands.", doAlias)
+    AddAction("unalias"     , world.PRIVILEGE_ZERO, 0, "name", 
+        "Removes an alias.", doUnalias)
 }
 
 func (client * Client) ProcessCommand(command []byte) {
     ad := &ActionData{client, client.GetServer(), 
         client.GetWorld(), client.GetAccount(), nil, nil, nil, nil }
-    _ = ad
     err := ParseCommand(command, ad);
     if err != nil {
-        client.Printf("%s", err)
+        client.Printf("%s\n", err)
         return
     }
     
-    action, ok := ActionMap[string(ad.Command)]
-    ad.Action = &action
-    
-    if ad.Action == nil || (!ok) {
-        client.Printf("Unknown command %s.", ad.Command)
-        return
-    }
-    // Check if sufficient rights to perform the action
-    if (ad.Action.Privilege > client.GetAccount().Privilege) {
-        client.Printf("You lack the privilege to %s (%d vs %d).", 
-        ad.Command, ad.Action.Privilege, client.GetAccount().Privilege)
+    // Only actions allowed by the privilege of the account are found.
+    privilege := client.GetAccount().Privilege
+    action, candidates := FindAction(string(ad.Command), privilege)
+    if action == nil {
+        if len(candidates) > 0 {
+            client.Printf("Which command do you mean: %s?\n", 
+                strings.Join(candidates, ", "))
+        } else {
+            client.Printf("Unknown command %s.\n", string(ad.Command))
+        }
         return
     }
+    ad.Action = action
     
     // Finally run action
-    ad.Action.Handler(ad)
+    err = ad.Action.Handler(ad)
+    if err == ErrUsage {
+        client.Printf("Usage: %s %s\n", action.Name, action.Usage)
+    } else if err != nil {
+        client.Log().Warning("Command %s failed: %v", action.Name, err)
+        client.Printf("%s failed: %s\n", action.Name, err)
+    }
 } 
-
@@ -0,0 +1,63 @@
+package server
+
+import "strings"
+import "testing"
+import "github.com/beoran/woe/world"
+
+func TestFindAction(test *testing.T) {
+	cases := []struct {
+		command   string
+		privilege world.Privilege
+		expected  string
+	}{
+		{"look", world.PRIVILEGE_ZERO, "look"},
+		{"l", world.PRIVILEGE_ZERO, "look"},
+		{"c", world.PRIVILEGE_ZERO, "commands"},
+		{"ch", world.PRIVILEGE_ZERO, "charset"},
+		{"una", world.PRIVILEGE_ZERO, "unalias"},
+		{"/sh", world.PRIVILEGE_LORD, "/shutdown"},
+		{"/sh", world.PRIVILEGE_NORMAL, ""},
+		{"xyzzy", world.PRIVILEGE_ZERO, ""},
+	}
+	for _, c := range cases {
+		action, _ := FindAction(c.command, c.privilege)
+		name := ""
+		if action != nil {
+			name = action.Name
+		}
+		if name != c.expected {
+			test.Errorf("FindAction(%q, %d): %q, expected %q", c.command, c.privilege, name, c.expected)
+		}
+	}
+}
+
+func TestFindActionAmbiguous(test *testing.T) {
+	actions := map[string]Action{
+		"/shutdown": Action{"/shutdown", world.PRIVILEGE_LORD, nil, "", "", 0},
+		"/snoop":    Action{"/snoop", world.PRIVILEGE_LORD, nil, "", "", 0},
+		"/stat":     Action{"/stat", world.PRIVILEGE_IMPLEMENTOR, nil, "", "", 0},
+		"say":       Action{"say", world.PRIVILEGE_ZERO, nil, "", "", 10},
+		"score":     Action{"score", world.PRIVILEGE_ZERO, nil, "", "", 0},
+	}
+	action, candidates := findAction(actions, "/s", world.PRIVILEGE_LORD)
+	if action != nil {
+		test.Errorf("findAction(\"/s\") should be ambiguous, found %s", action.Name)
+	}
+	if strings.Join(candidates, " ") != "/shutdown /snoop" {
+		test.Errorf("findAction(\"/s\") candidates: %v", candidates)
+	}
+	// A higher priority decides between abbreviations.
+	if action, _ = findAction(actions, "s", world.PRIVILEGE_ZERO); action == nil || action.Name != "say" {
+		test.Errorf("findAction(\"s\") should find say: %v", action)
+	}
+}
+
+func TestParseCommand(test *testing.T) {
+	data := &ActionData{}
+	if err := ParseCommand([]byte("  say hello  there, you "), data); err != nil {
+		test.Fatalf("ParseCommand: %v", err)
+	}
+	if string(data.Command) != "say" || string(data.Rest) != "hello  there, you" {
+		test.Errorf("ParseCommand: %q %q", data.Command, data.Rest)
+	}
+}
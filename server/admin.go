@@ -0,0 +1,399 @@
+package server
+
+/* This file contains the actions for administrators, and the audit trail
+ * that records who used them on whom. */
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/beoran/woe/monolog"
+	"github.com/beoran/woe/telnet"
+	"github.com/beoran/woe/world"
+)
+
+// Returns the path of the audit trail.
+func (me *Server) AuditPath() string {
+	return filepath.Join(me.DataPath(), "log", "audit.log")
+}
+
+// Records an administrative action in the audit trail, together with the
+// account and address of the client that did it.
+func (me *Client) Audit(format string, args ...interface{}) {
+	what := fmt.Sprintf(format, args...)
+	line := fmt.Sprintf("%s %s (%s): %s\n", time.Now().Format(time.RFC3339),
+		me.AccountName(), me.Address(), what)
+	monolog.Log("AUDIT", "%s", strings.TrimSpace(line))
+
+	path := me.server.AuditPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		monolog.Error("Could not create audit trail directory: %v", err)
+		return
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		monolog.Error("Could not open audit trail %s: %v", path, err)
+		return
+	}
+	defer file.Close()
+	file.WriteString(line)
+}
+
+// Returns the IP address the client is connected from.
+func (me *Client) Address() string {
+	if me.conn == nil {
+		return ""
+	}
+	address := me.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// Returns the name of the account of the client, or "-" if not logged in.
+func (me *Client) AccountName() string {
+	if me.account == nil {
+		return "-"
+	}
+	return me.account.Name
+}
+
+// Returns a log entry with the client id, address and account name as
+// fields, for messages about the client.
+func (me *Client) Log() *monolog.Entry {
+	return monolog.WithFields(monolog.Fields{
+		"client":  me.id,
+		"address": me.Address(),
+		"account": me.AccountName(),
+	})
+}
+
+// Returns the privilege of the account of the client, or zero if not
+// logged in.
+func (me *Client) Privilege() world.Privilege {
+	if me.account == nil {
+		return world.PRIVILEGE_ZERO
+	}
+	return me.account.Privilege
+}
+
+// Finds a connected client by account or character name.
+func (me *Server) FindClient(name string) *Client {
+	for _, client := range me.Clients() {
+		if !client.IsAlive() {
+			continue
+		}
+		if client.account != nil && strings.EqualFold(client.account.Name, name) {
+			return client
+		}
+		if client.character != nil && strings.EqualFold(client.character.Name, name) {
+			return client
+		}
+	}
+	return nil
+}
+
+// Returns true if the client may use an administrative action on a target
+// with the given privilege. Only targets with a lower privilege may be
+// acted upon.
+func (me *Client) Outranks(privilege world.Privilege) bool {
+	return me.Privilege() > privilege
+}
+
+// Sends a copy of the text to the client that snoops this one, if any.
+func (me *Client) snoop(text string) {
+	snooper := me.snooper
+	if snooper == nil || text == "" {
+		return
+	}
+	if !snooper.IsAlive() {
+		me.snooper = nil
+		return
+	}
+	prefix := "[" + me.AccountName() + "] "
+	text = strings.TrimRight(text, "\r\n")
+	text = prefix + strings.Replace(text, "\n", "\n"+prefix, -1)
+	snooper.Printf("%s\n", text)
+}
+
+// Returns true if the client snoops the other, directly or through others.
+func (me *Client) IsSnooping(other *Client) bool {
+	for snooper := other.snooper; snooper != nil; snooper = snooper.snooper {
+		if snooper == me {
+			return true
+		}
+	}
+	return false
+}
+
+// Makes the client act as if it sent the command itself.
+func (me *Client) Force(command string) bool {
+	data := me.info.encoding.Encode(command + "\n")
+	select {
+	case me.telnet.Events <- &telnet.DataEvent{Data: data}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Finds the account with the given name, whether it is logged in or not.
+// The account is only loaded, not linked to the world.
+func (me *Server) FindAccount(name string) (account *world.Account, err error) {
+	if client := me.FindClient(name); client != nil && client.account != nil {
+		return client.account, nil
+	}
+	if account = me.World.GetAccount(name); account != nil {
+		return account, nil
+	}
+	return world.LoadAccount(me.storage, name)
+}
+
+// Changes the privilege of an account, for /promote and /demote.
+func changePrivilege(data *ActionData, promote bool) (err error) {
+	client := data.Client
+	args := strings.Fields(string(data.Rest))
+	if len(args) < 1 || len(args) > 2 {
+		return ErrUsage
+	}
+	account, err := data.Server.FindAccount(args[0])
+	if err != nil || account == nil {
+		client.Printf("No account named %s.\n", args[0])
+		return nil
+	}
+	if !client.Outranks(account.Privilege) {
+		client.Printf("You can't change the privilege of %s.\n", account.Name)
+		return nil
+	}
+
+	privilege := account.Privilege - world.PRIVILEGE_NORMAL
+	if promote {
+		privilege = account.Privilege + world.PRIVILEGE_NORMAL
+	}
+	if len(args) > 1 {
+		var ok bool
+		if privilege, ok = world.ParsePrivilege(args[1]); !ok {
+			client.Printf("Unknown privilege %s.\n", args[1])
+			return nil
+		}
+	}
+	if promote && privilege <= account.Privilege {
+		client.Printf("%s already has privilege %s.\n", account.Name, account.Privilege)
+		return nil
+	} else if !promote && privilege >= account.Privilege {
+		client.Printf("%s only has privilege %s.\n", account.Name, account.Privilege)
+		return nil
+	}
+	if privilege < world.PRIVILEGE_ZERO {
+		privilege = world.PRIVILEGE_ZERO
+	}
+	if client.Privilege() < world.PRIVILEGE_IMPLEMENTOR && !client.Outranks(privilege) {
+		client.Printf("You can't give a privilege of %s.\n", privilege)
+		return nil
+	}
+
+	old := account.Privilege
+	account.Change(func() { account.Privilege = privilege })
+	if err = account.Save(data.Server.Storage()); err != nil {
+		account.Change(func() { account.Privilege = old })
+		return err
+	}
+	client.Audit("changed privilege of %s from %s to %s", account.Name, old, privilege)
+	client.Printf("%s now has privilege %s.\n", account.Name, privilege)
+	if target := data.Server.FindClient(account.Name); target != nil && target != client {
+		target.Printf("Your privilege is now %s.\n", privilege)
+	}
+	return nil
+}
+
+func doPromote(data *ActionData) (err error) {
+	return changePrivilege(data, true)
+}
+
+func doDemote(data *ActionData) (err error) {
+	return changePrivilege(data, false)
+}
+
+// Lists the connected clients. With -all, clients that are not logged in
+// yet are listed as well.
+func doAdminWho(data *ActionData) (err error) {
+	client := data.Client
+	all := false
+	switch strings.TrimSpace(string(data.Rest)) {
+	case "-all":
+		all = true
+	case "":
+	default:
+		return ErrUsage
+	}
+	client.Printf("%-4s %-16s %-16s %-12s %s\n", "ID", "Account", "Character", "Privilege", "Address")
+	for _, other := range data.Server.Clients() {
+		if !other.IsAlive() || (!all && !other.IsLoginFinished()) {
+			continue
+		}
+		character := "-"
+		if other.character != nil {
+			character = other.character.Name
+		}
+		client.Printf("%-4d %-16s %-16s %-12s %s\n", other.id, other.AccountName(),
+			character, other.Privilege(), other.Address())
+	}
+	return nil
+}
+
+func doKick(data *ActionData) (err error) {
+	client := data.Client
+	args := strings.SplitN(string(data.Rest), " ", 2)
+	if args[0] == "" {
+		return ErrUsage
+	}
+	target := data.Server.FindClient(args[0])
+	if target == nil {
+		client.Printf("%s is not connected.\n", args[0])
+		return nil
+	}
+	if !client.Outranks(target.Privilege()) {
+		client.Printf("You can't kick %s.\n", args[0])
+		return nil
+	}
+	reason := "no reason given"
+	if len(args) > 1 {
+		reason = strings.TrimSpace(args[1])
+	}
+	name := target.AccountName()
+	client.Audit("kicked %s: %s", name, reason)
+	target.Printf("You have been kicked: %s\n", reason)
+	target.Hangup()
+	client.Printf("Kicked %s.\n", name)
+	return nil
+}
+
+func doBan(data *ActionData) (err error) {
+	client := data.Client
+	bans := data.World.Bans()
+	args := strings.SplitN(string(data.Rest), " ", 2)
+	if args[0] == "" {
+		for _, ban := range bans.Bans() {
+			client.Printf("%-8s %-20s by %s on %s: %s\n", ban.Kind, ban.Target,
+				ban.By, ban.Time.Format("2006-01-02"), ban.Reason)
+		}
+		client.Printf("%d bans.\n", len(bans.Bans()))
+		return nil
+	}
+	reason := "no reason given"
+	if len(args) > 1 {
+		reason = strings.TrimSpace(args[1])
+	}
+	ban := world.NewBan(args[0], client.AccountName(), reason)
+	if ban.Kind == world.BAN_ACCOUNT {
+		account, err := data.Server.FindAccount(ban.Target)
+		if err == nil && account != nil && !client.Outranks(account.Privilege) {
+			client.Printf("You can't ban %s.\n", account.Name)
+			return nil
+		}
+	} else if ban.Matches("", client.Address()) {
+		client.Printf("You can't ban your own address.\n")
+		return nil
+	}
+	bans.Add(ban)
+	if err = data.World.SaveBans(); err != nil {
+		return err
+	}
+	client.Audit("banned %s %s: %s", ban.Kind, ban.Target, reason)
+	client.Printf("Banned %s %s.\n", ban.Kind, ban.Target)
+
+	for _, target := range data.Server.Clients() {
+		if target != client && target.IsAlive() &&
+			ban.Matches(target.AccountName(), target.Address()) &&
+			client.Outranks(target.Privilege()) {
+			target.Printf("You have been banned: %s\n", reason)
+			target.Hangup()
+		}
+	}
+	return nil
+}
+
+func doUnban(data *ActionData) (err error) {
+	client := data.Client
+	target := strings.TrimSpace(string(data.Rest))
+	if target == "" {
+		return ErrUsage
+	}
+	if !data.World.Bans().Remove(target) {
+		client.Printf("%s is not banned.\n", target)
+		return nil
+	}
+	if err = data.World.SaveBans(); err != nil {
+		return err
+	}
+	client.Audit("unbanned %s", target)
+	client.Printf("Unbanned %s.\n", target)
+	return nil
+}
+
+// Snoops a client, or stops snooping without a name.
+func doSnoop(data *ActionData) (err error) {
+	client := data.Client
+	name := strings.TrimSpace(string(data.Rest))
+	if name == "" {
+		for _, target := range data.Server.Clients() {
+			if target.snooper == client {
+				target.snooper = nil
+				client.Audit("stopped snooping %s", target.AccountName())
+				client.Printf("Stopped snooping %s.\n", target.AccountName())
+			}
+		}
+		return nil
+	}
+	target := data.Server.FindClient(name)
+	if target == nil {
+		client.Printf("%s is not connected.\n", name)
+		return nil
+	}
+	if target == client || target.IsSnooping(client) {
+		client.Printf("You can't snoop %s.\n", name)
+		return nil
+	}
+	if !client.Outranks(target.Privilege()) {
+		client.Printf("You can't snoop %s.\n", name)
+		return nil
+	}
+	if target.snooper != nil && target.snooper != client {
+		client.Printf("%s is already snooped by %s.\n", name, target.snooper.AccountName())
+		return nil
+	}
+	target.snooper = client
+	client.Audit("snoops %s", target.AccountName())
+	client.Printf("Snooping %s.\n", target.AccountName())
+	return nil
+}
+
+func doForce(data *ActionData) (err error) {
+	client := data.Client
+	args := strings.SplitN(string(data.Rest), " ", 2)
+	if len(args) < 2 || strings.TrimSpace(args[1]) == "" {
+		return ErrUsage
+	}
+	target := data.Server.FindClient(args[0])
+	if target == nil || !target.IsLoginFinished() {
+		client.Printf("%s is not playing.\n", args[0])
+		return nil
+	}
+	if !client.Outranks(target.Privilege()) {
+		client.Printf("You can't force %s.\n", args[0])
+		return nil
+	}
+	command := strings.TrimSpace(args[1])
+	if !target.Force(command) {
+		client.Printf("%s is too busy.\n", target.AccountName())
+		return nil
+	}
+	client.Audit("forced %s to %s", target.AccountName(), command)
+	client.Printf("Forced %s to %s.\n", target.AccountName(), command)
+	return nil
+}
@@ -0,0 +1,17 @@
+package server
+
+import "testing"
+
+func TestSnoopChain(test *testing.T) {
+	lord := &Client{}
+	master := &Client{}
+	player := &Client{}
+	player.snooper = master
+	master.snooper = lord
+	if !lord.IsSnooping(player) || !master.IsSnooping(player) {
+		test.Errorf("Snoop chain not detected")
+	}
+	if player.IsSnooping(lord) {
+		test.Errorf("Player should not snoop lord")
+	}
+}
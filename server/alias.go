@@ -0,0 +1,109 @@
+package server
+
+/* This file contains command aliases, command stacking and repeating
+ * of the last command, so players need fewer keystrokes. */
+
+import "strconv"
+import "strings"
+import "github.com/beoran/woe/monolog"
+
+// Separates stacked commands on a single line.
+const COMMAND_SEPARATOR = ";"
+
+// Repeats the last command line.
+const COMMAND_REPEAT = "!"
+
+// Maximum amount of commands a single line may expand to.
+const COMMAND_STACK_MAX = 20
+
+// Lines starting with these commands are not split on the separator,
+// so aliases can be defined with stacked commands.
+var CommandsNotStacked = []string{"alias"}
+
+// Expands an alias with the arguments it was called with. $1 to $9 are
+// replaced by the arguments, $* by all of them. If the expansion uses no
+// arguments at all, they are appended to it.
+func ExpandAlias(expansion string, args []string) string {
+	used := false
+	replacements := []string{"$*", strings.Join(args, " ")}
+	for index := 1; index <= 9; index++ {
+		arg := ""
+		if index <= len(args) {
+			arg = args[index-1]
+		}
+		replacements = append(replacements, "$"+strconv.Itoa(index), arg)
+	}
+	for index := 0; index < len(replacements); index += 2 {
+		if strings.Contains(expansion, replacements[index]) {
+			used = true
+		}
+	}
+	result := strings.NewReplacer(replacements...).Replace(expansion)
+	if !used && len(args) > 0 {
+		result += " " + strings.Join(args, " ")
+	}
+	return result
+}
+
+// Splits a line into stacked commands, unless it starts with one of
+// CommandsNotStacked.
+func SplitCommands(line string) []string {
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		for _, command := range CommandsNotStacked {
+			if fields[0] == command {
+				return []string{strings.TrimSpace(line)}
+			}
+		}
+	}
+	var commands []string
+	for _, command := range strings.Split(line, COMMAND_SEPARATOR) {
+		command = strings.TrimSpace(command)
+		if command != "" {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// Returns the alias the command starts with, if the character has one.
+func (me *Client) FindAlias(command string) (expansion string, args []string, ok bool) {
+	if me.character == nil {
+		return "", nil, false
+	}
+	fields := strings.Fields(command)
+	if len(fields) < 1 {
+		return "", nil, false
+	}
+	expansion, ok = me.character.Aliases[fields[0]]
+	return expansion, fields[1:], ok
+}
+
+// Expands a line of input into the commands to run. Handles repeating
+// of the last line, command stacking and aliases. Aliases are expanded
+// only once, so an alias can't call itself.
+func (me *Client) ExpandCommands(line string) []string {
+	if strings.TrimSpace(line) == COMMAND_REPEAT {
+		if me.lastCommand == "" {
+			return nil
+		}
+		line = me.lastCommand
+	} else {
+		me.lastCommand = line
+	}
+
+	var commands []string
+	for _, command := range SplitCommands(line) {
+		if expansion, args, ok := me.FindAlias(command); ok {
+			expanded := ExpandAlias(expansion, args)
+			commands = append(commands, SplitCommands(expanded)...)
+		} else {
+			commands = append(commands, command)
+		}
+	}
+	if len(commands) > COMMAND_STACK_MAX {
+		monolog.Warning("Client %d line expands to %d commands, truncated.", me.id, len(commands))
+		commands = commands[:COMMAND_STACK_MAX]
+	}
+	return commands
+}
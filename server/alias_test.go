@@ -0,0 +1,48 @@
+package server
+
+import "testing"
+import "github.com/beoran/woe/world"
+
+func TestExpandAlias(test *testing.T) {
+	cases := []struct {
+		expansion string
+		args      []string
+		expected  string
+	}{
+		{"say $1 is $2", []string{"sky", "blue"}, "say sky is blue"},
+		{"tell $1 $*", []string{"bob", "hi"}, "tell bob bob hi"},
+		{"look", []string{"north"}, "look north"},
+		{"get $1 from $2", []string{"sword"}, "get sword from "},
+	}
+	for _, c := range cases {
+		if result := ExpandAlias(c.expansion, c.args); result != c.expected {
+			test.Errorf("ExpandAlias(%q, %v): %q, expected %q", c.expansion, c.args, result, c.expected)
+		}
+	}
+}
+
+func TestExpandCommands(test *testing.T) {
+	character := &world.Character{}
+	character.SetAlias("ln", "look $1;north")
+	client := &Client{character: character}
+
+	commands := client.ExpandCommands("ln sword; say done ;;")
+	expected := []string{"look sword", "north", "say done"}
+	if len(commands) != len(expected) {
+		test.Fatalf("Wrong commands: %q", commands)
+	}
+	for index := range expected {
+		if commands[index] != expected[index] {
+			test.Errorf("Command %d: %q, expected %q", index, commands[index], expected[index])
+		}
+	}
+
+	repeated := client.ExpandCommands(COMMAND_REPEAT)
+	if len(repeated) != len(expected) || repeated[0] != expected[0] {
+		test.Errorf("Wrong repeat: %q", repeated)
+	}
+
+	if defined := client.ExpandCommands("alias x a;b"); len(defined) != 1 {
+		test.Errorf("Alias definition should not be split: %q", defined)
+	}
+}
@@ -2,7 +2,7 @@ package server
 
 /* This file contains dialog helpers for the client. */
 
-// import "github.com/beoran/woe/monolog"
+import "github.com/beoran/woe/monolog"
 import t "github.com/beoran/woe/telnet"
 import "github.com/beoran/woe/telnet"
 import "github.com/beoran/woe/world"
@@ -12,8 +12,9 @@ import "bytes"
 import "strings"
 import "regexp"
 
-// import "fmt"
+import "fmt"
 import "strconv"
+import "time"
 
 // import "strings"
 
@@ -25,12 +26,9 @@ func (me *Client) PasswordMode() telnet.Event {
 	// It should also do whatever is appropriate for password entry to the input
 	// box thing - for example, it might * it out. Text entered in server-echoes
 	// mode should also not be placed any command history.
-	// don't use the Q state machne for echos
-	me.telnet.TelnetSendBytes(t.TELNET_IAC, t.TELNET_WILL, t.TELNET_TELOPT_ECHO)
-	tev, _, _ := me.TryReadEvent(100)
-	if tev != nil && !telnet.IsEventType(tev, t.TELNET_DO_EVENT) {
-		return tev
-	}
+	// The answer is handled as it arrives by HandleTelnetEvent.
+	me.telnet.RequestNegotiate(t.TELNET_WILL, t.TELNET_TELOPT_ECHO)
+	me.password.Store(true)
 	return nil
 }
 
@@ -38,17 +36,26 @@ func (me *Client) PasswordMode() telnet.Event {
 func (me *Client) NormalMode() telnet.Event {
 	// When the server wants the client to start local echoing again, it s}s
 	// "IAC WONT ECHO" - the client must respond to this with "IAC DONT ECHO".
-	// Again don't use Q state machine.
-	me.telnet.TelnetSendBytes(t.TELNET_IAC, t.TELNET_WONT, t.TELNET_TELOPT_ECHO)
-	tev, _, _ := me.TryReadEvent(100)
-	if tev != nil && !telnet.IsEventType(tev, t.TELNET_DONT_EVENT) {
-		return tev
-	}
+	me.telnet.RequestNegotiate(t.TELNET_WONT, t.TELNET_TELOPT_ECHO)
+	me.password.Store(false)
 	return nil
 }
 
+// Prints formatted text to the client. For MXP clients the text is
+// escaped, so nothing in it is taken as markup. Use MXPPrintf for markup.
 func (me *Client) Printf(format string, args ...interface{}) {
-	me.telnet.TelnetPrintf(format, args...)
+	text := fmt.Sprintf(format, args...)
+	me.snoop(text)
+	me.send(me.MXPText(text))
+}
+
+// Sends text to the client in its character set, as it is.
+func (me *Client) send(text string) {
+	if me.info.encoding.IsUTF8() {
+		me.telnet.TelnetPrintf("%s", text)
+		return
+	}
+	me.telnet.TelnetPrintf("%s", me.info.encoding.Encode(text))
 }
 
 func (me *Client) ColorTest() {
@@ -66,17 +73,11 @@ func (me *Client) ColorTest() {
 	}
 }
 
-// Blockingly reads a single command from the client
+// Blockingly reads a single command from the client.
+// Returns nil if the client disconnected.
 func (me *Client) ReadCommand() (something []byte) {
-	something = nil
-	for something == nil {
-		something, _, _ = me.TryRead(-1)
-		if something != nil {
-			something = bytes.TrimRight(something, "\r\n")
-			return something
-		}
-	}
-	return nil
+	something, _, _ = me.TryReadLine(-1)
+	return something
 }
 
 func (me *Client) AskSomething(prompt string, re string, nomatch_prompt string, noecho bool) (something []byte) {
@@ -88,9 +89,12 @@ func (me *Client) AskSomething(prompt string, re string, nomatch_prompt string,
 
 	for something == nil || len(something) == 0 {
 		me.Printf("%s", prompt)
-		something, _, _ = me.TryRead(-1)
+		var done bool
+		something, _, done = me.TryReadLine(-1)
+		if done {
+			return nil
+		}
 		if something != nil {
-			something = bytes.TrimRight(something, "\r\n")
 			if len(re) > 0 {
 				ok, _ := regexp.Match(re, something)
 				if !ok {
@@ -111,6 +115,9 @@ func (me *Client) AskSomething(prompt string, re string, nomatch_prompt string,
 
 func (me *Client) AskYesNo(prompt string) bool {
 	res := me.AskSomething(prompt+" (y/n)", "[ynYN]", "Please answer y or n.", false)
+	if len(res) < 1 {
+		return false
+	}
 	if res[0] == 'Y' || res[0] == 'y' {
 		return true
 	} else {
@@ -371,10 +378,11 @@ func (me *Client) AskOptionListOnce(heading string, prompt string, noecho bool,
 	for i := 0; i < list.AskOptionListLen(); i++ {
 		v := list.AskOptionListGet(i)
 		sh := v.AskShort()
+		name := me.MXPCommand(v.AskName(), sh, strconv.Itoa(i+1))
 		if sh == "" {
-			me.Printf("[%d] %s\n", i+1, v.AskName())
+			me.MXPPrintf("[%d] %s\n", i+1, name)
 		} else {
-			me.Printf("[%d] %s: %s\n", i+1, v.AskName(), sh)
+			me.MXPPrintf("[%d] %s: %s\n", i+1, name, me.MXPText(sh))
 		}
 	}
 	me.Printf("\n")
@@ -426,13 +434,15 @@ func (me *Client) AskEntityListOnce(
 	last := 0
 	for i, v := range list {
 		e := v.AsEntity()
-		me.Printf("[%d] %s: %s\n", i+1, e.Name, e.Short)
+		name := me.MXPCommand(e.Name, e.Short, strconv.Itoa(i+1))
+		me.MXPPrintf("[%d] %s: %s\n", i+1, name, me.MXPText(e.Short))
 		last = i + 1
 	}
 
 	if extras != nil {
 		for i, v := range extras {
-			me.Printf("[%d] %s\n", last+i+1, v)
+			name := me.MXPCommand(v, "", strconv.Itoa(last+i+1))
+			me.MXPPrintf("[%d] %s\n", last+i+1, name)
 		}
 	}
 
@@ -486,8 +496,16 @@ func (me *Client) AskEntityList(
 
 const LOGIN_RE = "^[A-Za-z][A-Za-z0-9]*$"
 
+// Also accepts an MSSP request from a crawler in stead of a login.
+// The MSSP data is then sent and nil is returned.
 func (me *Client) AskLogin() []byte {
-	return me.AskSomething("Login?>", LOGIN_RE, "Login must consist of letters followed by letters or numbers.", false)
+	login := me.AskSomething("Login?>", LOGIN_RE+"|^"+MSSP_REQUEST+"$", "Login must consist of letters followed by letters or numbers.", false)
+	if string(login) == MSSP_REQUEST {
+		monolog.Info("Client %d sent an MSSP request", me.id)
+		me.SendMSSPReply()
+		return nil
+	}
+	return login
 }
 
 const EMAIL_RE = "@"
@@ -512,5 +530,20 @@ func (me *Client) AskRepeatPassword() []byte {
 
 func (me *Client) HandleCommand() {
 	command := me.ReadCommand()
-	me.ProcessCommand(command)
+	// A client that was kicked while it waited doesn't run its command.
+	if command == nil || !me.IsAlive() {
+		return
+	}
+	me.lastInput = time.Now()
+	if me.snooper != nil {
+		me.snoop("< " + string(command))
+	}
+	for _, expanded := range me.ExpandCommands(string(command)) {
+		if !me.IsAlive() {
+			break
+		}
+		me.ProcessCommand([]byte(expanded))
+	}
+	me.SendGMCPUpdate()
+	me.SendMSDPUpdate()
 }
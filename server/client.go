@@ -3,6 +3,7 @@ package server
 import (
 	// "fmt"
 	"net"
+	"sync/atomic"
 	"time"
 	// "errors"
 	// "io"
@@ -26,8 +27,20 @@ type ClientInfo struct {
 	ttype     bool
 	binary    bool
 	sga       bool
+	gmcp      bool
 	terminals []string
 	terminal  string
+	// NEW-ENVIRON support and the variables sent by the client.
+	environment   bool
+	environ       map[string]string
+	clientName    string
+	clientVersion string
+	charset       string
+	ipaddress     string
+	// Character set of the client, nil for UTF-8.
+	encoding *telnet.Charset
+	// GMCP packages supported by the client and their versions.
+	gmcpSupports map[string]int
 }
 
 type Client struct {
@@ -41,6 +54,8 @@ type Client struct {
 	timechan chan time.Time
 	telnet   *telnet.Telnet
 	info     ClientInfo
+	// Closed when ServeWrite has sent everything to the client.
+	writedone chan bool
 
 	// Account of client or nil if not yet selected.
 	account *world.Account
@@ -49,6 +64,32 @@ type Client struct {
 	// Message channels that this client is listening to once fully logged in.
 	// Not to be confused with Go channels.
 	channels map[string]bool
+	// Last GMCP vitals and room sent, to send only changes.
+	gmcpVitals *GMCPVitals
+	gmcpRoom   string
+	// MSDP variables reported to the client, with their last sent value.
+	msdpReported map[string]string
+	// Telnet options that are not yet answered during the telnet setup.
+	setupPending map[byte]bool
+	// Assembles the input of the client into lines.
+	lines *LineAssembler
+	// Last command line, for repeating it.
+	lastCommand string
+	// Administrator that receives a copy of the input and output, or nil.
+	snooper *Client
+	// Time of the last command, for the idle time.
+	lastInput time.Time
+	// Time the connection was lost while playing, zero if connected.
+	linkdead time.Time
+	// True if the telnet traffic of the client is logged, see /trace.
+	trace atomic.Bool
+	// True while the client is asked for a password, so it is not traced.
+	password atomic.Bool
+	// Receives the log lines for /tail, or nil.
+	tail chan string
+	// True while tail is set. What is sent to the client is then not
+	// logged, or each log line shown would be logged and shown again.
+	tailing atomic.Bool
 }
 
 func NewClient(server *Server, id int, conn net.Conn) *Client {
@@ -58,18 +99,51 @@ func NewClient(server *Server, id int, conn net.Conn) *Client {
 	telnet := telnet.New()
 	channels := make(map[string]bool)
 	info := ClientInfo{w: -1, h: -1, terminal: "none"}
-	return &Client{server, id, conn, true, -1, datachan, errchan, timechan, telnet, info, nil, nil, channels}
+	writedone := make(chan bool)
+	return &Client{server, id, conn, true, -1, datachan, errchan, timechan, telnet, info, writedone, nil, nil, channels, nil, "", nil, nil, NewLineAssembler(), "", nil, time.Now(), time.Time{},
+		atomic.Bool{}, atomic.Bool{}, nil, atomic.Bool{}}
 }
 
+// How long closing a client waits for the output to be sent.
+const CLOSE_TIMEOUT = time.Second
+
 func (me *Client) Close() {
+	// A client that stops reading would block ServeWrite, and with it
+	// everything that sends to the client, so writing gets a deadline.
+	me.conn.SetWriteDeadline(time.Now().Add(CLOSE_TIMEOUT))
+	// Close the telnet stream first, so the end of the compressed stream,
+	// if any, is sent before the connection is closed.
+	me.telnet.Close()
+	select {
+	case <-me.writedone:
+	case <-time.After(CLOSE_TIMEOUT):
+		me.Log().Warning("Timeout waiting for output to be sent.")
+	}
 	me.conn.Close()
 	me.alive = false
+	me.StopTail()
 	if me.account != nil {
+		me.Save()
 		me.server.World.RemoveAccount(me.account.Name)
 	}
 	me.account = nil
 }
 
+// Saves the character and the account of the client, if it has them.
+func (me *Client) Save() {
+	storage := me.server.Storage()
+	if me.character != nil {
+		if err := me.character.Save(storage); err != nil {
+			me.Log().Error("Could not save character %s: %v", me.character.ID, err)
+		}
+	}
+	if me.account != nil {
+		if err := me.account.Save(storage); err != nil {
+			me.Log().Error("Could not save account %s: %v", me.account.Name, err)
+		}
+	}
+}
+
 /** Goroutine that does the actual reading of input data, and sends it to the
  * needed channels. */
 func (me *Client) ServeRead() {
@@ -82,7 +156,12 @@ func (me *Client) ServeRead() {
 			me.errchan <- err
 			return
 		}
-		monolog.Log("SERVEREAD", "Read data from client: %v", buffer[:read], read)
+		if me.password.Load() {
+			monolog.Log("SERVEREAD", "Read %d bytes of password from client", read)
+		} else {
+			monolog.Log("SERVEREAD", "Read data from client: %v", buffer[:read])
+		}
+		me.traceData("Read", buffer[:read])
 		// reply will be stored in me.telnet.Events channel
 		me.telnet.ProcessBytes(buffer[:read])
 	}
@@ -92,12 +171,13 @@ func (me *Client) ServeRead() {
  * to the connected client.
  */
 func (me *Client) ServeWrite() {
-	for me.alive {
-		select {
-		case data := <-me.telnet.ToClient:
+	defer close(me.writedone)
+	for data := range me.telnet.ToClient {
+		if !me.tailing.Load() {
 			monolog.Log("SERVEWRITE", "Will send to client: %v", data)
-			me.conn.Write(data)
+			me.traceData("Sent", data)
 		}
+		me.conn.Write(data)
 	}
 }
 
@@ -105,62 +185,90 @@ func (me *Client) TryReadEvent(millis int) (event telnet.Event, timeout bool, cl
 	var timerchan <-chan (time.Time)
 
 	if millis >= 0 {
-		timerchan = time.Tick(time.Millisecond * time.Duration(millis))
+		timer := time.NewTimer(time.Millisecond * time.Duration(millis))
+		defer timer.Stop()
+		timerchan = timer.C
 	} else {
 		/* If time is negative, block by using a fake time channel that never gets sent anyting */
 		timerchan = make(<-chan (time.Time))
 	}
+	// Vitals can change without a command, so they are checked while
+	// waiting, and sent if they changed.
+	vitals := time.NewTicker(GMCP_VITALS_INTERVAL)
+	defer vitals.Stop()
 
-	select {
-	case event := <-me.telnet.Events:
-		return event, false, false
-
-	case err := <-me.errchan:
-		monolog.Info("Connection closed: %s\n", err)
-		me.Close()
-		return nil, false, true
-
-	case _ = <-timerchan:
-		return nil, true, false
+	for {
+		select {
+		case event := <-me.telnet.Events:
+			return event, false, false
+
+		case err := <-me.errchan:
+			me.Log().Info("Connection closed: %s", err)
+			me.LinkDead()
+			return nil, false, true
+
+		case _ = <-timerchan:
+			return nil, true, false
+
+		case <-vitals.C:
+			if me.info.gmcp {
+				me.SendGMCPVitals()
+			}
+
+		// Log lines for /tail are shown while waiting for input.
+		case line, ok := <-me.tail:
+			if !ok {
+				me.StopTail()
+			} else {
+				me.Printf("%s\n", line)
+			}
+		}
 	}
 }
 
 func (me *Client) HandleNAWSEvent(nawsevent *telnet.NAWSEvent) {
 	me.info.w = nawsevent.W
 	me.info.h = nawsevent.H
-	monolog.Info("Client %d window size #{%d}x#{%d}", me.id, me.info.w, me.info.h)
+	me.Log().Info("Window size %dx%d", me.info.w, me.info.h)
 	me.info.naws = true
 }
 
 func (me *Client) TryRead(millis int) (data []byte, timeout bool, done bool) {
-
 	for me.alive {
 		event, timeout, done := me.TryReadEvent(millis)
 		if event == nil && (timeout || done) {
 			return nil, timeout, done
 		}
-		switch event := event.(type) {
-		case *telnet.DataEvent:
-			monolog.Log("TELNETDATAEVENT", "Telnet data event %T : %d.", event, len(event.Data))
-			return event.Data, false, false
-		case *telnet.NAWSEvent:
-			monolog.Log("TELNETNAWSEVENT", "Telnet NAWS event %T.", event)
-			me.HandleNAWSEvent(event)
-		default:
-			monolog.Info("Ignoring telnet event %T : %v for now.", event, event)
+		if data := me.HandleTelnetEvent(event); data != nil {
+			return data, false, false
 		}
 	}
 
 	return nil, false, true
 }
 
+// Reads a complete line of input, without the line ending. Input that
+// contains several lines is queued, and returned by the following calls.
+func (me *Client) TryReadLine(millis int) (line []byte, timeout bool, done bool) {
+	for {
+		if line, ok := me.lines.Next(); ok {
+			return line, false, false
+		}
+		data, timeout, done := me.TryRead(millis)
+		if data == nil {
+			return nil, timeout, done
+		}
+		me.lines.Write(data)
+	}
+}
+
 func (me *Client) Serve() (err error) {
 	// buffer := make([]byte, 1024, 1024)
 	go me.ServeWrite()
 	go me.ServeRead()
 	me.SetupTelnet()
 	if me.server.World != nil {
-		me.Printf(me.server.World.MOTD)
+		me.Printf("%s", me.server.World.MOTD)
 	}
 	if !me.AccountDialog() {
 		time.Sleep(3)
@@ -169,8 +277,12 @@ func (me *Client) Serve() (err error) {
 		me.Close()
 		return nil
 	}
+	if me.account.Charset != "" {
+		me.SetEncoding(me.account.Charset)
+	}
 
-	if !me.CharacterDialog() {
+	// A client that took over a link dead one already has a character.
+	if me.character == nil && !me.CharacterDialog() {
 		time.Sleep(3)
 		// sleep so output gets flushed, hopefully.
 		// Also slow down brute force attacks.
@@ -179,6 +291,8 @@ func (me *Client) Serve() (err error) {
 	}
 
 	me.Printf("Welcome, %s\n", me.account.Name)
+	me.SendGMCPCharacter()
+	me.PlaySound(world.SOUND_EVENT_ENTER)
 
 	for me.alive {
 		me.HandleCommand()
@@ -200,6 +314,21 @@ func (me *Client) Disconnect() {
 	me.alive = false
 }
 
+// Disconnects the client at once, from another client's goroutine, for
+// example when it is kicked or banned. What was already sent to it is
+// flushed, and then its connection is closed, so it can't run any more
+// commands. The rest is cleaned up by Close as usual.
+func (me *Client) Hangup() {
+	me.alive = false
+	me.conn.SetWriteDeadline(time.Now().Add(CLOSE_TIMEOUT))
+	me.telnet.Close()
+	select {
+	case <-me.writedone:
+	case <-time.After(CLOSE_TIMEOUT):
+	}
+	me.conn.Close()
+}
+
 func (me *Client) IsAlive() bool {
 	return me.alive
 }
@@ -221,8 +350,11 @@ func (me *Client) IsListeningToChannel(channelname string) bool {
 	return true
 }
 
+// Sends a string to the client through the telnet layer, so it gets
+// compressed if needed. The string is escaped for MXP clients.
 func (me *Client) WriteString(str string) {
-	me.conn.Write([]byte(str))
+	me.snoop(str)
+	me.telnet.TelnetSend(me.info.encoding.Encode(me.MXPText(str)))
 }
 
 /** Accessor */
@@ -0,0 +1,28 @@
+package server
+
+import "net"
+import "strings"
+import "testing"
+import "github.com/beoran/woe/monolog"
+
+func TestServeReadHidesPassword(test *testing.T) {
+	ring := monolog.NewRingLogger(16)
+	monolog.AddLogger(ring, nil)
+	monolog.EnableLevel("SERVEREAD")
+
+	conn, other := net.Pipe()
+	client := NewClient(nil, 1, conn)
+	client.password.Store(true)
+	go client.ServeRead()
+	other.Write([]byte("secret\r\n"))
+	other.Close()
+	<-client.errchan
+
+	logged := strings.Join(ring.Lines(0), "\n")
+	if !strings.Contains(logged, "Read 8 bytes of password from client") {
+		test.Errorf("Password read was not logged:\n%s", logged)
+	}
+	if strings.Contains(logged, "115 101 99") {
+		test.Errorf("Password was logged:\n%s", logged)
+	}
+}
@@ -49,7 +49,7 @@ func (me *Client) NewAccountDialog(login string) bool {
 		}
 
 		me.account = world.NewAccount(login, string(pass1), string(email), 7)
-		err := me.account.Save(me.server.DataPath())
+		err := me.account.Save(me.server.Storage())
 
 		if err != nil {
 			monolog.Error("Could not save account %s: %v", login, err)
@@ -71,12 +71,16 @@ func (me *Client) AccountDialog() bool {
 	}
 	var err error
 
-	if me.server.World.GetAccount(string(login)) != nil {
-		me.Printf("Account already logged in!\n")
-		me.Printf("Disconnecting!\n")
+	if ban := me.server.World.Bans().Find(string(login), ""); ban != nil {
+		me.Log().Warning("Banned account %s refused.", login)
+		me.Printf("This account is banned: %s\n", ban.Reason)
 		return false
 	}
 
+	if account := me.server.World.GetAccount(string(login)); account != nil {
+		return me.ReconnectDialog(account)
+	}
+
 	me.account, err = me.server.World.LoadAccount(string(login))
 	if err != nil {
 		monolog.Warning("Could not load account %s: %v", login, err)
@@ -88,6 +92,38 @@ func (me *Client) AccountDialog() bool {
 	}
 }
 
+// Lets a player take over their link dead client, with its character.
+func (me *Client) ReconnectDialog(account *world.Account) bool {
+	if me.server.FindLinkDead(account.Name) == nil {
+		me.Printf("Account already logged in!\n")
+		me.Printf("Disconnecting!\n")
+		return false
+	}
+	me.account = account
+	if !me.ExistingAccountDialog() {
+		me.account = nil
+		return false
+	}
+	// The link dead client is removed from the server here, so the reaper
+	// can't close it while it is taken over.
+	linkdead := me.server.FindLinkDead(account.Name)
+	if linkdead == nil || !me.server.removeClient(linkdead) {
+		// It timed out and was closed while the password was asked.
+		var err error
+		if me.account, err = me.server.World.LoadAccount(account.Name); err != nil {
+			monolog.Error("Could not load account %s: %v", account.Name, err)
+			return false
+		}
+		return true
+	}
+	me.Log().Info("Takes over link dead client %d of %s", linkdead.id, account.Name)
+	me.TakeOver(linkdead)
+	if me.character != nil {
+		me.Printf("Reconnected to %s.\n", me.character.Name)
+	}
+	return true
+}
+
 func (me *Client) NewCharacterDialog() bool {
 	noconfirm := true
 	extra := TrivialAskOptionList{TrivialAskOption("Cancel")}
@@ -95,7 +131,7 @@ func (me *Client) NewCharacterDialog() bool {
 	me.Printf("New character:\n")
 	charname := me.AskCharacterName()
 
-	existing, aname, _ := world.LoadCharacterByName(me.server.DataPath(), string(charname))
+	existing, aname, _ := world.LoadCharacterByName(me.server.Storage(), string(charname))
 
 	for existing != nil {
 		if aname == me.account.Name {
@@ -104,7 +140,7 @@ func (me *Client) NewCharacterDialog() bool {
 			me.Printf("That character name is already taken by someone else.\n")
 		}
 		charname := me.AskCharacterName()
-		existing, aname, _ = world.LoadCharacterByName(me.server.DataPath(), string(charname))
+		existing, aname, _ = world.LoadCharacterByName(me.server.Storage(), string(charname))
 	}
 
 	kinres := me.AskOptionListExtra("Please choose the kin of this character", "Kin?> ", false, noconfirm, KinListAsker(world.KinList), extra)
@@ -157,9 +193,9 @@ func (me *Client) NewCharacterDialog() bool {
 	}
 
 	me.account.AddCharacter(character)
-	me.account.Points -= NEW_CHARACTER_PRICE
-	me.account.Save(me.server.DataPath())
-	character.Save(me.server.DataPath())
+	me.account.Change(func() { me.account.Points -= NEW_CHARACTER_PRICE })
+	me.account.Save(me.server.Storage())
+	character.Save(me.server.Storage())
 	me.Printf("Character %s saved.\n", character.Being.Name)
 
 	return true
@@ -190,8 +226,8 @@ func (me *Client) DeleteCharacterDialog() bool {
 	/* A character that is deleted gives NEW_CHARACTER_PRICE +
 	 * level / (NEW_CHARACTER_PRICE * 2) points, but only after the delete. */
 	np := NEW_CHARACTER_PRICE + character.Level/(NEW_CHARACTER_PRICE*2)
-	me.account.DeleteCharacter(me.server.DataPath(), character)
-	me.account.Points += np
+	me.account.DeleteCharacter(me.server.Storage(), character)
+	me.account.Change(func() { me.account.Points += np })
 
 	return true
 }
@@ -0,0 +1,213 @@
+package server
+
+/* This file contains the GMCP support of the client. */
+
+import "strings"
+import "strconv"
+import "github.com/beoran/woe/monolog"
+import "github.com/beoran/woe/telnet"
+import "time"
+
+// Char.Vitals GMCP message
+type GMCPVitals struct {
+	HP    int `json:"hp"`
+	MaxHP int `json:"maxhp"`
+	MP    int `json:"mp"`
+	MaxMP int `json:"maxmp"`
+	JP    int `json:"jp"`
+	MaxJP int `json:"maxjp"`
+	LP    int `json:"lp"`
+	MaxLP int `json:"maxlp"`
+}
+
+// Char.Status GMCP message
+type GMCPStatus struct {
+	Name   string `json:"name"`
+	Level  int    `json:"level"`
+	Kin    string `json:"kin"`
+	Gender string `json:"gender"`
+	Job    string `json:"job"`
+}
+
+// Room.Info GMCP message
+type GMCPRoomInfo struct {
+	Num   string            `json:"num"`
+	Name  string            `json:"name"`
+	Exits map[string]string `json:"exits"`
+}
+
+// Comm.Channel.Text GMCP message
+type GMCPChannelText struct {
+	Channel string `json:"channel"`
+	Talker  string `json:"talker"`
+	Text    string `json:"text"`
+}
+
+// GMCP support. The client announces the packages it supports itself.
+func (me *Client) enableGMCP() {
+	monolog.Info("Client %d accepts GMCP", me.id)
+	me.info.gmcp = true
+}
+
+func (me *Client) disableGMCP() {
+	me.info.gmcp = false
+}
+
+// Returns true if the client supports the given GMCP package.
+// A message name like "Char.Vitals" is also accepted.
+func (me *Client) SupportsGMCP(name string) bool {
+	if !me.info.gmcp {
+		return false
+	}
+	supports := me.info.gmcpSupports
+	for name != "" {
+		if _, ok := supports[name]; ok {
+			return true
+		}
+		index := strings.LastIndex(name, ".")
+		if index < 0 {
+			break
+		}
+		name = name[:index]
+	}
+	return false
+}
+
+// Updates the GMCP packages the client supports from a Core.Supports message.
+func (me *Client) handleGMCPSupports(event *telnet.GMCPEvent, clear bool, remove bool) {
+	var list []string
+	if err := event.Decode(&list); err != nil {
+		monolog.Warning("Client %d bad %s: %v", me.id, event.Name, err)
+		return
+	}
+	// Copy the map, since it may be in use by a broadcast.
+	supports := make(map[string]int)
+	if !clear {
+		for k, v := range me.info.gmcpSupports {
+			supports[k] = v
+		}
+	}
+	for _, entry := range list {
+		parts := strings.Fields(entry)
+		if len(parts) < 1 {
+			continue
+		}
+		if remove {
+			delete(supports, parts[0])
+			continue
+		}
+		version := 1
+		if len(parts) > 1 {
+			if v, err := strconv.Atoi(parts[1]); err == nil {
+				version = v
+			}
+		}
+		supports[parts[0]] = version
+	}
+	me.info.gmcpSupports = supports
+	monolog.Info("Client %d GMCP supports %v", me.id, supports)
+}
+
+// Handles a GMCP message from the client.
+func (me *Client) HandleGMCPEvent(event *telnet.GMCPEvent) {
+	me.info.gmcp = true
+	switch event.Name {
+	case "Core.Hello":
+		var hello map[string]string
+		if err := event.Decode(&hello); err == nil {
+			monolog.Info("Client %d GMCP hello %v", me.id, hello)
+		}
+	case "Core.Supports.Set":
+		me.handleGMCPSupports(event, true, false)
+	case "Core.Supports.Add":
+		me.handleGMCPSupports(event, false, false)
+	case "Core.Supports.Remove":
+		me.handleGMCPSupports(event, false, true)
+	case "Core.Ping":
+		me.telnet.TelnetSendGMCP("Core.Ping", nil)
+	default:
+		monolog.Info("Client %d unhandled GMCP message %s", me.id, event.Name)
+	}
+}
+
+// Sends a GMCP message if the client supports it.
+func (me *Client) SendGMCP(name string, data interface{}) {
+	if !me.SupportsGMCP(name) {
+		return
+	}
+	if err := me.telnet.TelnetSendGMCP(name, data); err != nil {
+		monolog.Warning("Client %d could not send GMCP %s: %v", me.id, name, err)
+	}
+}
+
+// How often the vitals are checked for changes while waiting for input.
+const GMCP_VITALS_INTERVAL = time.Second
+
+// Sends the vitals of the character, but only if they changed since the
+// last time they were sent.
+func (me *Client) SendGMCPVitals() {
+	if me.character == nil {
+		return
+	}
+	vitals := me.character.Vitals
+	msg := GMCPVitals{
+		vitals.HP.Now, vitals.HP.Max, vitals.MP.Now, vitals.MP.Max,
+		vitals.JP.Now, vitals.JP.Max, vitals.LP.Now, vitals.LP.Max,
+	}
+	if me.gmcpVitals != nil && *me.gmcpVitals == msg {
+		return
+	}
+	me.gmcpVitals = &msg
+	me.SendGMCP("Char.Vitals", msg)
+}
+
+// Sends the status of the character.
+func (me *Client) SendGMCPStatus() {
+	if me.character == nil {
+		return
+	}
+	being := &me.character.Being
+	msg := GMCPStatus{being.Name, being.Level, being.KinName(),
+		being.GenderName(), being.JobName()}
+	me.SendGMCP("Char.Status", msg)
+}
+
+// Sends information on the room the character is in, but only if the
+// character moved since the last time it was sent.
+func (me *Client) SendGMCPRoom() {
+	if me.character == nil || me.character.Room == nil {
+		return
+	}
+	room := me.character.Room
+	if me.gmcpRoom == room.ID {
+		return
+	}
+	me.gmcpRoom = room.ID
+	msg := GMCPRoomInfo{room.ID, room.Name, make(map[string]string)}
+	for dir, exit := range room.Exits {
+		msg.Exits[string(dir)] = exit.ToRoomID
+	}
+	me.SendGMCP("Room.Info", msg)
+}
+
+// Sends a channel message.
+func (me *Client) SendGMCPChannel(channel string, talker string, text string) {
+	me.SendGMCP("Comm.Channel.Text", GMCPChannelText{channel, talker, text})
+}
+
+// Sends all GMCP data that may have changed after a command or on login.
+func (me *Client) SendGMCPUpdate() {
+	if !me.info.gmcp {
+		return
+	}
+	me.SendGMCPVitals()
+	me.SendGMCPRoom()
+}
+
+// Sends all GMCP data on the character, for example after login.
+func (me *Client) SendGMCPCharacter() {
+	me.gmcpVitals = nil
+	me.gmcpRoom = ""
+	me.SendGMCPStatus()
+	me.SendGMCPUpdate()
+}
@@ -0,0 +1,106 @@
+package server
+
+/* This file contains the line assembler that splits the input of a client
+ * into complete lines. */
+
+import "unicode/utf8"
+import "github.com/beoran/woe/monolog"
+
+// Maximum length of an input line in bytes. Longer lines are truncated.
+const LINE_MAX_LENGTH = 2048
+
+// Maximum amount of complete lines that are queued. More are dropped.
+const LINE_QUEUE_MAX = 64
+
+const (
+	LINE_NUL = 0
+	LINE_BS  = 8
+	LINE_LF  = 10
+	LINE_CR  = 13
+	LINE_DEL = 127
+)
+
+// Assembles input data into lines, following the newline rules of RFC 854:
+// CR LF and CR NUL end a line. A lone CR or LF is accepted as well, since
+// not all clients follow the RFC. Backspace and DEL erase the last character
+// of the line, for clients that send input character by character.
+type LineAssembler struct {
+	line  []byte
+	lines [][]byte
+	// True if the last byte was a CR, so a following LF or NUL is ignored.
+	cr bool
+	// True if the current line was truncated.
+	overflow bool
+}
+
+func NewLineAssembler() *LineAssembler {
+	return &LineAssembler{}
+}
+
+// Ends the current line and queues it.
+func (me *LineAssembler) endLine() {
+	if me.overflow {
+		monolog.Warning("Input line too long, truncated to %d bytes.", LINE_MAX_LENGTH)
+	}
+	if len(me.lines) >= LINE_QUEUE_MAX {
+		monolog.Warning("Too many input lines queued, line dropped.")
+	} else {
+		me.lines = append(me.lines, me.line)
+	}
+	me.line = nil
+	me.overflow = false
+}
+
+// Erases the last character, which may be several bytes long in UTF-8.
+func (me *LineAssembler) erase() {
+	if len(me.line) < 1 {
+		return
+	}
+	_, size := utf8.DecodeLastRune(me.line)
+	me.line = me.line[:len(me.line)-size]
+}
+
+// Adds input data.
+func (me *LineAssembler) Write(data []byte) {
+	for _, c := range data {
+		cr := me.cr
+		me.cr = false
+		switch c {
+		case LINE_CR:
+			me.endLine()
+			me.cr = true
+		case LINE_LF:
+			if !cr {
+				me.endLine()
+			}
+		case LINE_NUL:
+			// Ignored, after CR or anywhere else.
+		case LINE_BS, LINE_DEL:
+			me.erase()
+		default:
+			if len(me.line) < LINE_MAX_LENGTH {
+				me.line = append(me.line, c)
+			} else {
+				me.overflow = true
+			}
+		}
+	}
+}
+
+// Returns the next complete line, if any.
+func (me *LineAssembler) Next() (line []byte, ok bool) {
+	if len(me.lines) < 1 {
+		return nil, false
+	}
+	line = me.lines[0]
+	me.lines = me.lines[1:]
+	if line == nil {
+		line = []byte{}
+	}
+	return line, true
+}
+
+// Returns the amount of complete lines that are queued.
+func (me *LineAssembler) Len() int {
+	return len(me.lines)
+}
@@ -0,0 +1,61 @@
+package server
+
+import "testing"
+
+func HelperLines(me *LineAssembler) []string {
+	var result []string
+	for line, ok := me.Next(); ok; line, ok = me.Next() {
+		result = append(result, string(line))
+	}
+	return result
+}
+
+func TestLineAssembler(test *testing.T) {
+	la := NewLineAssembler()
+	la.Write([]byte("look\r"))
+	la.Write([]byte("\nsay hi\r\x00north\nsou"))
+	lines := HelperLines(la)
+	expected := []string{"look", "say hi", "north"}
+	if len(lines) != len(expected) {
+		test.Fatalf("Wrong lines: %q", lines)
+	}
+	for index := range expected {
+		if lines[index] != expected[index] {
+			test.Errorf("Line %d: %q, expected %q", index, lines[index], expected[index])
+		}
+	}
+	la.Write([]byte("th\r\n\r\n"))
+	lines = HelperLines(la)
+	if len(lines) != 2 || lines[0] != "south" || lines[1] != "" {
+		test.Errorf("Wrong lines after partial input: %q", lines)
+	}
+}
+
+func TestLineAssemblerErase(test *testing.T) {
+	la := NewLineAssembler()
+	la.Write([]byte("lok\x08\x08ook caf\xc3\xa9\x7f\x7fe\n"))
+	lines := HelperLines(la)
+	if len(lines) != 1 || lines[0] != "look cae" {
+		test.Errorf("Wrong erase: %q", lines)
+	}
+}
+
+func TestLineAssemblerLimits(test *testing.T) {
+	la := NewLineAssembler()
+	long := make([]byte, LINE_MAX_LENGTH+10)
+	for index := range long {
+		long[index] = 'x'
+	}
+	la.Write(long)
+	la.Write([]byte("\n"))
+	line, ok := la.Next()
+	if !ok || len(line) != LINE_MAX_LENGTH {
+		test.Errorf("Line not truncated: %d", len(line))
+	}
+	for index := 0; index < LINE_QUEUE_MAX+5; index++ {
+		la.Write([]byte("x\n"))
+	}
+	if la.Len() != LINE_QUEUE_MAX {
+		test.Errorf("Queue not limited: %d", la.Len())
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+/* This file contains the actions that let implementors control the log
+ * from inside the game: the log levels, tracing of clients, and showing
+ * the recent log lines. */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/beoran/woe/monolog"
+)
+
+// Level at which the telnet traffic of traced clients is logged.
+const LOG_TRACE = "TRACE"
+
+// Amount of recent log lines /tail shows by default.
+const DEFAULT_TAIL = 20
+
+// Logs data sent to or read from the client, if it is traced. Input
+// is not logged while the client is asked for a password.
+func (me *Client) traceData(what string, data []byte) {
+	if !me.trace.Load() {
+		return
+	}
+	if what == "Read" && me.password.Load() {
+		me.Log().Log(LOG_TRACE, "Read %d bytes of password", len(data))
+		return
+	}
+	me.Log().Log(LOG_TRACE, "%s %q", what, data)
+}
+
+// Turns tracing of the telnet traffic of the client on or off.
+func (me *Client) SetTrace(trace bool) {
+	me.trace.Store(trace)
+}
+
+func (me *Client) IsTraced() bool {
+	return me.trace.Load()
+}
+
+// Shows the log lines to the client as they are logged, until StopTail.
+// Until then, what is sent to the client is not logged or traced.
+func (me *Client) StartTail(ring *monolog.RingLogger) {
+	me.StopTail()
+	me.tail = ring.Watch()
+	me.tailing.Store(true)
+}
+
+// Stops showing the log lines to the client.
+func (me *Client) StopTail() {
+	if me.tail != nil && me.server.logRing != nil {
+		me.server.logRing.Unwatch(me.tail)
+	}
+	me.tail = nil
+	me.tailing.Store(false)
+}
+
+// Finds a connected client by account or character name, or by id.
+func (me *Server) FindClientByNameOrID(name string) *Client {
+	if id, err := strconv.Atoi(name); err == nil {
+		if client := me.ClientByID(id); client != nil && client.IsAlive() {
+			return client
+		}
+		return nil
+	}
+	return me.FindClient(name)
+}
+
+// Returns a description of the logger for /log list.
+func describeLogger(logger monolog.Logger) string {
+	if stringer, ok := logger.(fmt.Stringer); ok && stringer.String() != "" {
+		return stringer.String()
+	}
+	return fmt.Sprintf("%T", logger)
+}
+
+// Enables, disables or lists the log levels. A level can be enabled or
+// disabled for one logger only, by its number in the list.
+func doLog(data *ActionData) (err error) {
+	client := data.Client
+	args := strings.Fields(string(data.Rest))
+	if len(args) < 1 {
+		return ErrUsage
+	}
+	loggers := monolog.Loggers()
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return ErrUsage
+		}
+		for index, logger := range loggers {
+			levels := monolog.LevelsOf(logger).List()
+			client.Printf("%-2d %-24s %s\n", index+1, describeLogger(logger), strings.Join(levels, " "))
+		}
+		return nil
+	case "enable", "disable":
+	default:
+		return ErrUsage
+	}
+	if len(args) < 2 || len(args) > 3 {
+		return ErrUsage
+	}
+	enable := args[0] == "enable"
+	level := strings.ToUpper(args[1])
+	targets := loggers
+	if len(args) == 3 {
+		index, err := strconv.Atoi(args[2])
+		if err != nil || index < 1 || index > len(loggers) {
+			client.Printf("No logger %s, see /log list.\n", args[2])
+			return nil
+		}
+		targets = loggers[index-1 : index]
+	}
+	for _, logger := range targets {
+		if levels := monolog.LevelsOf(logger); levels == nil {
+			continue
+		} else if enable {
+			levels.Enable(level)
+		} else {
+			levels.Disable(level)
+		}
+	}
+	what := "all loggers"
+	if len(targets) == 1 && len(loggers) > 1 {
+		what = describeLogger(targets[0])
+	}
+	client.Audit("%sd log level %s for %s", args[0], level, what)
+	client.Printf("Log level %s %sd for %s.\n", level, args[0], what)
+	return nil
+}
+
+// Traces the telnet traffic of a client, or stops tracing it with off.
+// Without arguments, lists the traced clients.
+func doTrace(data *ActionData) (err error) {
+	client := data.Client
+	args := strings.Fields(string(data.Rest))
+	if len(args) == 0 {
+		count := 0
+		for _, other := range data.Server.Clients() {
+			if other.IsTraced() {
+				client.Printf("Tracing client %d (%s).\n", other.id, other.AccountName())
+				count++
+			}
+		}
+		client.Printf("%d clients traced.\n", count)
+		return nil
+	}
+	if len(args) > 2 || (len(args) == 2 && args[1] != "off" && args[1] != "on") {
+		return ErrUsage
+	}
+	target := data.Server.FindClientByNameOrID(args[0])
+	if target == nil {
+		client.Printf("%s is not connected.\n", args[0])
+		return nil
+	}
+	if target == client {
+		// What is shown of the trace would be traced again.
+		client.Printf("You can't trace yourself.\n")
+		return nil
+	}
+	if target.account != nil && !client.Outranks(target.Privilege()) {
+		client.Printf("You can't trace %s.\n", args[0])
+		return nil
+	}
+	if len(args) == 2 && args[1] == "off" {
+		target.SetTrace(false)
+		client.Audit("stopped tracing client %d (%s)", target.id, target.AccountName())
+		client.Printf("Stopped tracing client %d.\n", target.id)
+		return nil
+	}
+	if !monolog.IsEnabled(LOG_TRACE) {
+		monolog.EnableLevel(LOG_TRACE)
+		client.Printf("Enabled log level %s.\n", LOG_TRACE)
+	}
+	target.SetTrace(true)
+	client.Audit("traces client %d (%s)", target.id, target.AccountName())
+	client.Printf("Tracing client %d (%s).\n", target.id, target.AccountName())
+	return nil
+}
+
+// Shows the recent log lines, and then the new ones as they are logged,
+// until /tail off.
+func doTail(data *ActionData) (err error) {
+	client := data.Client
+	arg := strings.TrimSpace(string(data.Rest))
+	ring := data.Server.LogRing()
+	if arg == "off" {
+		if client.tail == nil {
+			client.Printf("You are not following the log.\n")
+			return nil
+		}
+		client.StopTail()
+		client.Printf("Stopped following the log.\n")
+		return nil
+	}
+	lines := DEFAULT_TAIL
+	if arg != "" {
+		if lines, err = strconv.Atoi(arg); err != nil || lines < 1 {
+			return ErrUsage
+		}
+	}
+	if ring == nil {
+		client.Printf("The log is not kept in memory.\n")
+		return nil
+	}
+	for _, line := range ring.Lines(lines) {
+		client.Printf("%s\n", line)
+	}
+	client.StartTail(ring)
+	client.Printf("Following the log, /tail off to stop.\n")
+	client.Printf("What is sent to you is not logged or traced until then.\n")
+	return nil
+}
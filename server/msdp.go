@@ -0,0 +1,207 @@
+package server
+
+/* This file contains the MSDP support of the client. */
+
+import "sort"
+import "strconv"
+import "github.com/beoran/woe/monolog"
+import "github.com/beoran/woe/telnet"
+
+// A variable that can be reported to the client through MSDP.
+// Get returns the current value of the variable for the client, which
+// is a string, telnet.MSDPTable or telnet.MSDPArray.
+type MSDPReportable struct {
+	Name string
+	Get  func(me *Client) interface{}
+}
+
+// Helper that returns a reportable bound to a number of the character.
+func msdpCharacterInt(name string, get func(me *Client) int) MSDPReportable {
+	return MSDPReportable{name, func(me *Client) interface{} {
+		if me.character == nil {
+			return ""
+		}
+		return strconv.Itoa(get(me))
+	}}
+}
+
+// Returns the exits of the room the character is in as an MSDP table.
+func msdpRoomExits(me *Client) telnet.MSDPTable {
+	exits := make(telnet.MSDPTable)
+	if me.character == nil || me.character.Room == nil {
+		return exits
+	}
+	for dir, exit := range me.character.Room.Exits {
+		exits[string(dir)] = exit.ToRoomID
+	}
+	return exits
+}
+
+// All variables that may be reported to the client.
+var MSDPReportables = []MSDPReportable{
+	{"CHARACTER_NAME", func(me *Client) interface{} {
+		if me.character == nil {
+			return ""
+		}
+		return me.character.Name
+	}},
+	msdpCharacterInt("LEVEL", func(me *Client) int { return me.character.Level }),
+	msdpCharacterInt("HEALTH", func(me *Client) int { return me.character.HP.Now }),
+	msdpCharacterInt("HEALTH_MAX", func(me *Client) int { return me.character.HP.Max }),
+	msdpCharacterInt("MOVEMENT", func(me *Client) int { return me.character.MP.Now }),
+	msdpCharacterInt("MOVEMENT_MAX", func(me *Client) int { return me.character.MP.Max }),
+	msdpCharacterInt("MANA", func(me *Client) int { return me.character.JP.Now }),
+	msdpCharacterInt("MANA_MAX", func(me *Client) int { return me.character.JP.Max }),
+	msdpCharacterInt("LIFE", func(me *Client) int { return me.character.LP.Now }),
+	msdpCharacterInt("LIFE_MAX", func(me *Client) int { return me.character.LP.Max }),
+	{"ROOM_VNUM", func(me *Client) interface{} {
+		if me.character == nil || me.character.Room == nil {
+			return ""
+		}
+		return me.character.Room.ID
+	}},
+	{"ROOM_NAME", func(me *Client) interface{} {
+		if me.character == nil || me.character.Room == nil {
+			return ""
+		}
+		return me.character.Room.Name
+	}},
+	{"ROOM_EXITS", func(me *Client) interface{} {
+		return msdpRoomExits(me)
+	}},
+}
+
+// Commands the client may send through MSDP.
+var MSDPCommands = []string{"LIST", "REPORT", "RESET", "SEND", "UNREPORT"}
+
+// Lists that the client may ask for with LIST.
+var MSDPLists = []string{"COMMANDS", "LISTS", "CONFIGURABLE_VARIABLES",
+	"REPORTABLE_VARIABLES", "REPORTED_VARIABLES", "SENDABLE_VARIABLES"}
+
+// Finds a reportable variable by name or returns nil if not found.
+func FindMSDPReportable(name string) *MSDPReportable {
+	for index := range MSDPReportables {
+		if MSDPReportables[index].Name == name {
+			return &MSDPReportables[index]
+		}
+	}
+	return nil
+}
+
+// Helper to convert a list of strings to an MSDP array.
+func msdpStringArray(list []string) telnet.MSDPArray {
+	array := make(telnet.MSDPArray, 0, len(list))
+	for _, elt := range list {
+		array = append(array, elt)
+	}
+	return array
+}
+
+// Returns the names of all reportable variables.
+func msdpReportableNames() []string {
+	var names []string
+	for _, reportable := range MSDPReportables {
+		names = append(names, reportable.Name)
+	}
+	return names
+}
+
+// Sends an MSDP list on request of the client.
+func (me *Client) sendMSDPList(name string) {
+	var list []string
+	switch name {
+	case "COMMANDS":
+		list = MSDPCommands
+	case "LISTS":
+		list = MSDPLists
+	case "REPORTABLE_VARIABLES", "SENDABLE_VARIABLES":
+		list = msdpReportableNames()
+	case "REPORTED_VARIABLES":
+		for reported := range me.msdpReported {
+			list = append(list, reported)
+		}
+		sort.Strings(list)
+	case "CONFIGURABLE_VARIABLES":
+		list = []string{}
+	default:
+		monolog.Info("Client %d asked for unknown MSDP list %s", me.id, name)
+		return
+	}
+	me.telnet.TelnetSendMSDP(telnet.MSDPVar{Name: name, Value: msdpStringArray(list)})
+}
+
+// Sends the current value of a variable. Returns the encoded value, which
+// is used to detect changes, or "" if the variable is not known.
+func (me *Client) sendMSDPVariable(name string) string {
+	reportable := FindMSDPReportable(name)
+	if reportable == nil {
+		monolog.Info("Client %d asked for unknown MSDP variable %s", me.id, name)
+		return ""
+	}
+	variable := telnet.MSDPVar{Name: name, Value: reportable.Get(me)}
+	encoded, err := telnet.EncodeMSDP(variable)
+	if err != nil {
+		monolog.Warning("Could not encode MSDP variable %s: %v", name, err)
+		return ""
+	}
+	me.telnet.TelnetSubnegotiation(telnet.TELNET_TELOPT_MSDP, encoded)
+	return string(encoded)
+}
+
+// Handles MSDP commands from the client.
+func (me *Client) HandleMSDPEvent(event *telnet.MSDPEvent) {
+	if me.msdpReported == nil {
+		me.msdpReported = make(map[string]string)
+	}
+	for _, variable := range event.Vars {
+		names := variable.Strings()
+		switch variable.Name {
+		case "LIST":
+			for _, name := range names {
+				me.sendMSDPList(name)
+			}
+		case "REPORT":
+			for _, name := range names {
+				if encoded := me.sendMSDPVariable(name); encoded != "" {
+					me.msdpReported[name] = encoded
+				}
+			}
+		case "UNREPORT":
+			for _, name := range names {
+				delete(me.msdpReported, name)
+			}
+		case "RESET":
+			me.msdpReported = make(map[string]string)
+		case "SEND":
+			for _, name := range names {
+				me.sendMSDPVariable(name)
+			}
+		default:
+			monolog.Info("Client %d unknown MSDP command %s", me.id, variable.Name)
+		}
+	}
+}
+
+// Sends all reported variables that changed since they were last sent.
+func (me *Client) SendMSDPUpdate() {
+	if !me.info.msdp || len(me.msdpReported) < 1 {
+		return
+	}
+	var changed []telnet.MSDPVar
+	for name, last := range me.msdpReported {
+		reportable := FindMSDPReportable(name)
+		if reportable == nil {
+			continue
+		}
+		variable := telnet.MSDPVar{Name: name, Value: reportable.Get(me)}
+		encoded, err := telnet.EncodeMSDP(variable)
+		if err != nil || string(encoded) == last {
+			continue
+		}
+		me.msdpReported[name] = string(encoded)
+		changed = append(changed, variable)
+	}
+	if len(changed) > 0 {
+		me.telnet.TelnetSendMSDP(changed...)
+	}
+}
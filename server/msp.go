@@ -0,0 +1,76 @@
+package server
+
+/* This file contains the MSP (Mud Sound Protocol) support of the client.
+ * Sounds are looked up by zone and event in the sound table of the world
+ * and sent as !!SOUND(...) or !!MUSIC(...) triggers. */
+
+import "fmt"
+import "strings"
+import "github.com/beoran/woe/world"
+
+// Formats an MSP trigger for the sound.
+func MSPTrigger(sound world.Sound) string {
+	var buf strings.Builder
+	if sound.Music {
+		buf.WriteString("!!MUSIC(")
+	} else {
+		buf.WriteString("!!SOUND(")
+	}
+	buf.WriteString(sound.File)
+	if sound.Volume >= 0 {
+		fmt.Fprintf(&buf, " V=%d", sound.Volume)
+	}
+	if sound.Loops != 0 {
+		fmt.Fprintf(&buf, " L=%d", sound.Loops)
+	}
+	if sound.Priority >= 0 && !sound.Music {
+		fmt.Fprintf(&buf, " P=%d", sound.Priority)
+	}
+	if sound.Kind != "" {
+		fmt.Fprintf(&buf, " T=%s", sound.Kind)
+	}
+	if sound.URL != "" {
+		fmt.Fprintf(&buf, " U=%s", sound.URL)
+	}
+	buf.WriteString(")")
+	return buf.String()
+}
+
+// Returns true if sound triggers may be sent to this client.
+func (me *Client) UseMSP() bool {
+	return me.info.msp && (me.account == nil || !me.account.Mute)
+}
+
+// Turns sounds on or off for the account of this client.
+func (me *Client) SetSound(on bool) {
+	if me.account == nil || me.account.Mute == !on {
+		return
+	}
+	me.account.Change(func() { me.account.Mute = !on })
+}
+
+// Returns the zone the character of the client is in, or "" if unknown.
+func (me *Client) ZoneID() string {
+	if me.character == nil || me.character.Room == nil {
+		return ""
+	}
+	return me.character.Room.ZoneID
+}
+
+// Plays the sound for the event in the zone the character is in, if the
+// client supports MSP and there is a sound for it.
+func (me *Client) PlaySound(event string) {
+	if !me.UseMSP() {
+		return
+	}
+	gameworld := me.GetWorld()
+	if gameworld == nil {
+		return
+	}
+	sound, ok := gameworld.Sound(me.ZoneID(), event)
+	if !ok {
+		return
+	}
+	// Triggers must be on a line of their own.
+	me.telnet.TelnetSend([]byte("\r\n" + MSPTrigger(sound) + "\r\n"))
+}
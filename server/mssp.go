@@ -0,0 +1,145 @@
+package server
+
+/* This file contains the MSSP (Mud Server Status Protocol) data of the
+ * server. Static fields are read from a configuration file, the rest is
+ * filled in from the live server state every time MSSP is requested. */
+
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "github.com/beoran/woe/monolog"
+import "github.com/beoran/woe/sitef"
+import "github.com/beoran/woe/world"
+
+// Default static MSSP fields, used if there is no configuration file.
+var MSSP = map[string]string{
+	"NAME":             "Workers Of Eruta",
+	"CRAWL DELAY":      "0",
+	"CODEBASE":         "WOE",
+	"CONTACT":          "beoran@gmail.com",
+	"CREATED":          "2015",
+	"ICON":             "None",
+	"LANGUAGE":         "English",
+	"LOCATION":         "USA",
+	"MINIMUM AGE":      "18",
+	"WEBSITE":          "beoran.net",
+	"FAMILY":           "Custom",
+	"GENRE":            "Science Fiction",
+	"GAMEPLAY":         "Adventure",
+	"STATUS":           "Alpha",
+	"GAMESYSTEM":       "Custom",
+	"INTERMUD":         "",
+	"SUBGENRE":         "None",
+	"HELPFILES":        "0",
+	"LEVELS":           "0",
+	"ANSI":             "1",
+	"MCCP":             "1",
+	"MCP":              "0",
+	"MSDP":             "1",
+	"MSP":              "1",
+	"MXP":              "1",
+	"GMCP":             "1",
+	"PUEBLO":           "0",
+	"UTF-8":            "1",
+	"VT100":            "1",
+	"XTERM 255 COLORS": "1",
+	"PAY TO PLAY":      "0",
+	"PAY FOR PERKS":    "0",
+	"HIRING BUILDERS":  "0",
+	"HIRING CODERS":    "0",
+}
+
+// Line a crawler sends in stead of a login to get the MSSP data as text.
+const MSSP_REQUEST = "MSSP-REQUEST"
+
+// Returns the path of the MSSP configuration file.
+func (me *Server) MSSPPath() string {
+	return filepath.Join(me.DataPath(), "mssp.sitef")
+}
+
+// Loads the static MSSP fields from the configuration file, a single sitef
+// record with the MSSP variable names as keys. Falls back to the defaults
+// if the file doesn't exist or can't be read.
+func (me *Server) LoadMSSP() {
+	me.mssp = MSSP
+	path := me.MSSPPath()
+	records, err := sitef.ParseFilename(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			monolog.Info("No MSSP configuration at %s, using defaults.", path)
+		} else {
+			monolog.Error("Could not load MSSP configuration %s: %v", path, err)
+		}
+		return
+	}
+	if len(records) < 1 {
+		monolog.Warning("Empty MSSP configuration %s, using defaults.", path)
+		return
+	}
+
+	mssp := make(map[string]string)
+	for key, value := range MSSP {
+		mssp[key] = value
+	}
+	record := records[0]
+	for _, key := range record.Keys() {
+		mssp[strings.ToUpper(key)] = record.Get(key)
+	}
+	me.mssp = mssp
+	monolog.Info("Loaded MSSP configuration from %s", path)
+}
+
+// Returns the amount of players that are logged in.
+func (me *Server) PlayerCount() int {
+	count := 0
+	for _, client := range me.Clients() {
+		if client.IsLoginFinished() {
+			count++
+		}
+	}
+	return count
+}
+
+// Builds the MSSP data from the static fields and the current state of the
+// server and the world.
+func (me *Server) BuildMSSP() map[string]string {
+	mssp := make(map[string]string)
+	static := me.mssp
+	if static == nil {
+		static = MSSP
+	}
+	for key, value := range static {
+		mssp[key] = value
+	}
+	mssp["PLAYERS"] = strconv.Itoa(me.PlayerCount())
+	mssp["UPTIME"] = strconv.FormatInt(me.started.Unix(), 10)
+	mssp["SKILLS"] = strconv.Itoa(len(world.SkillList))
+	mssp["CLASSES"] = strconv.Itoa(len(world.JobList))
+	mssp["RACES"] = strconv.Itoa(len(world.KinList))
+	if me.World != nil {
+		mssp["AREAS"] = strconv.Itoa(me.World.ZoneCount())
+		mssp["ROOMS"] = strconv.Itoa(me.World.RoomCount())
+		mssp["MOBILES"] = strconv.Itoa(me.World.MobileCount())
+		mssp["OBJECTS"] = strconv.Itoa(me.World.ItemCount())
+		mssp["HELPFILES"] = strconv.Itoa(me.World.HelpCount())
+	}
+	return mssp
+}
+
+// Sends the MSSP data as plain text, for crawlers that don't negotiate.
+func (me *Client) SendMSSPReply() {
+	mssp := me.server.BuildMSSP()
+	keys := make([]string, 0, len(mssp))
+	for key := range mssp {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	me.Printf("\nMSSP-REPLY-START\n")
+	for _, key := range keys {
+		me.Printf("%s\t%s\n", key, mssp[key])
+	}
+	me.Printf("MSSP-REPLY-END\n")
+}
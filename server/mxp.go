@@ -0,0 +1,100 @@
+package server
+
+/* This file contains the MXP output layer of the client. All helpers here
+ * fall back to plain text for clients that don't support MXP. */
+
+import "fmt"
+import "strings"
+import "github.com/beoran/woe/world"
+
+// MXP line modes, sent as ANSI escape sequences.
+const (
+	MXP_OPEN        = "\033[0z"
+	MXP_SECURE      = "\033[1z"
+	MXP_LOCKED      = "\033[2z"
+	MXP_RESET       = "\033[3z"
+	MXP_TEMP_SECURE = "\033[4z"
+	MXP_LOCK_OPEN   = "\033[5z"
+	MXP_LOCK_SECURE = "\033[6z"
+	MXP_LOCK_LOCKED = "\033[7z"
+)
+
+var mxpEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;")
+
+// Escapes text so MXP clients don't interpret it as markup.
+func MXPEscape(text string) string {
+	return mxpEscaper.Replace(text)
+}
+
+// Returns an MXP SEND tag around text. The commands in hrefs are offered as
+// a menu if there is more than one. Text must be escaped already.
+func MXPSend(text string, hint string, hrefs ...string) string {
+	escaped := make([]string, len(hrefs))
+	for i, href := range hrefs {
+		escaped[i] = MXPEscape(href)
+	}
+	href := strings.Join(escaped, "|")
+	if hint == "" {
+		return fmt.Sprintf("<SEND href=\"%s\">%s</SEND>", href, text)
+	}
+	return fmt.Sprintf("<SEND href=\"%s\" hint=\"%s\">%s</SEND>", href, MXPEscape(hint), text)
+}
+
+// Returns true if MXP markup may be sent to this client.
+func (me *Client) UseMXP() bool {
+	return me.info.mxp
+}
+
+// Returns user generated or other untrusted text, escaped if the client
+// uses MXP.
+func (me *Client) MXPText(text string) string {
+	if !me.UseMXP() {
+		return text
+	}
+	return MXPEscape(text)
+}
+
+// Returns text as a link that sends command when clicked, or plain text.
+func (me *Client) MXPCommand(text string, hint string, commands ...string) string {
+	if !me.UseMXP() {
+		return text
+	}
+	return MXPSend(MXPEscape(text), hint, commands...)
+}
+
+// Returns a clickable exit.
+func (me *Client) MXPExit(direction string) string {
+	return me.MXPCommand(direction, "Go "+direction, direction)
+}
+
+// Returns a clickable item name with a menu of item commands.
+func (me *Client) MXPItem(item *world.Item) string {
+	name := strings.ToLower(item.Name)
+	return me.MXPCommand(item.Name, item.Short, "look "+name, "get "+name, "drop "+name)
+}
+
+// Returns a clickable character name with a menu of character commands.
+func (me *Client) MXPCharacter(character *world.Character) string {
+	name := strings.ToLower(character.Name)
+	return me.MXPCommand(character.Name, character.Short, "look "+name, "finger "+name)
+}
+
+// Prints formatted text that may contain MXP markup built with the helpers
+// above. The format itself is escaped and every line is sent in MXP secure
+// mode, but the arguments are not escaped, so other text in them must be
+// escaped with MXPText. Without MXP this is the same as Printf.
+func (me *Client) MXPPrintf(format string, args ...interface{}) {
+	if !me.UseMXP() {
+		me.Printf(format, args...)
+		return
+	}
+	text := fmt.Sprintf(MXPEscape(format), args...)
+	me.snoop(text)
+	lines := strings.SplitAfter(text, "\n")
+	for index, line := range lines {
+		if line != "" {
+			lines[index] = MXP_SECURE + line
+		}
+	}
+	me.send(strings.Join(lines, ""))
+}
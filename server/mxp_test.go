@@ -0,0 +1,42 @@
+package server
+
+import "strings"
+import "testing"
+import "github.com/beoran/woe/telnet"
+import "github.com/beoran/woe/world"
+
+// Returns what was sent to the client so far.
+func drainClient(client *Client) string {
+	var out []byte
+	for {
+		select {
+		case data := <-client.telnet.ToClient:
+			out = append(out, data...)
+		default:
+			return string(out)
+		}
+	}
+}
+
+func TestPrintfEscapesMXP(test *testing.T) {
+	client := &Client{telnet: telnet.New()}
+	client.Printf("Hi <b>%s</b>\n", "&you")
+	if sent := drainClient(client); sent != "Hi <b>&you</b>\r\n" {
+		test.Errorf("Wrong text without MXP: %q", sent)
+	}
+
+	client.info.mxp = true
+	client.Printf("Hi <b>%s</b>\n", "&you")
+	if sent := drainClient(client); sent != "Hi &lt;b&gt;&amp;you&lt;/b&gt;\r\n" {
+		test.Errorf("Text not escaped: %q", sent)
+	}
+	item := &world.Item{}
+	item.Name = "Sword<"
+	item.Short = "A sword"
+	client.MXPPrintf("You carry: %s\n", client.MXPItem(item))
+	sent := drainClient(client)
+	if !strings.HasPrefix(sent, MXP_SECURE+"You carry: <SEND href=\"look sword&lt;|") ||
+		!strings.HasSuffix(sent, ">Sword&lt;</SEND>\r\n") {
+		test.Errorf("Wrong item link: %q", sent)
+	}
+}
@@ -0,0 +1,339 @@
+package server
+
+/* This file contains the online world building commands, with which
+ * builders create and change rooms, exits and zones in the game. Every
+ * change is saved at once and shown to the players in the room. */
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/beoran/woe/monolog"
+	"github.com/beoran/woe/world"
+)
+
+// IDs of rooms and zones are used as file names, so they are restricted.
+var olcIDRe = regexp.MustCompile("^[a-z][a-z0-9_]*$")
+
+// Returns the room the character of the client is in, or nil.
+func (me *Client) Room() *world.Room {
+	if me.character == nil {
+		return nil
+	}
+	return me.character.Room
+}
+
+// Returns the players in the room.
+func (me *Server) ClientsInRoom(room *world.Room) []*Client {
+	var clients []*Client
+	for _, client := range me.Clients() {
+		if client.IsLoginFinished() && client.Room() == room {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// Tells the other players in the room that it changed, and sends them
+// the changed room data.
+func (me *Client) ShowRoomChange(room *world.Room, message string) {
+	for _, other := range me.server.ClientsInRoom(room) {
+		if other == me {
+			continue
+		}
+		other.Printf("%s\n", message)
+		other.gmcpRoom = ""
+		other.SendGMCPUpdate()
+	}
+}
+
+// Moves the character of the client to the room, plays the enter sound
+// of its zone and saves the character.
+func (me *Client) MoveTo(room *world.Room) (err error) {
+	me.character.Change(func() { me.character.Room = room })
+	me.PlaySound(world.SOUND_EVENT_ENTER)
+	return me.character.Save(me.server.Storage())
+}
+
+// Saves the room, reporting failure to the builder.
+func (me *Client) saveRoom(room *world.Room) bool {
+	if err := me.GetWorld().SaveRoom(room); err != nil {
+		monolog.Error("Could not save room %s: %v", room.ID, err)
+		me.Printf("Could not save room %s!\n", room.ID)
+		return false
+	}
+	return true
+}
+
+// Saves the zone, reporting failure to the builder.
+func (me *Client) saveZone(zone *world.Zone) bool {
+	if err := me.GetWorld().SaveZone(zone); err != nil {
+		monolog.Error("Could not save zone %s: %v", zone.ID, err)
+		me.Printf("Could not save zone %s!\n", zone.ID)
+		return false
+	}
+	return true
+}
+
+// Adds the room to the zone with the given ID, if it exists, and saves
+// the zone.
+func (me *Client) addRoomToZone(room *world.Room, zoneid string) {
+	if zone := me.GetWorld().GetZone(zoneid); zone != nil {
+		zone.AddRoomID(room.ID)
+		me.saveZone(zone)
+	}
+}
+
+func (me *Client) showRoom(room *world.Room) {
+	me.Printf("Room:  %s\nZone:  %s\nName:  %s\nShort: %s\nLong:  %s\n",
+		room.ID, room.ZoneID, room.Name, room.Short, room.Long)
+	for _, direction := range room.ExitDirections() {
+		me.Printf("Exit:  %-10s -> %s\n", direction, room.Exits[world.Direction(direction)].ToRoomID)
+	}
+}
+
+// Makes a new room in the zone, adds it to the world and saves it.
+func (me *Client) newRoom(id string, zoneid string) *world.Room {
+	gameworld := me.GetWorld()
+	if id == "" {
+		id = gameworld.NewRoomID(zoneid)
+	}
+	room := world.NewRoom(id, "New room", zoneid)
+	gameworld.AddRoom(room)
+	if !me.saveRoom(room) {
+		return nil
+	}
+	me.addRoomToZone(room, zoneid)
+	return room
+}
+
+// Splits the arguments into a subcommand and the rest of the text.
+func olcArguments(rest []byte) (command string, text string) {
+	parts := strings.SplitN(strings.TrimSpace(string(rest)), " ", 2)
+	command = strings.ToLower(parts[0])
+	if len(parts) > 1 {
+		text = strings.TrimSpace(parts[1])
+	}
+	return command, text
+}
+
+func doRedit(data *ActionData) (err error) {
+	client := data.Client
+	command, text := olcArguments(data.Rest)
+	room := client.Room()
+
+	if command == "new" {
+		if text != "" && (!olcIDRe.MatchString(text) || data.World.HaveRoom(text)) {
+			client.Printf("Room ID %s is not valid or already in use.\n", text)
+			return nil
+		}
+		zoneid := ""
+		if room != nil {
+			zoneid = room.ZoneID
+		}
+		if room = client.newRoom(text, zoneid); room == nil {
+			return nil
+		}
+		client.Audit("created room %s", room.ID)
+		client.Printf("Created room %s.\n", room.ID)
+		return client.MoveTo(room)
+	}
+
+	if room == nil {
+		client.Printf("You are nowhere. Use goto or redit new first.\n")
+		return nil
+	}
+
+	switch command {
+	case "":
+		client.showRoom(room)
+		return nil
+	case "name":
+		room.Change(func() { room.Name = text })
+	case "short":
+		room.Change(func() { room.Short = text })
+	case "long":
+		room.Change(func() { room.Long = text })
+	case "zone":
+		if data.World.GetZone(text) == nil {
+			client.Printf("There is no zone %s.\n", text)
+			return nil
+		}
+		if old := data.World.GetZone(room.ZoneID); old != nil {
+			old.RemoveRoomID(room.ID)
+			client.saveZone(old)
+		}
+		room.Change(func() { room.ZoneID = text })
+		client.addRoomToZone(room, text)
+	case "exit":
+		args := strings.Fields(text)
+		if len(args) < 1 || len(args) > 2 {
+			return ErrUsage
+		}
+		direction, ok := world.ParseDirection(args[0])
+		if !ok {
+			client.Printf("Unknown direction %s.\n", args[0])
+			return nil
+		}
+		if len(args) == 1 {
+			if !room.RemoveExit(direction) {
+				client.Printf("There is no exit %s.\n", direction)
+				return nil
+			}
+			break
+		}
+		if !olcIDRe.MatchString(args[1]) {
+			client.Printf("Room ID %s is not valid.\n", args[1])
+			return nil
+		}
+		to, err := data.World.LoadRoom(args[1])
+		if err != nil {
+			client.Printf("There is no room %s.\n", args[1])
+			return nil
+		}
+		room.SetExit(direction, to)
+	default:
+		return ErrUsage
+	}
+
+	if !client.saveRoom(room) {
+		return nil
+	}
+	client.Audit("changed %s of room %s", command, room.ID)
+	client.Printf("Changed %s of room %s.\n", command, room.ID)
+	client.ShowRoomChange(room, "The room shimmers and changes.")
+	return nil
+}
+
+func doZedit(data *ActionData) (err error) {
+	client := data.Client
+	id, text := olcArguments(data.Rest)
+	command, text := olcArguments([]byte(text))
+
+	if id == "" {
+		for _, zone := range data.World.Zones() {
+			client.Printf("%-20s %-30s %d rooms\n", zone.ID, zone.Name, len(zone.RoomIDS))
+		}
+		client.Printf("%d zones.\n", data.World.ZoneCount())
+		return nil
+	}
+
+	zone := data.World.GetZone(id)
+	if command == "new" {
+		if zone != nil || !olcIDRe.MatchString(id) {
+			client.Printf("Zone ID %s is not valid or already in use.\n", id)
+			return nil
+		}
+		if text == "" {
+			text = id
+		}
+		zone = world.NewZone(id, text)
+		data.World.AddZone(zone)
+		if client.saveZone(zone) {
+			client.Audit("created zone %s", zone.ID)
+			client.Printf("Created zone %s.\n", zone.ID)
+		}
+		return nil
+	}
+	if zone == nil {
+		client.Printf("There is no zone %s.\n", id)
+		return nil
+	}
+
+	switch command {
+	case "":
+		client.Printf("Zone:  %s\nName:  %s\nShort: %s\nLong:  %s\nRooms: %s\n",
+			zone.ID, zone.Name, zone.Short, zone.Long,
+			strings.Join(zone.RoomIDS, " "))
+		return nil
+	case "name":
+		zone.Change(func() { zone.Name = text })
+	case "short":
+		zone.Change(func() { zone.Short = text })
+	case "long":
+		zone.Change(func() { zone.Long = text })
+	default:
+		return ErrUsage
+	}
+	if client.saveZone(zone) {
+		client.Audit("changed %s of zone %s", command, zone.ID)
+		client.Printf("Changed %s of zone %s.\n", command, zone.ID)
+	}
+	return nil
+}
+
+// Makes a two way exit to a new room, or to an existing room if its ID
+// is given.
+func doDig(data *ActionData) (err error) {
+	client := data.Client
+	args := strings.Fields(string(data.Rest))
+	if len(args) < 1 || len(args) > 2 {
+		return ErrUsage
+	}
+	room := client.Room()
+	if room == nil {
+		client.Printf("You are nowhere. Use goto or redit new first.\n")
+		return nil
+	}
+	direction, ok := world.ParseDirection(args[0])
+	if !ok {
+		client.Printf("Unknown direction %s.\n", args[0])
+		return nil
+	}
+	if _, have := room.Exits[direction]; have {
+		client.Printf("There already is an exit %s.\n", direction)
+		return nil
+	}
+
+	var to *world.Room
+	if len(args) > 1 && !olcIDRe.MatchString(args[1]) {
+		client.Printf("Room ID %s is not valid.\n", args[1])
+		return nil
+	} else if len(args) > 1 && data.World.HaveRoom(args[1]) {
+		if to, err = data.World.LoadRoom(args[1]); err != nil {
+			return err
+		}
+	} else {
+		id := ""
+		if len(args) > 1 {
+			id = args[1]
+		}
+		if to = client.newRoom(id, room.ZoneID); to == nil {
+			return nil
+		}
+	}
+
+	room.SetExit(direction, to)
+	if _, have := to.Exits[direction.Opposite()]; !have {
+		to.SetExit(direction.Opposite(), room)
+	}
+	if !client.saveRoom(room) || !client.saveRoom(to) {
+		return nil
+	}
+	client.Audit("dug %s from room %s to %s", direction, room.ID, to.ID)
+	client.Printf("Dug an exit %s to %s.\n", direction, to.ID)
+	client.ShowRoomChange(room, "A new exit appears to the "+string(direction)+".")
+	client.ShowRoomChange(to, "A new exit appears to the "+string(direction.Opposite())+".")
+	return nil
+}
+
+func doGoto(data *ActionData) (err error) {
+	client := data.Client
+	id := strings.TrimSpace(string(data.Rest))
+	if id == "" {
+		return ErrUsage
+	}
+	if !olcIDRe.MatchString(id) {
+		client.Printf("Room ID %s is not valid.\n", id)
+		return nil
+	}
+	room, err := data.World.LoadRoom(id)
+	if err != nil {
+		client.Printf("There is no room %s.\n", id)
+		return nil
+	}
+	if err = client.MoveTo(room); err != nil {
+		return err
+	}
+	return doLook(data)
+}
@@ -9,66 +9,20 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/beoran/woe/monolog"
 	"github.com/beoran/woe/world"
 )
 
-var MSSP map[string]string
-
 const STATUS_OK = 0
 const STATUS_CANNOT_LISTEN = 1
 const STATUS_RESTART = 0
 const STATUS_SHUTDOWN = 4
 const MAX_CLIENTS = 1000
 
-func init() {
-	MSSP = map[string]string{
-		"NAME":             "Workers Of Eruta",
-		"UPTIME":           string(time.Now().Unix()),
-		"PLAYERS":          "0",
-		"CRAWL DELAY":      "0",
-		"CODEBASE":         "WOE",
-		"CONTACT":          "beoran@gmail.com",
-		"CREATED":          "2015",
-		"ICON":             "None",
-		"LANGUAGE":         "English",
-		"LOCATION":         "USA",
-		"MINIMUM AGE":      "18",
-		"WEBSITE":          "beoran.net",
-		"FAMILY":           "Custom",
-		"GENRE":            "Science Fiction",
-		"GAMEPLAY":         "Adventure",
-		"STATUS":           "Alpha",
-		"GAMESYSTEM":       "Custom",
-		"INTERMUD":         "",
-		"SUBGENRE":         "None",
-		"AREAS":            "0",
-		"HELPFILES":        "0",
-		"MOBILES":          "0",
-		"OBJECTS":          "0",
-		"ROOMS":            "1",
-		"CLASSES":          "0",
-		"LEVELS":           "0",
-		"RACES":            "3",
-		"SKILLS":           "900",
-		"ANSI":             "1",
-		"MCCP":             "1",
-		"MCP":              "0",
-		"MSDP":             "0",
-		"MSP":              "0",
-		"MXP":              "0",
-		"PUEBLO":           "0",
-		"UTF-8":            "1",
-		"VT100":            "1",
-		"XTERM 255 COLORS": "1",
-		"PAY TO PLAY":      "0",
-		"PAY FOR PERKS":    "0",
-		"HIRING BUILDERS":  "0",
-		"HIRING CODERS":    "0"}
-}
-
 type Server struct {
 	address    string
 	listener   net.Listener
@@ -77,6 +31,17 @@ type Server struct {
 	alive      bool
 	World      *world.World
 	exitstatus int
+	// Time the server was started, for the MSSP uptime.
+	started time.Time
+	// Static MSSP fields, from the MSSP configuration file.
+	mssp map[string]string
+	// Where the world is saved.
+	storage world.Storage
+	// Keeps the recent log lines for /tail, or nil.
+	logRing *monolog.RingLogger
+	// Guards clients, which the clients, the tickers and the reaper of
+	// disconnected clients all use from their own goroutines.
+	clientsMutex sync.RWMutex
 }
 
 type Ticker struct {
@@ -99,7 +64,10 @@ Welcome!
 `
 
 func (me *Server) SetupWorld() (err error) {
-	me.World, err = world.LoadWorld(me.DataPath(), "WOE")
+	me.World, err = world.LoadWorld(me.storage, "WOE")
+	if os.IsNotExist(err) {
+		me.World, err = nil, nil
+	}
 
 	if err != nil {
 		monolog.Error("Could not load world WOE: %s", err)
@@ -108,8 +76,8 @@ func (me *Server) SetupWorld() (err error) {
 
 	if me.World == nil {
 		monolog.Info("Creating new default world...")
-		me.World = world.NewWorld("WOE", DEFAULT_MOTD, me.DataPath())
-		err := me.World.Save(me.DataPath())
+		me.World = world.NewWorld("WOE", DEFAULT_MOTD, me.storage)
+		err := me.World.Save()
 		if err != nil {
 			monolog.Error("Could not save world: %v", err)
 			return err
@@ -117,10 +85,14 @@ func (me *Server) SetupWorld() (err error) {
 			monolog.Info("Saved default world.")
 		}
 	}
+	// Characters load their room from the default world.
+	world.DefaultWorld = me.World
 	return nil
 }
 
-func NewServer(address string) (server *Server, err error) {
+// Makes a new server that listens at the address, and keeps the world in
+// the storage backend with the given name, see world.OpenStorage.
+func NewServer(address string, backend string) (server *Server, err error) {
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return nil, err
@@ -131,12 +103,20 @@ func NewServer(address string) (server *Server, err error) {
 	clients := make(map[int]*Client)
 	tickers := make(map[string]*Ticker)
 
-	server = &Server{address, listener, clients, tickers, true, nil, STATUS_RESTART}
+	server = &Server{address, listener, clients, tickers, true, nil, STATUS_RESTART, time.Now(), nil, nil, nil, sync.RWMutex{}}
+	server.storage, err = world.OpenStorage(backend, server.DataPath())
+	if err != nil {
+		monolog.Error("Could not open %s storage: %v", backend, err)
+		listener.Close()
+		return nil, err
+	}
+	monolog.Info("Using %s storage.", backend)
 	err = server.SetupWorld()
 	if err != nil {
 		monolog.Error("Could not set up or load world!")
 		return nil, err
 	}
+	server.LoadMSSP()
 
 	monolog.Info("Server world set up.")
 	server.AddDefaultTickers()
@@ -193,47 +173,118 @@ func (me *Server) AddTicker(name string, milliseconds int, callback func(me *Tic
 }
 
 func onWeatherTicker(me *Ticker, t time.Time) bool {
-	me.Server.BroadcastToChannel("weather", "The weather is changing...\n")
+	me.Server.BroadcastToChannel("weather", "", "The weather is changing...\n")
 	return true
 }
 
+// Saves what changed in the world.
+func onAutosaveTicker(me *Ticker, t time.Time) bool {
+	saved, err := me.Server.World.SaveDirty()
+	if err != nil {
+		monolog.Error("Autosave failed: %v", err)
+	} else if saved > 0 {
+		monolog.Info("Autosave saved %d changes.", saved)
+	}
+	return true
+}
+
+// How often the world is saved by default.
+const DEFAULT_AUTOSAVE = 5 * time.Minute
+
+// Sets how often what changed in the world is saved. Zero or less
+// turns autosave off.
+func (me *Server) SetAutosave(interval time.Duration) {
+	if interval <= 0 {
+		me.RemoveTicker("autosave")
+		monolog.Info("Autosave is off.")
+		return
+	}
+	me.AddTicker("autosave", int(interval/time.Millisecond), onAutosaveTicker)
+	monolog.Info("Autosave every %s.", interval)
+}
+
 func (me *Server) AddDefaultTickers() {
 	me.AddTicker("weather", 30000, onWeatherTicker)
+	me.SetAutosave(DEFAULT_AUTOSAVE)
 }
 
 func (me *Server) handleDisconnectedClients() {
 	for me.alive {
 		time.Sleep(1)
-		for id, client := range me.clients {
-			if !client.IsAlive() {
+		for _, client := range me.Clients() {
+			if client.IsLinkDead() && time.Since(client.linkdead) < LINKDEAD_TIMEOUT {
+				continue
+			}
+			// A link dead client may have been taken over in the mean time.
+			if !client.IsAlive() && me.removeClient(client) {
 				monolog.Info("Client %d has disconnected.", client.id)
 				client.Close()
-				delete(me.clients, id)
 			}
 		}
 	}
 }
 
-func (me *Server) findFreeID() (id int, err error) {
-	for id = 0; id < MAX_CLIENTS; id++ {
-		client, have := me.clients[id]
-		if (!have) || (client == nil) {
-			return id, nil
+// Returns the connected clients, including link dead ones, sorted by id.
+func (me *Server) Clients() []*Client {
+	me.clientsMutex.RLock()
+	defer me.clientsMutex.RUnlock()
+	clients := make([]*Client, 0, len(me.clients))
+	for _, client := range me.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+// Returns the client with the id, or nil if there is none.
+func (me *Server) ClientByID(id int) *Client {
+	me.clientsMutex.RLock()
+	defer me.clientsMutex.RUnlock()
+	return me.clients[id]
+}
+
+// Adds a client for the connection with the first free id.
+func (me *Server) addClient(conn net.Conn) (client *Client, err error) {
+	me.clientsMutex.Lock()
+	defer me.clientsMutex.Unlock()
+	for id := 0; id < MAX_CLIENTS; id++ {
+		if other, have := me.clients[id]; !have || other == nil {
+			client = NewClient(me, id, conn)
+			me.clients[id] = client
+			return client, nil
 		}
 	}
-	return -1, fmt.Errorf("Too many clients!")
+	return nil, fmt.Errorf("Too many clients!")
+}
+
+// Removes the client from the server. Returns false if it was already
+// removed, so only one goroutine ends up with a client that is removed.
+func (me *Server) removeClient(client *Client) bool {
+	me.clientsMutex.Lock()
+	defer me.clientsMutex.Unlock()
+	if me.clients[client.id] != client {
+		return false
+	}
+	delete(me.clients, client.id)
+	return true
 }
 
 func (me *Server) onConnect(conn net.Conn) (err error) {
-	id, err := me.findFreeID()
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil && me.World != nil {
+		if ban := me.World.Bans().Find("", host); ban != nil {
+			monolog.Warning("Refusing connection for %s: banned (%s).", host, ban.Target)
+			conn.Write([]byte("Your address is banned.\r\n"))
+			conn.Close()
+			return nil
+		}
+	}
+	client, err := me.addClient(conn)
 	if err != nil {
-		monolog.Info("Refusing connection for %s: too many clients. ", conn.RemoteAddr().String())
+		monolog.Info("Refusing connection for %s: %v", conn.RemoteAddr().String(), err)
 		conn.Close()
 		return nil
 	}
-	monolog.Info("New client connected from %s, id %d. ", conn.RemoteAddr().String(), id)
-	client := NewClient(me, id, conn)
-	me.clients[id] = client
+	monolog.Info("New client connected from %s, id %d. ", conn.RemoteAddr().String(), client.id)
 	return client.Serve()
 }
 
@@ -257,13 +308,21 @@ func (me *Server) Close() {
 	}
 
 	monolog.Info("Closing server, shutting down clients.")
-	for _, client := range me.clients {
+	for _, client := range me.Clients() {
 		if client.IsAlive() {
 			client.Close()
 		}
 	}
 
 	me.handleDisconnectedClients()
+	if saved, err := me.World.SaveDirty(); err != nil {
+		monolog.Error("Could not save the world: %v", err)
+	} else {
+		monolog.Info("Saved %d changes.", saved)
+	}
+	if err := me.storage.Close(); err != nil {
+		monolog.Error("Could not close storage: %v", err)
+	}
 	monolog.Info("Closed server.")
 }
 
@@ -294,7 +353,7 @@ func (me *Server) Serve() (status int, err error) {
 }
 
 func (me *Server) BroadcastString(message string) {
-	for _, client := range me.clients {
+	for _, client := range me.Clients() {
 		if client.IsAlive() {
 			client.WriteString(message)
 		}
@@ -306,17 +365,21 @@ func (me *Server) Broadcast(format string, args ...interface{}) {
 	me.BroadcastString(msg)
 }
 
-func (me *Server) BroadcastStringToChannel(channelname string, message string) {
-	for _, client := range me.clients {
+// Sends the message to everyone listening to the channel. The talker is
+// who said it, or empty if it comes from the game itself.
+func (me *Server) BroadcastStringToChannel(channelname string, talker string, message string) {
+	for _, client := range me.Clients() {
 		if client.IsLoginFinished() && client.IsListeningToChannel(channelname) {
+			client.PlaySound(world.SOUND_EVENT_CHANNEL)
 			client.WriteString(message)
+			client.SendGMCPChannel(channelname, talker, message)
 		}
 	}
 }
 
-func (me *Server) BroadcastToChannel(channelname string, format string, args ...interface{}) {
+func (me *Server) BroadcastToChannel(channelname string, talker string, format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
-	me.BroadcastStringToChannel(channelname, msg)
+	me.BroadcastStringToChannel(channelname, talker, msg)
 }
 
 // Returns the data path of the server
@@ -335,6 +398,21 @@ func (me *Server) DataPath() string {
 	return fp
 }
 
+// Returns the storage the world is kept in.
+func (me *Server) Storage() world.Storage {
+	return me.storage
+}
+
+// Sets the logger that keeps the recent log lines for /tail.
+func (me *Server) SetLogRing(ring *monolog.RingLogger) {
+	me.logRing = ring
+}
+
+// Returns the logger with the recent log lines, or nil if there is none.
+func (me *Server) LogRing() *monolog.RingLogger {
+	return me.logRing
+}
+
 // Returns the script path of the server
 func (me *Server) ScriptPath() string {
 	//
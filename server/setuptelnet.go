@@ -5,147 +5,402 @@ import t "github.com/beoran/woe/telnet"
 import "github.com/beoran/woe/telnet"
 import "strings"
 import "strconv"
+import "time"
 
 /* This file contains telnet setup helpers for the client. */
 
-// generic negotiation
+// Options the client may enable unsolicited, on our side (us, when the
+// client sends DO) or on the client's side (him, when the client sends WILL).
+// Anything else is refused by the RFC 1143 state machine in telnet.
+type TeloptPolicy struct {
+	Telopt byte
+	Us     bool
+	Him    bool
+}
 
-func (me *Client) SetupNegotiate(millis int, command byte, option byte, yes_event telnet.EventType, no_event telnet.EventType) (bool, telnet.Event) {
-	me.telnet.TelnetSendNegotiate(command, option)
-	tev, timeout, close := me.TryReadEvent(millis)
+var TeloptPolicies = []TeloptPolicy{
+	{t.TELNET_TELOPT_BINARY, true, true},
+	{t.TELNET_TELOPT_SGA, true, false},
+	{t.TELNET_TELOPT_MSSP, true, false},
+	{t.TELNET_TELOPT_MSDP, true, false},
+	{t.TELNET_TELOPT_GMCP, true, false},
+	{t.TELNET_TELOPT_NAWS, false, true},
+	{t.TELNET_TELOPT_TTYPE, false, true},
+	{t.TELNET_TELOPT_NEW_ENVIRON, false, true},
+	{t.TELNET_TELOPT_CHARSET, true, true},
+	{t.TELNET_TELOPT_MXP, false, true},
+	{t.TELNET_TELOPT_MSP, false, true},
+}
 
-	if tev == nil || timeout || close {
-		monolog.Info("Timeout or close in TryReadEvent")
-		return false, nil
+// Sets up the telnet negotiation policy of the client.
+func (me *Client) SetupTelnetPolicy() {
+	for _, policy := range TeloptPolicies {
+		me.telnet.SetPolicy(policy.Telopt, policy.Us, policy.Him)
 	}
+}
+
+// Returns the negotiated state of a telnet option for this client.
+// us is true if the server side of the option is enabled, him is true if the
+// client side of the option is enabled.
+func (me *Client) TeloptEnabled(telopt byte) (us bool, him bool) {
+	return me.telnet.UsEnabled(telopt), me.telnet.HimEnabled(telopt)
+}
+
+// How to set up a telnet option. Enable and Disable are called whenever the
+// option is enabled or disabled, be it on our request or by the client.
+type TeloptSetup struct {
+	Telopt byte
+	// TELNET_WILL for an option on our side, TELNET_DO for the client's side.
+	Command byte
+	// True if the server proposes the option when the client connects.
+	Propose bool
+	// True if the client replies with a subnegotiation once enabled.
+	Reply   bool
+	Enable  func(me *Client)
+	Disable func(me *Client)
+}
 
-	evtype := telnet.EventTypeOf(tev)
+// The telnet options the server supports.
+var TeloptSetups = []TeloptSetup{
+	{t.TELNET_TELOPT_BINARY, t.TELNET_WILL, false, false, (*Client).enableBinary, (*Client).disableBinary},
+	{t.TELNET_TELOPT_SGA, t.TELNET_WILL, true, false, (*Client).enableSGA, (*Client).disableSGA},
+	{t.TELNET_TELOPT_MSSP, t.TELNET_WILL, true, false, (*Client).enableMSSP, nil},
+	{t.TELNET_TELOPT_COMPRESS2, t.TELNET_WILL, true, false, (*Client).enableCompress2, (*Client).disableCompress2},
+	{t.TELNET_TELOPT_NAWS, t.TELNET_DO, true, true, nil, (*Client).disableNAWS},
+	{t.TELNET_TELOPT_TTYPE, t.TELNET_DO, true, true, (*Client).enableTType, nil},
+	{t.TELNET_TELOPT_NEW_ENVIRON, t.TELNET_DO, true, true, (*Client).enableNewEnviron, nil},
+	{t.TELNET_TELOPT_CHARSET, t.TELNET_WILL, true, true, (*Client).enableCharset, nil},
+	{t.TELNET_TELOPT_MXP, t.TELNET_DO, true, false, (*Client).enableMXP, (*Client).disableMXP},
+	{t.TELNET_TELOPT_MSP, t.TELNET_DO, true, false, (*Client).enableMSP, (*Client).disableMSP},
+	{t.TELNET_TELOPT_MSDP, t.TELNET_WILL, true, false, (*Client).enableMSDP, (*Client).disableMSDP},
+	{t.TELNET_TELOPT_GMCP, t.TELNET_WILL, true, false, (*Client).enableGMCP, (*Client).disableGMCP},
+}
 
-	if evtype == no_event {
-		monolog.Info("Negative event no_event %v %v %v", tev, evtype, no_event)
-		return false, tev
+// Finds how to set up the option on the side of the negotiation command.
+// Returns nil if the option is not supported on that side.
+func FindTeloptSetup(command byte, telopt byte) *TeloptSetup {
+	for index := range TeloptSetups {
+		setup := &TeloptSetups[index]
+		if setup.Command == command && setup.Telopt == telopt {
+			return setup
+		}
 	}
+	return nil
+}
 
-	if evtype != yes_event {
-		monolog.Info("Unexpected event yes_event %v %v %v", tev, evtype, yes_event)
-		return false, tev
+// Maximum time in ms the telnet setup may take before the client gets
+// the login prompt. Options the client didn't answer by then are ignored.
+const TELNET_SETUP_TIMEOUT = 2000
+
+// Maximum amount of terminal types to cycle through with TTYPE.
+const TTYPE_MAX_CYCLE = 8
+
+/*
+Sets up the telnet connection. All options are proposed at once, and the
+answers are dispatched by option as they arrive, in any order, until all
+options are answered or the setup times out.
+
+Some clients, like tinyfugue actively initiate telnet setup, but seem to
+wait for server activity before they do so. Therefore a NOP is sent first
+to prod the client into activity. Their requests are handled according to
+TeloptPolicies, like those that arrive after the setup.
+*/
+func (me *Client) SetupTelnet() {
+	me.SetupTelnetPolicy()
+	me.setupPending = make(map[byte]bool)
+	defer func() { me.setupPending = nil }()
+
+	me.telnet.SendRaw([]byte{telnet.TELNET_IAC, telnet.TELNET_NOP})
+	for _, setup := range TeloptSetups {
+		if setup.Propose {
+			me.setupPending[setup.Telopt] = true
+			me.telnet.RequestNegotiate(setup.Command, setup.Telopt)
+		}
 	}
 
-	if tev == nil {
-		return false, tev
+	deadline := time.Now().Add(TELNET_SETUP_TIMEOUT * time.Millisecond)
+	for len(me.setupPending) > 0 {
+		left := time.Until(deadline)
+		if left <= 0 {
+			break
+		}
+		event, timeout, done := me.TryReadEvent(int(left / time.Millisecond))
+		if done {
+			return
+		}
+		if timeout {
+			break
+		}
+		if data := me.HandleTelnetEvent(event); data != nil {
+			// Keep input that arrives during setup for later.
+			me.lines.Write(data)
+		}
 	}
 
-	return true, tev
+	for telopt := range me.setupPending {
+		monolog.Info("Client %d did not answer telnet option %d in time", me.id, telopt)
+	}
 }
 
-// Negotiate BINARY support, for sending UTF-8. This is largely a courtesy to the cliennt,
-// since woe will send UTF-8 anyway.
-func (me *Client) SetupBinary() telnet.Event {
-	ok, tev := me.SetupNegotiate(1000, t.TELNET_WILL, t.TELNET_TELOPT_BINARY, t.TELNET_DO_EVENT, t.TELNET_DONT_EVENT)
-	if !ok {
-		me.info.binary = false
-		return tev
+// Marks the setup of the option as done.
+func (me *Client) setupDone(telopt byte) {
+	if me.setupPending != nil {
+		delete(me.setupPending, telopt)
 	}
+}
 
-	monolog.Info("Client #{@id} accepts BINARY")
-	me.info.binary = true
-	return tev
+// Handles a change of the state of a telnet option, command is
+// TELNET_WILL for our side and TELNET_DO for the client's side.
+func (me *Client) teloptChanged(command byte, telopt byte, enabled bool) {
+	setup := FindTeloptSetup(command, telopt)
+	if setup == nil {
+		monolog.Info("Client %d telnet option %d %d enabled: %v", me.id, command, telopt, enabled)
+		me.setupDone(telopt)
+		return
+	}
+	if !enabled {
+		if setup.Disable != nil {
+			setup.Disable(me)
+		}
+		me.setupDone(telopt)
+		return
+	}
+	if setup.Enable != nil {
+		setup.Enable(me)
+	}
+	if !setup.Reply {
+		me.setupDone(telopt)
+	}
 }
 
-// negotiate suppress go ahead
-func (me *Client) SetupSupressGA() telnet.Event {
-	ok, tev := me.SetupNegotiate(1000, t.TELNET_WILL, t.TELNET_TELOPT_SGA, t.TELNET_DO_EVENT, t.TELNET_DONT_EVENT)
-	if !ok {
-		me.info.binary = false
-		return tev
+// Handles any telnet event, during the setup or afterwards.
+// Returns the received data, transcoded to UTF-8, for data events,
+// and nil for all other events.
+func (me *Client) HandleTelnetEvent(event telnet.Event) []byte {
+	switch event := event.(type) {
+	case *telnet.DataEvent:
+		monolog.Log("TELNETDATAEVENT", "Telnet data event %T : %d.", event, len(event.Data))
+		return me.info.encoding.Decode(event.Data)
+	case *telnet.WillEvent:
+		me.teloptChanged(t.TELNET_DO, event.Telopt, true)
+	case *telnet.WontEvent:
+		me.teloptChanged(t.TELNET_DO, event.Telopt, false)
+	case *telnet.DoEvent:
+		me.teloptChanged(t.TELNET_WILL, event.Telopt, true)
+	case *telnet.DontEvent:
+		me.teloptChanged(t.TELNET_WILL, event.Telopt, false)
+	case *telnet.NAWSEvent:
+		monolog.Log("TELNETNAWSEVENT", "Telnet NAWS event %T.", event)
+		me.HandleNAWSEvent(event)
+		me.setupDone(t.TELNET_TELOPT_NAWS)
+	case *telnet.TTypeEvent:
+		me.HandleTTypeEvent(event)
+	case *telnet.EnvironmentEvent:
+		monolog.Log("TELNETENVIRONEVENT", "Telnet NEW-ENVIRON event %v.", event.Vars)
+		me.HandleEnvironmentEvent(event)
+		me.setupDone(t.TELNET_TELOPT_NEW_ENVIRON)
+	case *telnet.CharsetEvent:
+		monolog.Log("TELNETCHARSETEVENT", "Telnet CHARSET event %v.", event.Charsets)
+		me.HandleCharsetEvent(event)
+	case *telnet.GMCPEvent:
+		monolog.Log("TELNETGMCPEVENT", "Telnet GMCP event %s.", event.Name)
+		me.HandleGMCPEvent(event)
+	case *telnet.MSDPEvent:
+		monolog.Log("TELNETMSDPEVENT", "Telnet MSDP event %v.", event.Vars)
+		me.HandleMSDPEvent(event)
+	default:
+		monolog.Info("Ignoring telnet event %T : %v for now.", event, event)
 	}
+	return nil
+}
 
-	monolog.Info("Client #{@id} will suppress GA")
+// BINARY is used for sending UTF-8 or other 8 bit character sets.
+// The character set itself is negotiated with CHARSET.
+func (me *Client) enableBinary() {
+	monolog.Info("Client %d accepts BINARY", me.id)
+	me.info.binary = true
+}
+
+func (me *Client) disableBinary() {
+	me.info.binary = false
+}
+
+func (me *Client) enableSGA() {
+	monolog.Info("Client %d will suppress GA", me.id)
 	me.info.sga = true
-	return tev
+}
 
+func (me *Client) disableSGA() {
+	me.info.sga = false
 }
 
-// Negotiate COMPRESS2 support
-func (me *Client) SetupCompress2() telnet.Event {
-	ok, tev := me.SetupNegotiate(1000, t.TELNET_WILL, t.TELNET_TELOPT_COMPRESS2, t.TELNET_DO_EVENT, t.TELNET_DONT_EVENT)
-	if !ok {
-		return tev
-	}
+func (me *Client) enableMSSP() {
+	me.telnet.TelnetSendMSSP(me.server.BuildMSSP())
+	monolog.Info("Client %d accepts MSSP", me.id)
+	me.info.mssp = true
+}
 
+func (me *Client) enableCompress2() {
 	me.telnet.TelnetBeginCompress2()
-	monolog.Info("Client #{@id} started COMPRESS2 compression")
+	monolog.Info("Client %d started COMPRESS2 compression", me.id)
 	me.info.compress2 = true
-	return tev
 }
 
-// Negotiate NAWS (window size) support
-func (me *Client) SetupNAWS() telnet.Event {
-	ok, tev := me.SetupNegotiate(1000, t.TELNET_DO, t.TELNET_TELOPT_NAWS, t.TELNET_WILL_EVENT, t.TELNET_WONT_EVENT)
-	if !ok {
-		return tev
+// The telnet package already stops compressing on DONT COMPRESS2.
+func (me *Client) disableCompress2() {
+	me.info.compress2 = false
+}
+
+// The window size itself arrives as a NAWS subnegotiation.
+func (me *Client) disableNAWS() {
+	me.info.naws = false
+}
+
+// Starts cycling through the terminal types of the client.
+func (me *Client) enableTType() {
+	me.info.terminals = nil
+	me.telnet.TelnetTTypeSend()
+}
+
+// NEW-ENVIRON variables the server asks for, including those of MNES,
+// the Mud New-Environ Standard.
+var EnvironVariables = []string{"CLIENT_NAME", "CLIENT_VERSION", "CHARSET",
+	"IPADDRESS", "MTTS", "TERMINAL_TYPE"}
+
+// Asks the client to identify itself.
+func (me *Client) enableNewEnviron() {
+	monolog.Info("Client %d accepts NEW-ENVIRON", me.id)
+	me.telnet.TelnetNewenvironSend(EnvironVariables, nil)
+}
+
+// Stores the NEW-ENVIRON variables the client sent in reply to our
+// request (IS) or because they changed (INFO).
+func (me *Client) HandleEnvironmentEvent(event *telnet.EnvironmentEvent) {
+	if event.Telopt == t.TELNET_ENVIRON_SEND {
+		monolog.Info("Client %d asked for our NEW-ENVIRON variables, ignored.", me.id)
+		return
+	}
+	// Copy the map, since it may be in use elsewhere.
+	environ := make(map[string]string)
+	for key, value := range me.info.environ {
+		environ[key] = value
 	}
+	for _, env := range event.Vars {
+		environ[env.Name] = env.Value
+		switch env.Name {
+		case "CLIENT_NAME":
+			me.info.clientName = env.Value
+		case "CLIENT_VERSION":
+			me.info.clientVersion = env.Value
+		case "CHARSET":
+			me.info.charset = env.Value
+			me.negotiateEncoding(env.Value)
+		case "IPADDRESS":
+			me.info.ipaddress = env.Value
+		case "MTTS":
+			if num, err := strconv.Atoi(env.Value); err == nil {
+				me.info.mtts = num
+			}
+		case "TERMINAL_TYPE":
+			me.info.terminal = env.Value
+		}
+	}
+	me.info.environ = environ
+	me.info.environment = true
+	monolog.Info("Client %d is %s %s, charset %s, address %s", me.id,
+		me.info.clientName, me.info.clientVersion, me.info.charset, me.info.ipaddress)
+}
 
-	tev2, _, _ := me.TryReadEvent(1000)
-	if (tev2 == nil) || (!telnet.IsEventType(tev2, t.TELNET_NAWS_EVENT)) {
-		return tev2
+// Sets the character set used to transcode text to and from the client.
+// Returns false if the character set isn't supported.
+func (me *Client) SetEncoding(name string) bool {
+	charset := telnet.FindCharset(name)
+	if charset == nil {
+		monolog.Info("Client %d character set %s not supported", me.id, name)
+		return false
 	}
+	me.info.encoding = charset
+	monolog.Info("Client %d uses character set %s", me.id, charset.Name)
+	return true
+}
 
-	nawsevent, ok := tev2.(*telnet.NAWSEvent)
-	if ok {
-		me.info.w = nawsevent.W
-		me.info.h = nawsevent.H
-		monolog.Info("Client %d window size #{%d}x#{%d}", me.id, me.info.w, me.info.h)
-		me.info.naws = true
+// Sets the character set the client negotiated, unless the player chose
+// one for the account, which always wins.
+func (me *Client) negotiateEncoding(name string) bool {
+	if me.account != nil && me.account.Charset != "" {
+		monolog.Info("Client %d keeps character set %s of the account, not %s",
+			me.id, me.account.Charset, name)
+		charset := telnet.FindCharset(name)
+		return charset != nil && charset.Name == me.account.Charset
 	}
-	return nil
+	return me.SetEncoding(name)
 }
 
-func (me *Client) SetupMSSP() telnet.Event {
-	ok, tev := me.SetupNegotiate(1000, t.TELNET_WILL, t.TELNET_TELOPT_MSSP, t.TELNET_DO_EVENT, t.TELNET_DONT_EVENT)
-	if !ok {
-		return tev
+// Returns the name of the character set used for the client.
+func (me *Client) EncodingName() string {
+	if me.info.encoding == nil {
+		return "UTF-8"
 	}
-	me.telnet.TelnetSendMSSP(MSSP)
-	monolog.Info("Client %d accepts MSSP", me.id)
-	me.info.mssp = true
-	return nil
+	return me.info.encoding.Name
 }
 
-// Check for MXP (html-like) support (but don't implement it yet)
-func (me *Client) SetupMXP() telnet.Event {
+// Offers our character sets to the client (RFC 2066).
+func (me *Client) enableCharset() {
+	monolog.Info("Client %d accepts CHARSET", me.id)
+	me.telnet.TelnetCharsetRequest(telnet.CharsetNames()...)
+}
 
-	ok, tev := me.SetupNegotiate(1000, t.TELNET_DO, t.TELNET_TELOPT_MXP, t.TELNET_WILL_EVENT, t.TELNET_WONT_EVENT)
-	if !ok {
-		return tev
+// Handles a CHARSET reply to our request, or a request from the client.
+func (me *Client) HandleCharsetEvent(event *telnet.CharsetEvent) {
+	switch event.Command {
+	case t.TELNET_CHARSET_ACCEPTED:
+		if len(event.Charsets) > 0 {
+			me.negotiateEncoding(event.Charsets[0])
+		}
+		me.setupDone(t.TELNET_TELOPT_CHARSET)
+	case t.TELNET_CHARSET_REJECTED:
+		monolog.Info("Client %d rejected our character sets", me.id)
+		me.setupDone(t.TELNET_TELOPT_CHARSET)
+	case t.TELNET_CHARSET_REQUEST:
+		for _, name := range event.Charsets {
+			if me.negotiateEncoding(name) {
+				me.telnet.TelnetCharsetAccept(name)
+				return
+			}
+		}
+		me.telnet.TelnetCharsetReject()
 	}
+}
+
+// Starts MXP. See mxp.go for the MXP output helpers.
+func (me *Client) enableMXP() {
+	me.telnet.TelnetSubnegotiation(t.TELNET_TELOPT_MXP, nil)
 	monolog.Info("Client %d accepts MXP", me.id)
 	me.info.mxp = true
-	return nil
 }
 
-// Check for MSP (sound) support (but don't implement it yet)
-func (me *Client) SetupMSP() telnet.Event {
+func (me *Client) disableMXP() {
+	me.info.mxp = false
+}
 
-	ok, tev := me.SetupNegotiate(1000, t.TELNET_DO, t.TELNET_TELOPT_MSP, t.TELNET_WILL_EVENT, t.TELNET_WONT_EVENT)
-	if !ok {
-		return tev
-	}
+// MSP (sound) support. See msp.go for the sound triggers.
+func (me *Client) enableMSP() {
 	monolog.Info("Client %d accepts MSP", me.id)
 	me.info.msp = true
-	return nil
 }
 
-// Check for MSDP (two way MSSP) support (but don't implement it yet)
-func (me *Client) SetupMSDP() telnet.Event {
+func (me *Client) disableMSP() {
+	me.info.msp = false
+}
 
-	ok, tev := me.SetupNegotiate(1000, t.TELNET_WILL, t.TELNET_TELOPT_MSDP, t.TELNET_DO_EVENT, t.TELNET_DONT_EVENT)
-	if !ok {
-		return tev
-	}
+// MSDP (two way MSSP) support. See msdp.go for the variables.
+func (me *Client) enableMSDP() {
 	monolog.Info("Client %d accepts MSDP", me.id)
 	me.info.msdp = true
-	return nil
+}
+
+func (me *Client) disableMSDP() {
+	me.info.msdp = false
 }
 
 func (me *Client) HasTerminal(name string) bool {
@@ -158,54 +413,22 @@ func (me *Client) HasTerminal(name string) bool {
 	return false
 }
 
-// Negotiate MTTS/TTYPE (TERMINAL TYPE) support
-func (me *Client) SetupTType() telnet.Event {
-	me.info.terminals = nil
-	ok, tev := me.SetupNegotiate(1000, t.TELNET_DO, t.TELNET_TELOPT_TTYPE, t.TELNET_WILL_EVENT, t.TELNET_WONT_EVENT)
-	if !ok {
-		return tev
-	}
-
-	var last string = "none"
-	var now string = ""
-
-	for last != now {
-		last = now
-		me.telnet.TelnetTTypeSend()
-		var tev2 telnet.Event = nil
-		// Some clients (like KildClient, but not TinTin or telnet),
-		// insist on spamming useless NUL characters
-		// here... So we have to retry a few times to get a ttype_is
-		// throwing away any undesirable junk in between.
-	GET_TTYPE:
-		for index := 0; index < 3; index++ {
-			tev2, _, _ = me.TryReadEvent(1000)
-			if tev2 != nil {
-				etyp := telnet.EventTypeOf(tev2)
-				monolog.Info("Waiting for TTYPE: %T %v %d", tev2, tev2, etyp)
-				if telnet.IsEventType(tev2, t.TELNET_TTYPE_EVENT) {
-					monolog.Info("TTYPE received: %T %v %d", tev2, tev2, etyp)
-					break GET_TTYPE
-				}
-			} else { // and some clients don't respond, even
-				monolog.Info("Waiting for TTYPE: %T", tev2)
-			}
-		}
-
-		if tev2 == nil || !telnet.IsEventType(tev2, t.TELNET_TTYPE_EVENT) {
-			etyp := telnet.EventTypeOf(tev2)
-			monolog.Warning("Received no TTYPE: %T %v %d", tev2, tev2, etyp)
-			return tev2
-		}
-
-		ttypeevent := tev2.(*telnet.TTypeEvent)
-		now = ttypeevent.Name
-		if !me.HasTerminal(now) {
-			me.info.terminals = append(me.info.terminals, now)
-		}
-		me.info.terminal = now
+// Handles a terminal type sent by the client. The client cycles through
+// its terminal types on every request until the last one is repeated.
+func (me *Client) HandleTTypeEvent(event *telnet.TTypeEvent) {
+	monolog.Info("TTYPE received: %T %v", event, event)
+	if me.HasTerminal(event.Name) || len(me.info.terminals) >= TTYPE_MAX_CYCLE {
+		me.finishTType()
+		me.setupDone(t.TELNET_TELOPT_TTYPE)
+		return
 	}
+	me.info.terminals = append(me.info.terminals, event.Name)
+	me.info.terminal = event.Name
+	me.telnet.TelnetTTypeSend()
+}
 
+// Checks for MTTS support once all terminal types are known.
+func (me *Client) finishTType() {
 	monolog.Info("Client %d supports terminals %v", me.id, me.info.terminals)
 	monolog.Info("Client %d active terminal %v", me.id, me.info.terminal)
 
@@ -226,64 +449,4 @@ func (me *Client) SetupTType() telnet.Event {
 		}
 	}
 	me.info.ttype = true
-	return nil
-}
-
-/*
-Although most clients don't do this, some clients, like tinyfuge actively initiate telnet setup.
-Deal with that first, then do our own setup. It seems like tinyfuge is "waiting" for something
-before performing the setup, which messes up TryReadEvent...
-*/
-
-func (me *Client) ReadTelnetSetup() {
-	/* First send a NOP to prod the client into activity. This shouldn't be neccesary,
-	but some clients, in particular Tinyfugue waits for server activity before it sends it's own
-	telnet setup messages. If the NOP is not sent, those setup messages will then end up messing up the
-	telnet setup the WOE server is trying to do. Arguably this should perhaps be an AYT, but a NOP will
-	hopefully do the least damage.
-	*/
-	msg := []byte{telnet.TELNET_IAC, telnet.TELNET_NOP}
-	me.telnet.SendRaw(msg)
-
-	for {
-		// wait for incoming events.
-		event, _, _ := me.TryReadEvent(500)
-		if event == nil {
-			monolog.Info("Client %d no telnet setup received", me.id)
-			return
-		}
-
-		monolog.Info("Client %d telnet setup received: %v", me.id, event)
-
-		switch event := event.(type) {
-		case *telnet.DataEvent:
-			monolog.Info("Unexpected DATA event %T : %d.", event, len(event.Data))
-			// should do something with the data, maybe?
-			return
-		case *telnet.NAWSEvent:
-			monolog.Info("Received Telnet NAWS event %T.", event)
-			me.HandleNAWSEvent(event)
-
-		case *telnet.WillEvent:
-			monolog.Info("Received Telnet WILL event %T.", event)
-			// XXX do something with it!
-
-		default:
-			monolog.Info("Unexpected event in setup phase %T : %v. Ignored for now.", event, event)
-		}
-	}
-}
-
-func (me *Client) SetupTelnet() {
-	me.ReadTelnetSetup()
-	me.SetupSupressGA()
-	// me.SetupBinary()
-	me.SetupMSSP()
-	// me.SetupCompress2
-	me.SetupNAWS()
-	me.SetupTType()
-	me.SetupMXP()
-	me.SetupMSP()
-	me.SetupMSDP()
-	// me.ColorTest()
 }
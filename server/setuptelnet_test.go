@@ -0,0 +1,19 @@
+package server
+
+import "testing"
+import "github.com/beoran/woe/world"
+
+func TestNegotiateEncodingKeepsAccountCharset(test *testing.T) {
+	client := &Client{}
+	if !client.negotiateEncoding("Latin1") || client.EncodingName() != "ISO-8859-1" {
+		test.Fatalf("Negotiated character set not used: %s", client.EncodingName())
+	}
+	client.account = &world.Account{Charset: "CP437"}
+	client.SetEncoding("CP437")
+	if client.negotiateEncoding("Latin1") || client.EncodingName() != "CP437" {
+		test.Errorf("Negotiation overrode the account character set: %s", client.EncodingName())
+	}
+	if !client.negotiateEncoding("ibm437") {
+		test.Errorf("Character set of the account refused")
+	}
+}
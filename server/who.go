@@ -0,0 +1,201 @@
+package server
+
+/* This file contains the who list and the finger command, which show
+ * public information about the players. */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/beoran/woe/world"
+)
+
+// A link dead client is kept this long, so the player can reconnect.
+const LINKDEAD_TIMEOUT = 5 * time.Minute
+
+// Returns true if the client lost its connection while playing.
+func (me *Client) IsLinkDead() bool {
+	return !me.linkdead.IsZero()
+}
+
+// Returns how long the client didn't send any command.
+func (me *Client) IdleTime() time.Duration {
+	return time.Since(me.lastInput)
+}
+
+// Marks the client as link dead after its connection was lost. A client
+// that isn't playing yet is closed at once.
+func (me *Client) LinkDead() {
+	if me.IsLinkDead() {
+		return
+	}
+	if !me.IsLoginFinished() {
+		me.Close()
+		return
+	}
+	me.linkdead = time.Now()
+	me.alive = false
+	me.Save()
+	me.telnet.Close()
+	me.conn.Close()
+}
+
+// Takes over the account, the character and the settings of the player
+// from a link dead client that was removed from the server. The
+// connection of the link dead client is already closed.
+func (me *Client) TakeOver(linkdead *Client) {
+	me.account = linkdead.account
+	me.character = linkdead.character
+	me.channels = linkdead.channels
+	me.snooper = linkdead.snooper
+	me.SetTrace(linkdead.IsTraced())
+	linkdead.StopTail()
+	linkdead.account = nil
+	linkdead.character = nil
+	linkdead.snooper = nil
+}
+
+// Returns the link dead client of the account, or nil if there is none.
+func (me *Server) FindLinkDead(name string) *Client {
+	for _, client := range me.Clients() {
+		if client.IsLinkDead() && client.account != nil &&
+			strings.EqualFold(client.account.Name, name) {
+			return client
+		}
+	}
+	return nil
+}
+
+// Formats an idle time briefly, or returns "" if it is less than a minute.
+func FormatIdle(idle time.Duration) string {
+	switch {
+	case idle < time.Minute:
+		return ""
+	case idle < time.Hour:
+		return fmt.Sprintf("%dm", int(idle/time.Minute))
+	case idle < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(idle/time.Hour))
+	default:
+		return fmt.Sprintf("%dd", int(idle/(24*time.Hour)))
+	}
+}
+
+// Returns the names of the kin, job and gender of the character,
+// or "-" for those it doesn't have.
+func describeBeing(character *world.Character) (kin string, job string, gender string) {
+	kin, job, gender = "-", "-", "-"
+	if character.Kin != nil {
+		kin = character.Kin.Name
+	}
+	if character.Job != nil {
+		job = character.Job.Name
+	}
+	if character.Gender != nil {
+		gender = character.Gender.Name
+	}
+	return kin, job, gender
+}
+
+// Returns true if the character of the other client can be seen by the
+// client in the who list.
+func (me *Client) CanSee(other *Client) bool {
+	if other.character == nil || other.account == nil {
+		return false
+	}
+	return other.character.Privilege <= me.Privilege()
+}
+
+// Returns the clients with a character in the game, including link dead
+// ones, sorted by character name.
+func (me *Server) Players() []*Client {
+	var players []*Client
+	for _, client := range me.Clients() {
+		if client.IsLoginFinished() || (client.IsLinkDead() && client.character != nil) {
+			players = append(players, client)
+		}
+	}
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].character.Name < players[j].character.Name
+	})
+	return players
+}
+
+func doWho(data *ActionData) (err error) {
+	client := data.Client
+	count := 0
+	client.Printf("%-16s %-10s %-12s %5s %5s\n", "Name", "Kin", "Job", "Level", "Idle")
+	for _, other := range data.Server.Players() {
+		if !client.CanSee(other) {
+			continue
+		}
+		kin, job, _ := describeBeing(other.character)
+		status := FormatIdle(other.IdleTime())
+		if other.IsLinkDead() {
+			status = "linkdead"
+		}
+		client.Printf("%-16s %-10s %-12s %5d %5s\n", other.character.Name, kin, job,
+			other.character.Level, status)
+		count++
+	}
+	if count == 1 {
+		client.Printf("1 player is online.\n")
+	} else {
+		client.Printf("%d players are online.\n", count)
+	}
+	return nil
+}
+
+func doFinger(data *ActionData) (err error) {
+	client := data.Client
+	name := strings.TrimSpace(string(data.Rest))
+	if name == "" || strings.ContainsAny(name, " ./\\") {
+		return ErrUsage
+	}
+
+	var character *world.Character
+	var aname string
+	var other *Client
+	for _, player := range data.Server.Players() {
+		if strings.EqualFold(player.character.Name, name) && client.CanSee(player) {
+			other = player
+		}
+	}
+	if other != nil {
+		character = other.character
+		aname = other.AccountName()
+	} else {
+		character, aname, err = world.LoadCharacterByName(data.Server.Storage(), name)
+		if err != nil || character == nil || character.Privilege > client.Privilege() {
+			client.Printf("There is no character named %s.\n", name)
+			return nil
+		}
+	}
+
+	kin, job, gender := describeBeing(character)
+	client.Printf("Name:   %s\n", character.Name)
+	client.Printf("Kin:    %s\nJob:    %s\nGender: %s\nLevel:  %d\n", kin, job, gender, character.Level)
+	if account, err := data.Server.FindAccount(aname); err == nil && account != nil &&
+		account.Privilege >= world.PRIVILEGE_MASTER {
+		client.Printf("Staff:  %s\n", account.Privilege)
+	}
+	if character.Long != "" && character.Long != character.Name {
+		client.Printf("%s\n", character.Long)
+	}
+
+	if other == nil {
+		if seen, err := data.Server.Storage().Modified("character", character.ID); err == nil {
+			client.Printf("Offline, last seen %s.\n", seen.Format("2006-01-02 15:04"))
+		} else {
+			client.Printf("Offline.\n")
+		}
+	} else if other.IsLinkDead() {
+		client.Printf("Link dead.\n")
+	} else if idle := FormatIdle(other.IdleTime()); idle != "" {
+		client.Printf("Online, idle for %s.\n", idle)
+	} else {
+		client.Printf("Online.\n")
+	}
+	return nil
+}
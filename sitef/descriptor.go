@@ -0,0 +1,363 @@
+package sitef
+
+import "fmt"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+// Record descriptors, like in recfiles.
+//
+// A record that has a %rec key is a record descriptor. It describes the
+// records after it, up to the next record descriptor, and those records
+// are checked against it when the file is parsed. The descriptor itself
+// is not returned by the parser. The following directives are supported:
+//
+// %rec: Name of the records.
+// %type: A type declaration, of the form "field,field type". Repeat the
+// directive for more types.
+// A field name that ends in [] stands for all indexes of that field.
+// The types are int, real, bool, line, date, email, field,
+// size N, range MIN MAX, enum A B C and regexp /RE/.
+// %mandatory: Fields every record must have, separated by spaces.
+// %unique: Fields that may occur at most once in a record.
+// %type, %mandatory and %unique may be repeated.
+// %key: A field that is mandatory, unique, and that has a different
+// value in every record.
+// %doc: Documentation.
+//
+// The other recfile directives are accepted but not enforced.
+
+// The type of a field, declared with %type.
+type FieldType struct {
+    Kind    string
+    // Allowed values for enum.
+    Enum    []string
+    // Limits for range and size.
+    Min     int64
+    Max     int64
+    Regexp  * regexp.Regexp
+}
+
+var emailRe = regexp.MustCompile(`^[^@\s]+@[^@\s]+$`)
+var fieldRe = regexp.MustCompile(`^[a-zA-Z%][a-zA-Z0-9_]*$`)
+
+// Parses a type, such as "int" or "range 1 10".
+func ParseFieldType(spec string) (typ * FieldType, err error) {
+    args := strings.Fields(spec)
+    if len(args) < 1 {
+        return nil, fmt.Errorf("empty type")
+    }
+    typ = &FieldType{Kind: args[0]}
+    switch typ.Kind {
+    case "int", "real", "bool", "line", "date", "email", "field":
+        if len(args) > 1 {
+            return nil, fmt.Errorf("type %s has no arguments", typ.Kind)
+        }
+    case "enum":
+        if len(args) < 2 {
+            return nil, fmt.Errorf("enum needs values")
+        }
+        typ.Enum = args[1:]
+    case "size":
+        if len(args) != 2 {
+            return nil, fmt.Errorf("size needs one argument")
+        }
+        typ.Max, err = strconv.ParseInt(args[1], 10, 64)
+    case "range":
+        if len(args) == 2 {
+            typ.Max, err = strconv.ParseInt(args[1], 10, 64)
+        } else if len(args) == 3 {
+            if typ.Min, err = strconv.ParseInt(args[1], 10, 64) ; err == nil {
+                typ.Max, err = strconv.ParseInt(args[2], 10, 64)
+            }
+        } else {
+            return nil, fmt.Errorf("range needs one or two arguments")
+        }
+    case "regexp":
+        expr := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(spec), "regexp"))
+        if len(expr) > 1 && expr[0] == '/' && expr[len(expr) - 1] == '/' {
+            expr = expr[1:len(expr) - 1]
+        }
+        typ.Regexp, err = regexp.Compile(expr)
+    default:
+        return nil, fmt.Errorf("unknown type %s", typ.Kind)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("type %s: %v", typ.Kind, err)
+    }
+    return typ, nil
+}
+
+// Returns the type in the form ParseFieldType accepts.
+func (me * FieldType) String() string {
+    switch me.Kind {
+    case "enum":
+        return "enum " + strings.Join(me.Enum, " ")
+    case "size":
+        return fmt.Sprintf("size %d", me.Max)
+    case "range":
+        return fmt.Sprintf("range %d %d", me.Min, me.Max)
+    case "regexp":
+        return "regexp /" + me.Regexp.String() + "/"
+    }
+    return me.Kind
+}
+
+// Returns an error if the value doesn't have the type.
+func (me * FieldType) Check(value string) error {
+    ok := true
+    switch me.Kind {
+    case "int":
+        _, err := strconv.ParseInt(value, 10, 64)
+        ok = err == nil
+    case "real":
+        _, err := strconv.ParseFloat(value, 64)
+        ok = err == nil
+    case "bool":
+        switch value {
+        case "yes", "no", "true", "false", "1", "0":
+        default:
+            ok = false
+        }
+    case "line":
+        ok = !strings.ContainsRune(value, '\n')
+    case "date":
+        _, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            _, err = time.Parse("2006-01-02", value)
+        }
+        ok = err == nil
+    case "email":
+        ok = emailRe.MatchString(value)
+    case "field":
+        ok = fieldRe.MatchString(value)
+    case "enum":
+        ok = false
+        for _, allowed := range me.Enum {
+            ok = ok || value == allowed
+        }
+    case "size":
+        ok = int64(len(value)) <= me.Max
+    case "range":
+        number, err := strconv.ParseInt(value, 10, 64)
+        ok = err == nil && number >= me.Min && number <= me.Max
+    case "regexp":
+        ok = me.Regexp.MatchString(value)
+    }
+    if !ok {
+        return fmt.Errorf("%q is not of type %s", value, me.String())
+    }
+    return nil
+}
+
+// A record descriptor.
+type Descriptor struct {
+    Name        string
+    Doc         string
+    Types       map[string]* FieldType
+    Mandatory   []string
+    Unique      []string
+    Key         string
+}
+
+func NewDescriptor(name string) * Descriptor {
+    return &Descriptor{Name: name, Types: make(map[string]* FieldType)}
+}
+
+// Declares the type of fields. Each spec has the form of a %type line.
+func (me * Descriptor) SetType(spec string) error {
+    parts := strings.SplitN(strings.TrimSpace(spec), " ", 2)
+    if len(parts) < 2 {
+        return fmt.Errorf("%%type needs fields and a type: %q", spec)
+    }
+    typ, err := ParseFieldType(parts[1])
+    if err != nil {
+        return err
+    }
+    for _, field := range strings.Split(parts[0], ",") {
+        me.Types[field] = typ
+    }
+    return nil
+}
+
+// Declares the types of fields, and returns the descriptor. For
+// descriptors defined in code, so a bad type is a bug, which panics.
+func (me * Descriptor) WithTypes(specs ...string) * Descriptor {
+    for _, spec := range specs {
+        if err := me.SetType(spec) ; err != nil {
+            panic(err)
+        }
+    }
+    return me
+}
+
+// Declares the mandatory fields and returns the descriptor.
+func (me * Descriptor) WithMandatory(fields ...string) * Descriptor {
+    me.Mandatory = append(me.Mandatory, fields...)
+    return me
+}
+
+// Declares the unique fields and returns the descriptor.
+func (me * Descriptor) WithUnique(fields ...string) * Descriptor {
+    me.Unique = append(me.Unique, fields...)
+    return me
+}
+
+// Declares the key field and returns the descriptor.
+func (me * Descriptor) WithKey(field string) * Descriptor {
+    me.Key = field
+    return me
+}
+
+// Makes a descriptor from a record with a %rec key.
+func ParseDescriptor(record Record) (me * Descriptor, err error) {
+    me = NewDescriptor(strings.TrimSpace(record.Get("%rec")))
+    if me.Name == "" {
+        return nil, fmt.Errorf("%%rec needs a name")
+    }
+    me.Doc = record.Get("%doc")
+    for _, types := range record.GetAll("%type") {
+        // Continuation lines are accepted as more types too.
+        for _, spec := range strings.Split(types, "\n") {
+            if strings.TrimSpace(spec) == "" {
+                continue
+            }
+            if err = me.SetType(spec) ; err != nil {
+                return nil, err
+            }
+        }
+    }
+    for _, fields := range record.GetAll("%mandatory") {
+        me.Mandatory = append(me.Mandatory, strings.Fields(fields)...)
+    }
+    for _, fields := range record.GetAll("%unique") {
+        me.Unique = append(me.Unique, strings.Fields(fields)...)
+    }
+    keys := strings.Fields(record.Get("%key"))
+    if len(keys) > 1 {
+        return nil, fmt.Errorf("%%key must be a single field")
+    } else if len(keys) == 1 {
+        me.Key = keys[0]
+    }
+    return me, nil
+}
+
+// Returns the descriptor as a record that can be saved.
+func (me * Descriptor) Record() * Record {
+    record := NewRecord()
+    record.Put("%rec", me.Name)
+    if me.Doc != "" {
+        record.Put("%doc", me.Doc)
+    }
+    if len(me.Types) > 0 {
+        // Group the fields by type, to save them as "field,field type".
+        fields := make(map[string][]string)
+        for field, typ := range me.Types {
+            fields[typ.String()] = append(fields[typ.String()], field)
+        }
+        specs := make([]string, 0, len(fields))
+        for typ, names := range fields {
+            sort.Strings(names)
+            specs = append(specs, strings.Join(names, ",") + " " + typ)
+        }
+        sort.Strings(specs)
+        for _, spec := range specs {
+            record.Put("%type", spec)
+        }
+    }
+    if len(me.Mandatory) > 0 {
+        record.Put("%mandatory", strings.Join(me.Mandatory, " "))
+    }
+    if len(me.Unique) > 0 {
+        record.Put("%unique", strings.Join(me.Unique, " "))
+    }
+    if me.Key != "" {
+        record.Put("%key", me.Key)
+    }
+    return record
+}
+
+// Returns the type of the key, or nil if it has none. A type declared for
+// field[] applies to all keys field[index].
+func (me * Descriptor) TypeOf(key string) * FieldType {
+    if typ, ok := me.Types[key] ; ok {
+        return typ
+    }
+    if index := strings.IndexByte(key, '['); index > 0 && strings.HasSuffix(key, "]") {
+        return me.Types[key[:index] + "[]"]
+    }
+    return nil
+}
+
+// Checks the record against the descriptor. Keys maps the values of
+// the key field of the records checked before to their line numbers,
+// and is updated. Reports every problem with report.
+func (me * Descriptor) Check(record Record, keys map[string]int,
+    report func(lineno int, column int, format string, args ...interface{})) {
+    mandatory := me.Mandatory
+    unique := me.Unique
+    if me.Key != "" {
+        mandatory = append(mandatory[:len(mandatory):len(mandatory)], me.Key)
+        unique = append(unique[:len(unique):len(unique)], me.Key)
+    }
+
+    for _, field := range mandatory {
+        if _, ok := record.MayGet(field) ; !ok {
+            report(record.Lineno(), 0, "%s record lacks mandatory field %s", me.Name, field)
+        }
+    }
+    for _, field := range unique {
+        if record.Count(field) > 1 {
+            report(record.Line(field), 1, "%s record has field %s more than once", me.Name, field)
+        }
+    }
+    for _, key := range record.Keys() {
+        if typ := me.TypeOf(key) ; typ != nil {
+            if err := typ.Check(record.Get(key)) ; err != nil {
+                report(record.Line(key), len(key) + 2, "field %s: %v", key, err)
+            }
+        }
+    }
+    if value, ok := record.MayGet(me.Key) ; ok && me.Key != "" {
+        if lineno, seen := keys[value] ; seen {
+            report(record.Line(me.Key), len(me.Key) + 2,
+                "%s %s %s is already used on line %d", me.Name, me.Key, value, lineno)
+        } else {
+            keys[value] = record.Line(me.Key)
+        }
+    }
+}
+
+// Takes the record descriptors out of the records, and checks the other
+// records against them.
+func (me * Parser) applyDescriptors(records RecordList) (result RecordList) {
+    var descriptor * Descriptor
+    var keys map[string]int
+    report := func(lineno int, column int, format string, args ...interface{}) {
+        me.Errors = append(me.Errors, NewError(me.Filename, lineno, column, format, args...))
+    }
+
+    for _, record := range records {
+        if _, ok := record.MayGet("%rec") ; ok {
+            parsed, err := ParseDescriptor(*record)
+            if err != nil {
+                report(record.Lineno(), 0, "bad record descriptor: %v", err)
+            }
+            descriptor = parsed
+            keys = make(map[string]int)
+            continue
+        }
+        for _, key := range record.Keys() {
+            if strings.HasPrefix(key, "%") {
+                me.strictError(record.Line(key), 1, "%s outside of a record descriptor", key)
+            }
+        }
+        if descriptor != nil && len(record.Keys()) > 0 {
+            descriptor.Check(*record, keys, report)
+        }
+        result = append(result, record)
+    }
+    return result
+}
@@ -0,0 +1,115 @@
+package sitef
+
+import "bytes"
+import "strings"
+import "testing"
+
+const describedInput = `%rec: Ban
+%type: kind enum account address
+	time date
+	count,hits[] int
+%mandatory: kind
+%unique: count
+%key: target
+----
+kind:account
+target:bob
+time:2016-01-02
+hits[0]:3
+----
+kind:planet
+target:bob
+time:yesterday
+hits[1]:many
+----
+target:alice
+count:1
+count:2
+----
+`
+
+func TestDescriptor(test *testing.T) {
+	parser := NewParser("bans.sitef", false)
+	records, err := parser.Parse(strings.NewReader(describedInput))
+	if len(records) != 3 {
+		test.Fatalf("Expected 3 records without the descriptor, got %d", len(records))
+	}
+	list, ok := err.(ErrorList)
+	if !ok {
+		test.Fatalf("Expected an ErrorList, got %v", err)
+	}
+	expect := []string{
+		`bans.sitef:14:6: field kind: "planet" is not of type enum account address`,
+		`bans.sitef:16:6: field time: "yesterday" is not of type date`,
+		`bans.sitef:17:9: field hits[1]: "many" is not of type int`,
+		`bans.sitef:15:8: Ban target bob is already used on line 10`,
+		`bans.sitef:19: Ban record lacks mandatory field kind`,
+		`bans.sitef:20:1: Ban record has field count more than once`,
+	}
+	if len(list) != len(expect) {
+		test.Fatalf("Expected %d errors, got %d:\n%v", len(expect), len(list), list)
+	}
+	for index, message := range expect {
+		if list[index].Error() != message {
+			test.Errorf("Expected %q, got %q", message, list[index].Error())
+		}
+	}
+}
+
+func TestDescriptorRecord(test *testing.T) {
+	descriptor := NewDescriptor("Room").WithKey("id").WithMandatory("name").
+		WithTypes("exits[] line", "level,price range 0 100")
+	var buffer bytes.Buffer
+	if err := WriteRecord(&buffer, *descriptor.Record()); err != nil {
+		test.Fatalf("WriteRecord: %v", err)
+	}
+	written := buffer.String()
+	for _, line := range []string{"%type:exits[] line\n", "%type:level,price range 0 100\n"} {
+		if !strings.Contains(written, line) {
+			test.Errorf("Expected %q in:\n%s", line, written)
+		}
+	}
+	buffer.WriteString("id:town\nname:Town\nlevel:101\n----\n")
+	records, err := ParseReader(&buffer)
+	if len(records) != 1 || records[0].Get("id") != "town" {
+		test.Errorf("Wrong records %v", records)
+	}
+	if list, ok := err.(ErrorList); !ok || len(list) != 1 ||
+		!strings.Contains(list[0].Error(), "is not of type range 0 100") {
+		test.Errorf("Expected a range error, got %v", err)
+	}
+}
+
+const repeatedInput = `%rec: Room
+%type: id line
+%type: level int
+%mandatory: id
+%mandatory: name
+----
+id:town
+name:Town
+level:high
+----
+id:field
+----
+`
+
+func TestDescriptorRepeated(test *testing.T) {
+	records, err := NewParser("rooms.sitef", true).Parse(strings.NewReader(repeatedInput))
+	if len(records) != 2 {
+		test.Fatalf("Expected 2 records without the descriptor, got %d", len(records))
+	}
+	expect := []string{
+		`rooms.sitef:9:7: field level: "high" is not of type int`,
+		`rooms.sitef:11: Room record lacks mandatory field name`,
+	}
+	list, ok := err.(ErrorList)
+	if !ok || len(list) != len(expect) {
+		test.Fatalf("Expected %d errors, got %v", len(expect), err)
+	}
+	for index, message := range expect {
+		if list[index].Error() != message {
+			test.Errorf("Expected %q, got %q", message, list[index].Error())
+		}
+	}
+}
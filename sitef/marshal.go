@@ -1,13 +1,465 @@
 package sitef
 
+import "encoding"
+import "fmt"
+import "reflect"
+import "sort"
+import "strconv"
+import "strings"
+import "unicode"
+
 
 // Marshallling of structs from and to sitef format
+//
+// Fields are stored under their lower case name, or the name given in a
+// sitef:"name" tag. A sitef:"-" tag skips the field, and a
+// sitef:"name,omitempty" tag skips it if it has its zero value.
+// Unexported fields are skipped.
+//
+// Nested structs are stored as key.field, slices and arrays as key[n]
+// with the length under key itself, like PutArray and GetArrayIndex do,
+// and maps as key[name]. Embedded structs without a tag name are stored as if their
+// fields belonged to the outer struct. Pointers are followed, and nil
+// pointers are not stored. Types that implement encoding.TextMarshaler
+// and encoding.TextUnmarshaler are stored as their text.
+
+var textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Parsed sitef struct tag of a field.
+type fieldTag struct {
+    name        string
+    omitempty   bool
+    skip        bool
+}
+
+func parseFieldTag(field reflect.StructField) (tag fieldTag) {
+    text, ok  := field.Tag.Lookup("sitef")
+    if text == "-" {
+        tag.skip = true
+        return tag
+    }
+    parts     := strings.Split(text, ",")
+    if ok {
+        tag.name = parts[0]
+    }
+    for _, option := range parts[1:] {
+        if option == "omitempty" {
+            tag.omitempty = true
+        }
+    }
+    return tag
+}
+
+func joinKey(prefix string, name string) string {
+    if prefix == "" {
+        return name
+    }
+    return prefix + "." + name
+}
+
+// Returns true if the value is the zero value of its type.
+func isZero(value reflect.Value) bool {
+    switch value.Kind() {
+        case reflect.Slice, reflect.Map:
+            return value.Len() == 0
+        case reflect.Ptr, reflect.Interface:
+            return value.IsNil()
+    }
+    return reflect.DeepEqual(value.Interface(), reflect.Zero(value.Type()).Interface())
+}
+
+// Marshals a struct, or a pointer to a struct, into a new record.
+func Marshal(structure interface{}) (* Record, error) {
+    record := NewRecord()
+    err    := MarshalRecord(record, structure)
+    return record, err
+}
+
+// Marshals a struct, or a pointer to a struct, into an existing record.
+func MarshalRecord(record * Record, structure interface{}) error {
+    value := reflect.Indirect(reflect.ValueOf(structure))
+    if value.Kind() != reflect.Struct {
+        return fmt.Errorf("sitef: cannot marshal %s, not a struct", value.Type())
+    }
+    return record.marshalStruct("", value)
+}
+
+func (me * Record) marshalStruct(prefix string, value reflect.Value) error {
+    typ := value.Type()
+    for index := 0; index < typ.NumField(); index++ {
+        field := typ.Field(index)
+        tag   := parseFieldTag(field)
+        if tag.skip || field.PkgPath != "" && !field.Anonymous {
+            continue
+        }
+        fieldValue := value.Field(index)
+        if tag.omitempty && isZero(fieldValue) {
+            continue
+        }
+        if field.Anonymous && tag.name == "" {
+            embedded := reflect.Indirect(fieldValue)
+            if embedded.Kind() == reflect.Struct {
+                if err := me.marshalStruct(prefix, embedded); err != nil {
+                    return err
+                }
+            }
+            continue
+        }
+        if field.PkgPath != "" {
+            continue
+        }
+        name := tag.name
+        if name == "" {
+            name = strings.ToLower(field.Name)
+        }
+        if err := me.marshalValue(joinKey(prefix, name), fieldValue); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (me * Record) marshalValue(key string, value reflect.Value) error {
+    if marshaler, ok := textMarshalerOf(value); ok {
+        if value.Kind() == reflect.Ptr && value.IsNil() {
+            return nil
+        }
+        text, err := marshaler.MarshalText()
+        if err != nil {
+            return fmt.Errorf("sitef: key %s: %v", key, err)
+        }
+        me.Put(key, string(text))
+        return nil
+    }
+
+    switch value.Kind() {
+        case reflect.Ptr, reflect.Interface:
+            if value.IsNil() {
+                return nil
+            }
+            return me.marshalValue(key, value.Elem())
+        case reflect.Struct:
+            return me.marshalStruct(key, value)
+        case reflect.Slice, reflect.Array:
+            if value.Type().Elem().Kind() == reflect.Uint8 {
+                // Copy, because Bytes only works on addressable arrays.
+                bytes := make([]byte, value.Len())
+                reflect.Copy(reflect.ValueOf(bytes), value)
+                me.Put(key, string(bytes))
+                return nil
+            }
+            me.PutInt(key, value.Len())
+            for index := 0; index < value.Len(); index++ {
+                elemKey := fmt.Sprintf("%s[%d]", key, index)
+                if err := me.marshalValue(elemKey, value.Index(index)); err != nil {
+                    return err
+                }
+            }
+            return nil
+        case reflect.Map:
+            names := make([]string, 0, value.Len())
+            byName := make(map[string]reflect.Value)
+            for _, mapKey := range value.MapKeys() {
+                name, err := formatSimple(mapKey)
+                if err != nil {
+                    return fmt.Errorf("sitef: key %s: %v", key, err)
+                }
+                if name == "" || strings.ContainsAny(name, ":[]") || strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+                    return fmt.Errorf("sitef: key %s: map key %q can't be saved", key, name)
+                }
+                names = append(names, name)
+                byName[name] = value.MapIndex(mapKey)
+            }
+            sort.Strings(names)
+            for _, name := range names {
+                elemKey := fmt.Sprintf("%s[%s]", key, name)
+                if err := me.marshalValue(elemKey, byName[name]); err != nil {
+                    return err
+                }
+            }
+            return nil
+    }
+
+    text, err := formatSimple(value)
+    if err != nil {
+        return fmt.Errorf("sitef: key %s: %v", key, err)
+    }
+    me.Put(key, text)
+    return nil
+}
+
+// Returns the TextMarshaler of value, also when only a pointer to it has
+// MarshalText, so marshalling accepts the same types as unmarshalling.
+func textMarshalerOf(value reflect.Value) (encoding.TextMarshaler, bool) {
+    if value.Type().Implements(textMarshalerType) {
+        return value.Interface().(encoding.TextMarshaler), true
+    }
+    if !reflect.PtrTo(value.Type()).Implements(textMarshalerType) {
+        return nil, false
+    }
+    if value.CanAddr() {
+        return value.Addr().Interface().(encoding.TextMarshaler), true
+    }
+    // Map values and the like aren't addressable, so marshal a copy.
+    copied := reflect.New(value.Type())
+    copied.Elem().Set(value)
+    return copied.Interface().(encoding.TextMarshaler), true
+}
+
+// Formats a value of a simple type, or one that is a TextMarshaler.
+func formatSimple(value reflect.Value) (string, error) {
+    if marshaler, ok := textMarshalerOf(value); ok {
+        text, err := marshaler.MarshalText()
+        return string(text), err
+    }
+    switch value.Kind() {
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+            return strconv.FormatInt(value.Int(), 10), nil
+        case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+            return strconv.FormatUint(value.Uint(), 10), nil
+        case reflect.Float32, reflect.Float64:
+            return strconv.FormatFloat(value.Float(), 'g', -1, value.Type().Bits()), nil
+        case reflect.String:
+            return value.String(), nil
+        case reflect.Bool:
+            return strconv.FormatBool(value.Bool()), nil
+    }
+    return "", fmt.Errorf("unsupported type %s", value.Type())
+}
+
+// Parses text into a value of a simple type, or one that is a
+// TextUnmarshaler. The value must be settable.
+func parseSimple(text string, value reflect.Value) (err error) {
+    if value.CanAddr() && value.Addr().Type().Implements(textUnmarshalerType) {
+        return value.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+    }
+    switch value.Kind() {
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+            var parsed int64
+            parsed, err = strconv.ParseInt(strings.TrimSpace(text), 10, value.Type().Bits())
+            value.SetInt(parsed)
+        case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+            var parsed uint64
+            parsed, err = strconv.ParseUint(strings.TrimSpace(text), 10, value.Type().Bits())
+            value.SetUint(parsed)
+        case reflect.Float32, reflect.Float64:
+            var parsed float64
+            parsed, err = strconv.ParseFloat(strings.TrimSpace(text), value.Type().Bits())
+            value.SetFloat(parsed)
+        case reflect.String:
+            value.SetString(text)
+        case reflect.Bool:
+            var parsed bool
+            parsed, err = strconv.ParseBool(strings.TrimSpace(text))
+            value.SetBool(parsed)
+        default:
+            err = fmt.Errorf("unsupported type %s", value.Type())
+    }
+    return err
+}
+
+// Unmarshals a record into a pointer to a struct. Fields for which the
+// record has no keys keep their value, so defaults can be set beforehand.
+func Unmarshal(record Record, structure interface{}) error {
+    pointer := reflect.ValueOf(structure)
+    if pointer.Kind() != reflect.Ptr || pointer.IsNil() ||
+        pointer.Elem().Kind() != reflect.Struct {
+        return fmt.Errorf("sitef: cannot unmarshal into %T, not a pointer to a struct", structure)
+    }
+    return record.unmarshalStruct("", pointer.Elem())
+}
+
+// Returns true if the record has the key, or keys nested below it.
+func (me Record) hasKeyOrBelow(key string) bool {
+    if _, ok := me.dict[key]; ok {
+        return true
+    }
+    for _, have := range me.order {
+        if strings.HasPrefix(have, key + ".") || strings.HasPrefix(have, key + "[") {
+            return true
+        }
+    }
+    return false
+}
+
+// Returns the length of the slice or array stored under the key. It must
+// not be negative, nor larger than the amount of key[n] elements the
+// record has, so a damaged record can't make a huge slice.
+func (me Record) getLength(key string) (int, error) {
+    length, err := me.GetInt(key)
+    if err != nil {
+        return 0, err
+    }
+    if length < 0 {
+        return 0, fmt.Errorf("negative length %d", length)
+    }
+    if count := me.countIndexes(key) ; length > count {
+        return 0, fmt.Errorf("length %d, but only %d elements", length, count)
+    }
+    return length, nil
+}
+
+// Returns the amount of different indexes n of keys key[n] in the record.
+func (me Record) countIndexes(key string) int {
+    seen := make(map[string]bool)
+    for _, have := range me.order {
+        if !strings.HasPrefix(have, key + "[") {
+            continue
+        }
+        rest := have[len(key) + 1:]
+        end  := strings.IndexByte(rest, ']')
+        if end < 1 {
+            continue
+        }
+        if _, err := strconv.Atoi(rest[:end]) ; err == nil {
+            seen[rest[:end]] = true
+        }
+    }
+    return len(seen)
+}
+
+func (me Record) unmarshalStruct(prefix string, value reflect.Value) error {
+    typ := value.Type()
+    for index := 0; index < typ.NumField(); index++ {
+        field := typ.Field(index)
+        tag   := parseFieldTag(field)
+        if tag.skip {
+            continue
+        }
+        fieldValue := value.Field(index)
+        if field.Anonymous && tag.name == "" {
+            if fieldValue.Kind() == reflect.Ptr {
+                if fieldValue.Type().Elem().Kind() != reflect.Struct || !fieldValue.CanSet() {
+                    continue
+                }
+                if fieldValue.IsNil() {
+                    fieldValue.Set(reflect.New(fieldValue.Type().Elem()))
+                }
+                fieldValue = fieldValue.Elem()
+            }
+            if fieldValue.Kind() == reflect.Struct {
+                if err := me.unmarshalStruct(prefix, fieldValue); err != nil {
+                    return err
+                }
+            }
+            continue
+        }
+        if field.PkgPath != "" {
+            continue
+        }
+        name := tag.name
+        if name == "" {
+            name = strings.ToLower(field.Name)
+        }
+        if err := me.unmarshalValue(joinKey(prefix, name), fieldValue); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (me Record) unmarshalValue(key string, value reflect.Value) error {
+    if !me.hasKeyOrBelow(key) {
+        return nil
+    }
+
+    if value.CanAddr() && value.Addr().Type().Implements(textUnmarshalerType) {
+        if err := parseSimple(me.Get(key), value); err != nil {
+            return fmt.Errorf("sitef: key %s: %v", key, err)
+        }
+        return nil
+    }
+
+    switch value.Kind() {
+        case reflect.Ptr:
+            if value.IsNil() {
+                value.Set(reflect.New(value.Type().Elem()))
+            }
+            return me.unmarshalValue(key, value.Elem())
+        case reflect.Struct:
+            return me.unmarshalStruct(key, value)
+        case reflect.Slice:
+            if value.Type().Elem().Kind() == reflect.Uint8 {
+                value.SetBytes([]byte(me.Get(key)))
+                return nil
+            }
+            length, err := me.getLength(key)
+            if err != nil {
+                return fmt.Errorf("sitef: key %s: %v", key, err)
+            }
+            slice := reflect.MakeSlice(value.Type(), length, length)
+            for index := 0; index < length; index++ {
+                elemKey := fmt.Sprintf("%s[%d]", key, index)
+                if err := me.unmarshalValue(elemKey, slice.Index(index)); err != nil {
+                    return err
+                }
+            }
+            value.Set(slice)
+            return nil
+        case reflect.Array:
+            if value.Type().Elem().Kind() == reflect.Uint8 {
+                text := me.Get(key)
+                if len(text) > value.Len() {
+                    return fmt.Errorf("sitef: key %s: %d bytes do not fit in %s", key, len(text), value.Type())
+                }
+                reflect.Copy(value, reflect.ValueOf([]byte(text)))
+                return nil
+            }
+            length, err := me.getLength(key)
+            if err != nil {
+                return fmt.Errorf("sitef: key %s: %v", key, err)
+            }
+            if length > value.Len() {
+                return fmt.Errorf("sitef: key %s: %d elements do not fit in %s", key, length, value.Type())
+            }
+            for index := 0; index < length; index++ {
+                elemKey := fmt.Sprintf("%s[%d]", key, index)
+                if err := me.unmarshalValue(elemKey, value.Index(index)); err != nil {
+                    return err
+                }
+            }
+            return nil
+        case reflect.Map:
+            return me.unmarshalMap(key, value)
+    }
 
-/*
-func Marshal(value interface{}) (byte [], error)
+    if err := parseSimple(me.Get(key), value); err != nil {
+        return fmt.Errorf("sitef: key %s: %v", key, err)
+    }
+    return nil
+}
 
-st := reflect.TypeOf(s)
-field := st.Field(0)
-fmt.Println(field.Tag.Get("color"), field.Tag.Get("species"))
+func (me Record) unmarshalMap(key string, value reflect.Value) error {
+    typ := value.Type()
+    if value.IsNil() {
+        value.Set(reflect.MakeMap(typ))
+    }
+    seen := make(map[string]bool)
+    for _, have := range me.order {
+        if !strings.HasPrefix(have, key + "[") {
+            continue
+        }
+        end := strings.Index(have[len(key) + 1:], "]")
+        if end < 0 {
+            continue
+        }
+        name := have[len(key) + 1 : len(key) + 1 + end]
+        if seen[name] {
+            continue
+        }
+        seen[name] = true
 
-*/
+        mapKey := reflect.New(typ.Key()).Elem()
+        if err := parseSimple(name, mapKey); err != nil {
+            return fmt.Errorf("sitef: key %s: %v", key, err)
+        }
+        elem    := reflect.New(typ.Elem()).Elem()
+        elemKey := fmt.Sprintf("%s[%s]", key, name)
+        if err := me.unmarshalValue(elemKey, elem); err != nil {
+            return err
+        }
+        value.SetMapIndex(mapKey, elem)
+    }
+    return nil
+}
@@ -0,0 +1,184 @@
+package sitef
+
+import "bytes"
+import "fmt"
+import "strings"
+import "testing"
+import "time"
+
+type testVital struct {
+	Now int
+	Max int
+}
+
+type testBase struct {
+	ID   string `sitef:"id"`
+	Name string
+}
+
+type testBeing struct {
+	testBase
+	Level   int
+	HP      testVital
+	Tags    []string
+	Aliases map[string]string `sitef:"alias,omitempty"`
+	Born    time.Time
+	Parent  *testBase `sitef:",omitempty"`
+	Secret  string    `sitef:"-"`
+	hidden  int
+}
+
+func TestMarshal(test *testing.T) {
+	born := time.Date(2015, 5, 1, 12, 0, 0, 0, time.UTC)
+	being := testBeing{testBase{"being_1", "Bob"}, 3, testVital{10, 20},
+		[]string{"a", "b"}, map[string]string{"x": "look", "y": "north"},
+		born, &testBase{"being_0", "Alice"}, "secret", 7}
+
+	record, err := Marshal(&being)
+	if err != nil {
+		test.Fatalf("Marshal: %v", err)
+	}
+	expected := map[string]string{
+		"id": "being_1", "name": "Bob", "level": "3", "hp.now": "10",
+		"hp.max": "20", "tags": "2", "tags[0]": "a", "tags[1]": "b",
+		"alias[x]": "look", "alias[y]": "north",
+		"born": "2015-05-01T12:00:00Z", "parent.id": "being_0",
+	}
+	for key, value := range expected {
+		if got := record.Get(key); got != value {
+			test.Errorf("Marshal %s: %q, expected %q", key, got, value)
+		}
+	}
+	if _, ok := record.MayGet("secret"); ok {
+		test.Errorf("Marshal should skip sitef:\"-\" fields")
+	}
+
+	var buffer bytes.Buffer
+	WriteRecord(&buffer, *record)
+	records, err := ParseReader(strings.NewReader(buffer.String()))
+	if err != nil || len(records) < 1 {
+		test.Fatalf("ParseReader: %v", err)
+	}
+
+	var loaded testBeing
+	if err = Unmarshal(*records[0], &loaded); err != nil {
+		test.Fatalf("Unmarshal: %v", err)
+	}
+	being.Secret = ""
+	being.hidden = 0
+	if loaded.ID != being.ID || loaded.Name != being.Name || loaded.Level != being.Level ||
+		loaded.HP != being.HP || len(loaded.Tags) != 2 || loaded.Tags[1] != "b" ||
+		loaded.Aliases["y"] != "north" || !loaded.Born.Equal(born) ||
+		loaded.Parent == nil || loaded.Parent.Name != "Alice" {
+		test.Errorf("Unmarshal: %+v, expected %+v", loaded, being)
+	}
+}
+
+func TestUnmarshalDefaults(test *testing.T) {
+	record := NewRecord()
+	record.Put("level", "five")
+	loaded := testBeing{Name: "Default"}
+	if err := Unmarshal(*record, &loaded); err == nil {
+		test.Errorf("Unmarshal should fail on a malformed int")
+	}
+	if loaded.Name != "Default" {
+		test.Errorf("Unmarshal should keep fields without keys: %q", loaded.Name)
+	}
+}
+
+type testZone struct {
+	Rooms []string
+	Exits [3]int
+	Code  [4]byte
+}
+
+func TestUnmarshalLengths(test *testing.T) {
+	for _, length := range []string{"-1", "5"} {
+		record := NewRecord()
+		record.Put("rooms", length)
+		record.Put("rooms[0]", "square")
+		var zone testZone
+		if err := Unmarshal(*record, &zone); err == nil {
+			test.Errorf("Unmarshal should fail on length %s", length)
+		}
+	}
+
+	zone := testZone{[]string{"square"}, [3]int{1, 2, 3}, [4]byte{'a', 'b', 'c', 'd'}}
+	record, err := Marshal(zone)
+	if err != nil {
+		test.Fatalf("Marshal: %v", err)
+	}
+	var loaded testZone
+	if err = Unmarshal(*record, &loaded); err != nil {
+		test.Fatalf("Unmarshal: %v", err)
+	}
+	if loaded.Exits != zone.Exits || loaded.Code != zone.Code || len(loaded.Rooms) != 1 {
+		test.Errorf("Unmarshal: %+v, expected %+v", loaded, zone)
+	}
+
+	record.Put("exits", "4")
+	record.Put("exits[3]", "4")
+	if err = Unmarshal(*record, &loaded); err == nil {
+		test.Errorf("Unmarshal should fail if an array is too short")
+	}
+}
+
+func TestMarshalBadMapKeys(test *testing.T) {
+	for _, name := range []string{"a:b", "x]y", "x[y", "two words", ""} {
+		being := testBeing{Aliases: map[string]string{name: "say x"}}
+		if _, err := Marshal(&being); err == nil {
+			test.Errorf("Marshal should fail on map key %q", name)
+		}
+	}
+}
+
+// A text marshaler with pointer receivers on both sides.
+type testColour struct {
+	Red, Green, Blue uint8
+}
+
+func (me *testColour) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("#%02x%02x%02x", me.Red, me.Green, me.Blue)), nil
+}
+
+func (me *testColour) UnmarshalText(text []byte) error {
+	_, err := fmt.Sscanf(string(text), "#%02x%02x%02x", &me.Red, &me.Green, &me.Blue)
+	return err
+}
+
+type testPalette struct {
+	Main   testColour
+	Others []testColour
+	Named  map[string]testColour
+}
+
+func TestMarshalPointerTextMarshaler(test *testing.T) {
+	palette := testPalette{testColour{255, 0, 16}, []testColour{{1, 2, 3}},
+		map[string]testColour{"sky": {0, 0, 255}}}
+
+	// Marshal by value, so the top level struct isn't addressable either.
+	record, err := Marshal(palette)
+	if err != nil {
+		test.Fatalf("Marshal: %v", err)
+	}
+	expected := map[string]string{
+		"main": "#ff0010", "others[0]": "#010203", "named[sky]": "#0000ff",
+	}
+	for key, value := range expected {
+		if got := record.Get(key); got != value {
+			test.Errorf("Marshal %s: %q, expected %q", key, got, value)
+		}
+	}
+	if _, ok := record.MayGet("main.red"); ok {
+		test.Errorf("Marshal should use MarshalText, not the struct fields")
+	}
+
+	var loaded testPalette
+	if err = Unmarshal(*record, &loaded); err != nil {
+		test.Fatalf("Unmarshal: %v", err)
+	}
+	if loaded.Main != palette.Main || len(loaded.Others) != 1 ||
+		loaded.Others[0] != palette.Others[0] || loaded.Named["sky"] != palette.Named["sky"] {
+		test.Errorf("Unmarshal: %+v, expected %+v", loaded, palette)
+	}
+}
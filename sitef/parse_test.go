@@ -0,0 +1,74 @@
+package sitef
+
+import "strings"
+import "testing"
+
+func TestParseLenient(test *testing.T) {
+	input := "name:Alice\nlong:A\n\tlong\n+text\n----\nname:Bob\n----\n"
+	records, err := ParseReader(strings.NewReader(input))
+	if err != nil {
+		test.Fatalf("ParseReader: %v", err)
+	}
+	if len(records) != 2 {
+		test.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	if long := records[0].Get("long"); long != "A\nlongtext" {
+		test.Errorf("Wrong continued value %q", long)
+	}
+	if name := records[1].Get("name"); name != "Bob" {
+		test.Errorf("Wrong name %q", name)
+	}
+}
+
+func TestParseStrict(test *testing.T) {
+	input := strings.Join([]string{
+		"name:Alice",
+		"name:Alice again", // duplicate
+		"no colon here",    // no :
+		"bad\tkey:x",       // tab in key
+		"exits[north:x",    // unbalanced
+		"%rec:Account",     // known directive
+		"%bogus:x",         // unknown directive
+		"MINIMUM AGE:18",   // spaces are allowed
+		"trailing :x",      // but not at the end
+		"----",
+		"\tcontinued", // no key
+		"long:" + strings.Repeat("x", MAX_LINE_LENGTH),
+	}, "\n")
+	parser := NewParser("test.sitef", true)
+	_, err := parser.Parse(strings.NewReader(input))
+	list, ok := err.(ErrorList)
+	if !ok {
+		test.Fatalf("Expected an ErrorList, got %v", err)
+	}
+	expect := []string{
+		"test.sitef:2:1: duplicate key name",
+		"test.sitef:3:14: expected : after key",
+		"test.sitef:4:4: invalid character '\\t' in key",
+		"test.sitef:5:6: [ without ] in key",
+		"test.sitef:7:1: unknown directive %bogus",
+		"test.sitef:9:9: key ends with a space",
+		"test.sitef:11:1: continued value without a key",
+		"test.sitef:12:4097: line is longer than 4096 characters",
+	}
+	if len(list) != len(expect) {
+		test.Fatalf("Expected %d errors, got %d:\n%v", len(expect), len(list), list)
+	}
+	for index, message := range expect {
+		if list[index].Error() != message {
+			test.Errorf("Expected %q, got %q", message, list[index].Error())
+		}
+	}
+	if _, err := ParseReader(strings.NewReader(input)); err != nil {
+		test.Errorf("Lenient parse failed: %v", err)
+	}
+}
+
+func TestParseTooLong(test *testing.T) {
+	input := "name:Alice\nlong:" + strings.Repeat("x", MAX_LINE_BUFFER) + "\n"
+	_, err := ParseReader(strings.NewReader(input))
+	list, ok := err.(ErrorList)
+	if !ok || len(list) != 1 || list[0].Lineno() != 2 {
+		test.Errorf("Expected an error on line 2, got %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package sitef
+
+import "os"
+import "io"
+import "fmt"
+import "bufio"
+import "path/filepath"
+import "github.com/beoran/woe/monolog"
+
+// Saving sitef files is crash safe. The records are written to a temporary
+// file in the same directory, which is flushed to disk and then renamed
+// over the target. So, the target either has its old or its new contents,
+// even if the server crashes or the disk fills up while saving.
+//
+// Before the target is replaced, its previous contents are kept as
+// a backup in filename.bak.1, the one before that in filename.bak.2,
+// and so on, up to Backups files.
+
+// Number of backups kept of every saved file. 0 disables backups.
+var Backups = 3
+
+// Returns the name of the n-th backup of the file, with 1 the newest.
+func BackupName(filename string, n int) string {
+    return fmt.Sprintf("%s.bak.%d", filename, n)
+}
+
+// Copies the file at from to a new file at to.
+func copyFile(from string, to string) (err error) {
+    in, err := os.Open(from)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    out, err := os.OpenFile(to, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+    if err != nil {
+        return err
+    }
+    if _, err = io.Copy(out, in); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}
+
+// Shifts the backups of the file by one and keeps the current contents
+// of the file as the newest backup. The file itself is left in place.
+func rotateBackups(filename string, backups int) (err error) {
+    if backups < 1 {
+        return nil
+    }
+    if _, err = os.Stat(filename); os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    err = os.Remove(BackupName(filename, backups))
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    for n := backups - 1 ; n > 0 ; n-- {
+        err = os.Rename(BackupName(filename, n), BackupName(filename, n + 1))
+        if err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    // A hard link is cheap, but not all file systems have them.
+    if err = os.Link(filename, BackupName(filename, 1)) ; err != nil {
+        err = copyFile(filename, BackupName(filename, 1))
+    }
+    return err
+}
+
+// Flushes the directory to disk, so a rename in it is durable.
+// Not all platforms support this, so failure is only logged.
+func syncDir(dirname string) {
+    dir, err := os.Open(dirname)
+    if err != nil {
+        return
+    }
+    defer dir.Close()
+    if err = dir.Sync() ; err != nil {
+        monolog.Debug("Could not sync directory %s: %v", dirname, err)
+    }
+}
+
+// Saves a file atomically, with write writing the contents. The target is
+// only replaced if write and flushing the file to disk both succeed.
+func SaveAtomic(filename string, write func (io.Writer) error) (err error) {
+    dirname, basename := filepath.Split(filename)
+    if dirname == "" {
+        dirname = "."
+    }
+
+    file, err := os.CreateTemp(dirname, "." + basename + ".tmp*")
+    if err != nil {
+        return err
+    }
+    tmpname := file.Name()
+    defer func () {
+        if err != nil {
+            file.Close()
+            os.Remove(tmpname)
+        }
+    }()
+
+    // CreateTemp makes the file private, so give it the mode of the file
+    // it replaces, or the usual mode of a new data file.
+    mode := os.FileMode(0644)
+    if info, staterr := os.Stat(filename) ; staterr == nil {
+        mode = info.Mode().Perm()
+    }
+    if err = file.Chmod(mode) ; err != nil {
+        return err
+    }
+
+    buffer := bufio.NewWriter(file)
+    if err = write(buffer) ; err != nil {
+        return err
+    }
+    if err = buffer.Flush() ; err != nil {
+        return err
+    }
+    if err = file.Sync() ; err != nil {
+        return err
+    }
+    if err = file.Close() ; err != nil {
+        return err
+    }
+    if err = rotateBackups(filename, Backups) ; err != nil {
+        monolog.Warning("Could not make backup of %s: %v", filename, err)
+    }
+    if err = os.Rename(tmpname, filename) ; err != nil {
+        return err
+    }
+    syncDir(dirname)
+    return nil
+}
+
+func SaveRecord(filename string, record Record) (err error) {
+    err = SaveAtomic(filename, func (writer io.Writer) error {
+        return WriteRecord(writer, record)
+    })
+    if err != nil {
+        monolog.Error("Could not save %s: %v", filename, err)
+    }
+    return err
+}
+
+func SaveRecordList(filename string, records RecordList) (err error) {
+    err = SaveAtomic(filename, func (writer io.Writer) error {
+        return WriteRecordList(writer, records)
+    })
+    if err != nil {
+        monolog.Error("Could not save %s: %v", filename, err)
+    }
+    return err
+}
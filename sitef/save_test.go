@@ -0,0 +1,111 @@
+package sitef
+
+import "errors"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func TestSaveRecordBackups(test *testing.T) {
+	dir := test.TempDir()
+	path := filepath.Join(dir, "account.sitef")
+	old := Backups
+	Backups = 2
+	defer func() { Backups = old }()
+
+	for _, name := range []string{"one", "two", "three", "four"} {
+		record := NewRecord()
+		record.Put("name", name)
+		if err := SaveRecord(path, *record); err != nil {
+			test.Fatalf("SaveRecord: %v", err)
+		}
+	}
+
+	expect := map[string]string{
+		path:                "four",
+		BackupName(path, 1): "three",
+		BackupName(path, 2): "two",
+	}
+	for filename, name := range expect {
+		records, err := ParseFilename(filename)
+		if err != nil || len(records) != 1 || records[0].Get("name") != name {
+			test.Errorf("%s: expected %s, got %v %v", filename, name, records, err)
+		}
+	}
+	if _, err := os.Stat(BackupName(path, 3)); !os.IsNotExist(err) {
+		test.Errorf("Too many backups kept: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 3 {
+		test.Errorf("Temporary files left behind: %d files", len(files))
+	}
+}
+
+type failWriter struct {
+	left int
+}
+
+func (me *failWriter) Write(data []byte) (int, error) {
+	if len(data) > me.left {
+		return me.left, errors.New("disk full")
+	}
+	me.left -= len(data)
+	return len(data), nil
+}
+
+func TestWriteRecordError(test *testing.T) {
+	record := NewRecord()
+	record.Put("name", "Alice")
+	record.Put("email", "alice@example.com")
+	if err := WriteRecord(&failWriter{12}, *record); err == nil {
+		test.Errorf("Write error was not returned")
+	}
+	if err := WriteRecord(&failWriter{100}, *record); err != nil {
+		test.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSaveAtomicKeepsOld(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "room.sitef")
+	record := NewRecord()
+	record.Put("name", "Old")
+	if err := SaveRecord(path, *record); err != nil {
+		test.Fatalf("SaveRecord: %v", err)
+	}
+	err := SaveAtomic(path, func(writer io.Writer) error {
+		return errors.New("crash")
+	})
+	if err == nil {
+		test.Errorf("Error was not returned")
+	}
+	records, err := ParseFilename(path)
+	if err != nil || len(records) != 1 || records[0].Get("name") != "Old" {
+		test.Errorf("Old contents lost: %v %v", records, err)
+	}
+}
+
+func TestSaveAtomicMode(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "room.sitef")
+	record := NewRecord()
+	record.Put("name", "Square")
+	if err := SaveRecord(path, *record); err != nil {
+		test.Fatalf("SaveRecord: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		test.Fatalf("Stat: %v", err)
+	} else if info.Mode().Perm() != 0644 {
+		test.Errorf("New file should have mode 0644: %v", info.Mode())
+	}
+
+	if err := os.Chmod(path, 0640); err != nil {
+		test.Fatalf("Chmod: %v", err)
+	}
+	if err := SaveRecord(path, *record); err != nil {
+		test.Fatalf("SaveRecord: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		test.Fatalf("Stat: %v", err)
+	} else if info.Mode().Perm() != 0640 {
+		test.Errorf("Saving should keep the mode 0640: %v", info.Mode())
+	}
+}
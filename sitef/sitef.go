@@ -33,7 +33,10 @@ import "github.com/beoran/woe/monolog"
 // + supresses the newline.
 // Anything else signifies the beginning of the next key.
 // % is allowed for special keys for recfile compatibility.  
-// However % directives are not implemented.
+// A record that starts with %rec is a record descriptor, which
+// describes the records after it, see descriptor.go.
+// The parser is lenient by default, a strict Parser reports every
+// problem in the file with its line and column.
 // Keys may not be nested, however, you could use spaces or dots, 
 // or array indexes to emulate nexted keys. 
 // A # at the start optionally after whitespace is a comment
@@ -42,20 +45,59 @@ import "github.com/beoran/woe/monolog"
 type Record struct { 
         dict map[string]string
         order []string
+        // The value of every key in order, so a repeated key keeps all of them.
+        values []string
+        // Line numbers of the record and its keys, if it was parsed.
+        lineno int
+        lines map[string]int
 }
 
 func NewRecord() (* Record) {
     rec := &Record{}
     rec.dict  = make(map[string]string)
     rec.order = make([]string, 0)
+    rec.values = make([]string, 0)
     return rec
 }
 
 func (me * Record) Put(key string, val string) {
     me.order = append(me.order, key)
+    me.values = append(me.values, val)
     me.dict[key] = val
 }
 
+// Puts a key and value parsed at the given line.
+func (me * Record) putAt(key string, val string, lineno int) {
+    if me.lines == nil {
+        me.lines = make(map[string]int)
+        me.lineno = lineno
+    }
+    if _, have := me.lines[key] ; !have {
+        me.lines[key] = lineno
+    }
+    me.Put(key, val)
+}
+
+// Returns the line the record starts at, or 0 if it wasn't parsed.
+func (me Record) Lineno() int {
+    return me.lineno
+}
+
+// Returns the line the key was first found at, or 0 if it wasn't parsed.
+func (me Record) Line(key string) int {
+    return me.lines[key]
+}
+
+// Returns how many times the key occurs in the record.
+func (me Record) Count(key string) (count int) {
+    for _, other := range me.order {
+        if other == key {
+            count++
+        }
+    }
+    return count
+}
+
 func (me * Record) Putf(key string, format string, values ...interface{}) {
     me.Put(key, fmt.Sprintf(format, values...))
     monolog.Debug("After putf: %s %v", key, me.order)
@@ -82,7 +124,7 @@ func (me * Record) PutInt64(key string, val int64) {
 }
 
 func (me * Record) PutFloat64(key string, val float64) {
-    me.Putf(key, "%lf", val)
+    me.Put(key, strconv.FormatFloat(val, 'g', -1, 64))
 }
 
 func (me Record) MayGet(key string) (result string, ok bool) {
@@ -96,6 +138,28 @@ func (me Record) Get(key string) (result string) {
     return result
 }
 
+// Returns every value of the key in order. Get only returns the last one.
+func (me Record) GetAll(key string) (result []string) {
+    for index, other := range me.order {
+        if other == key {
+            result = append(result, me.values[index])
+        }
+    }
+    return result
+}
+
+// Returns the keys of the record, in the order they were first put.
+func (me Record) Keys() (keys []string) {
+    seen := make(map[string]bool)
+    for _, key := range me.order {
+        if !seen[key] {
+            seen[key] = true
+            keys = append(keys, key)
+        }
+    }
+    return keys
+}
+
 func (me * Record) GetArrayIndex(key string, i int) (result string) {
     realkey := fmt.Sprintf("%s[%d]", key, i)
     return me.Get(realkey)
@@ -243,19 +307,52 @@ func (me Record) GetStruct(prefix string, structure interface {}) {
 }
 
 
+// A parse error, with the position where it was found. Lines and columns
+// start at 1. The column is 0 if the error concerns the whole line.
 type Error struct {
-    error   string
-    lineno  int
+    error       string
+    filename    string
+    lineno      int
+    column      int
+}
+
+func NewError(filename string, lineno int, column int, format string, args ...interface{}) *Error {
+    return &Error{fmt.Sprintf(format, args...), filename, lineno, column}
 }
 
 func (me Error) Error() string {
-    return fmt.Sprintf("%d: %s", me.Lineno, me.error)
+    position := fmt.Sprintf("%d", me.lineno)
+    if me.column > 0 {
+        position = fmt.Sprintf("%d:%d", me.lineno, me.column)
+    }
+    if me.filename != "" {
+        position = me.filename + ":" + position
+    }
+    return position + ": " + me.error
 }
 
 func (me Error) Lineno() int {
     return me.lineno
 }
 
+func (me Error) Column() int {
+    return me.column
+}
+
+func (me Error) Filename() string {
+    return me.filename
+}
+
+// All errors found while parsing a file.
+type ErrorList []*Error
+
+func (me ErrorList) Error() string {
+    messages := make([]string, 0, len(me))
+    for _, err := range me {
+        messages = append(messages, err.Error())
+    }
+    return strings.Join(messages, "\n")
+}
 
 type ParserState int
 
@@ -267,142 +364,244 @@ const (
 
 type RecordList []*Record
 
+// Lines longer than this can't be parsed at all.
+const MAX_LINE_BUFFER = 1024 * 1024
 
-func ParseReader(read io.Reader) (RecordList, error) {
+// Lines longer than this are reported in strict mode.
+const MAX_LINE_LENGTH = 4096
+
+// The % directives of recfiles.
+var Directives = map[string]bool {
+    "%rec": true, "%type": true, "%typedef": true, "%mandatory": true,
+    "%key": true, "%unique": true, "%doc": true, "%allowed": true,
+    "%prohibit": true, "%sort": true, "%size": true, "%constraint": true,
+    "%confidential": true, "%auto": true, "%singular": true,
+}
+
+// A sitef parser. In strict mode, the parser reports every problem it
+// finds in the file, where it is lenient otherwise: malformed keys,
+// lines without a key, keys that occur twice in one record,
+// unknown % directives and lines that are longer than MaxLine.
+type Parser struct {
+    Filename    string
+    Strict      bool
+    MaxLine     int
+    Errors      ErrorList
+}
+
+func NewParser(filename string, strict bool) * Parser {
+    return &Parser{filename, strict, MAX_LINE_LENGTH, nil}
+}
+
+// Records an error in strict mode.
+func (me * Parser) strictError(lineno int, column int, format string, args ...interface{}) {
+    if me.Strict {
+        me.Errors = append(me.Errors, NewError(me.Filename, lineno, column, format, args...))
+    }
+}
+
+// Checks a key. Keys may not contain control characters or end with a
+// space, and
+// index brackets must be balanced, not nested, and not empty.
+// Returns the column of the problem and a message, or 0 if the key is ok.
+func CheckKey(key string) (column int, message string) {
+    if key == "" {
+        return 1, "empty key"
+    }
+    if key[0] == '%' {
+        if !Directives[key] {
+            return 1, fmt.Sprintf("unknown directive %s", key)
+        }
+        return 0, ""
+    }
+    open := -1
+    for index, char := range key {
+        switch {
+        case char < ' ' || char == 0x7f:
+            return index + 1, fmt.Sprintf("invalid character %q in key", char)
+        case char == '[' && open >= 0:
+            return index + 1, "nested [ in key"
+        case char == '[' && index == 0:
+            return index + 1, "key starts with ["
+        case char == '[':
+            open = index
+        case char == ']' && open < 0:
+            return index + 1, "] without [ in key"
+        case char == ']' && open == index - 1:
+            return index + 1, "empty index in key"
+        case char == ']':
+            open = -1
+        }
+    }
+    if open >= 0 {
+        return open + 1, "[ without ] in key"
+    }
+    if strings.HasSuffix(key, " ") {
+        return len(key), "key ends with a space"
+    }
+    return 0, ""
+}
+
+// Record descriptor directives that may occur more than once, like in
+// recfiles.
+var repeatableDirectives = map[string]bool {
+    "%type": true, "%typedef": true, "%mandatory": true, "%unique": true,
+    "%allowed": true, "%prohibit": true, "%constraint": true,
+    "%confidential": true, "%auto": true,
+}
+
+// Parses the records from the reader. Problems found in strict mode
+// are returned as an ErrorList, together with the records that could
+// be parsed. A line that is too long to read at all is always an error,
+// and so are records that don't match their record descriptor.
+// The record descriptors themselves are not returned.
+func (me * Parser) Parse(read io.Reader) (RecordList, error) {
     var records     RecordList
     record      := NewRecord()
-    var err         Error
     lineno      := 0
     scanner     := bufio.NewScanner(read)
     var key     bytes.Buffer
     var value   bytes.Buffer
-    
-    
+    keyline     := 0
+    me.Errors    = nil
+
+    scanner.Buffer(make([]byte, 4096), MAX_LINE_BUFFER)
+
+    // Puts the key and value in the record, if there is a key.
+    putKey := func() {
+        if len(key.String()) > 0 {
+            record.putAt(key.String(), value.String(), keyline)
+        }
+        key.Reset()
+        value.Reset()
+    }
+
     for scanner.Scan() {
         lineno++
         line := scanner.Text()
+        if me.MaxLine > 0 && len(line) > me.MaxLine {
+            me.strictError(lineno, me.MaxLine + 1,
+                "line is longer than %d characters", me.MaxLine)
+        }
         // End of record?
         if (len(line) < 1) || line[0] == '-' {
-            // Append last record if needed. 
-            if len(key.String()) > 0 {
-                record.Put(key.String(), value.String())
-            }
+            putKey()
             // save the record and make a new one
             records = append(records, record)
             record  = NewRecord()
         // comment?
         } else if line[0] == '#' {
-            continue; 
+            continue;
         // continue value?
         } else if line[0] == '\t' || line[0] == ' '|| line[0] == '+' {
-            
+            if len(key.String()) < 1 {
+                me.strictError(lineno, 1, "continued value without a key")
+            }
+
             /* Add a newline unless + is used */
             if (line[0] != '+') {
-                value.WriteRune('\n')          
+                value.WriteRune('\n')
             }
-            
+
             // continue the value, skipping the first character
-            value.WriteString(line[1:])            
+            value.WriteString(line[1:])
         // new key
         } else if strings.ContainsRune(line, ':') {
             // save the previous key/value pair if needed
-            if len(key.String()) > 0 {
-                record.Put(key.String(), value.String())
-            }
-            
-            key.Reset()
-            value.Reset()
+            putKey()
 
             parts := strings.SplitN(line, ":", 2)
-                            
+            if column, message := CheckKey(parts[0]) ; column > 0 {
+                me.strictError(lineno, column, "%s", message)
+            } else if _, have := record.MayGet(parts[0]) ; have && !repeatableDirectives[parts[0]] {
+                me.strictError(lineno, 1, "duplicate key %s", parts[0])
+            }
+
             key.WriteString(parts[0])
+            keyline = lineno
             if len(parts) > 1 {
-               value.WriteString(parts[1])   
-            }            
+               value.WriteString(parts[1])
+            }
         // Not a key. Be lenient and assume this is a continued value.
         } else {
-            value.WriteString(line)   
+            me.strictError(lineno, len(line) + 1, "expected : after key")
+            value.WriteString(line)
         }
     }
-    
-    // Append last record if needed. 
-    if len(key.String()) > 0 {
-        record.Put(key.String(), value.String())
-    }
-    
+
+    // Append last record if needed.
+    putKey()
+
     if (len(record.order) > 0) {
         records = append(records, record)
     }
 
-    
-
     if serr := scanner.Err(); serr != nil {
-       err.lineno = lineno
-       err.error  = serr.Error()
-       monolog.Error("Sitef parse error: %d %s", lineno, serr.Error) 
-       return records, err
+        err := NewError(me.Filename, lineno + 1, 0, "%s", serr.Error())
+        monolog.Error("Sitef parse error: %s", err.Error())
+        return records, append(me.Errors, err)
+    }
+
+    records = me.applyDescriptors(records)
+    if len(me.Errors) > 0 {
+        return records, me.Errors
     }
-    
     return records, nil
-    
 }
 
-func ParseFilename(filename string) (RecordList, error) {
+func (me * Parser) ParseFilename(filename string) (RecordList, error) {
     file, err := os.Open(filename)
     if err != nil {
         return nil, err
     }
     defer file.Close()
-    return ParseReader(file)
+    me.Filename = filename
+    return me.Parse(file)
 }
 
-func WriteField(writer io.Writer, key string, value string) {
-    monolog.Debug("WriteField %s:%s", key, value)
-    replacer := strings.NewReplacer("\n", "\n\t")    
-    writer.Write([]byte(key))
-    writer.Write([]byte{':'})    
-    writer.Write([]byte(replacer.Replace(value)))
-    writer.Write([]byte{'\n'})
+// Parses the records leniently.
+func ParseReader(read io.Reader) (RecordList, error) {
+    return NewParser("", false).Parse(read)
 }
 
-func WriteRecord(writer io.Writer, record Record) {
-    monolog.Debug("WriteRecord %v", record)
-
-    for index := 0 ; index < len(record.order) ; index++ {
-        key := record.order[index];
-        value := record.dict[key];
-        WriteField(writer, key, value);
-    }
-    writer.Write([]byte{'-', '-', '-', '-', '\n'})
+func ParseFilename(filename string) (RecordList, error) {
+    return NewParser(filename, false).ParseFilename(filename)
 }
 
-func WriteRecordList(writer io.Writer, records RecordList) {
-    for _, record := range records {
-        WriteRecord(writer, *record);
-    }
+// Parses the records strictly, reporting all problems as an ErrorList.
+func ParseFilenameStrict(filename string) (RecordList, error) {
+    return NewParser(filename, true).ParseFilename(filename)
 }
 
 
-func SaveRecord(filename string, record Record) (error) {
-    file, err := os.Create(filename)
-    if err != nil {
-        monolog.WriteError(err)
-        return err
-    }
-    defer file.Close()
-    WriteRecord(file, record)
-    return nil
+// Writes a single field. Returns the first error of the writer, if any.
+func WriteField(writer io.Writer, key string, value string) (err error) {
+    monolog.Debug("WriteField %s:%s", key, value)
+    replacer := strings.NewReplacer("\n", "\n\t")
+    _, err = io.WriteString(writer, key + ":" + replacer.Replace(value) + "\n")
+    return err
 }
 
+func WriteRecord(writer io.Writer, record Record) (err error) {
+    monolog.Debug("WriteRecord %v", record)
 
+    for index := 0 ; index < len(record.order) ; index++ {
+        key := record.order[index];
+        value := record.values[index];
+        if err = WriteField(writer, key, value) ; err != nil {
+            return err
+        }
+    }
+    _, err = writer.Write([]byte{'-', '-', '-', '-', '\n'})
+    return err
+}
 
-func SaveRecordList(filename string, records RecordList) (error) {
-    file, err := os.Create(filename)
-    if err != nil {
-        return err
+func WriteRecordList(writer io.Writer, records RecordList) (err error) {
+    for _, record := range records {
+        if err = WriteRecord(writer, *record) ; err != nil {
+            return err
+        }
     }
-    defer file.Close()
-    WriteRecordList(file, records)
     return nil
 }
 
@@ -0,0 +1,185 @@
+package telnet
+
+import "bytes"
+import "strings"
+import "unicode/utf8"
+import "github.com/beoran/woe/monolog"
+
+// This file implements CHARSET negotiation (RFC 2066) and the transcoding
+// of text between UTF-8 and the character sets that are supported.
+
+// A CHARSET subnegotiation received from the client. For
+// TELNET_CHARSET_REQUEST Charsets are the character sets the client
+// offers, for TELNET_CHARSET_ACCEPTED it is the one the client accepted.
+type CharsetEvent struct {
+	Command  byte
+	Charsets []string
+}
+
+func (me CharsetEvent) Type() EventType { return TELNET_CHARSET_EVENT }
+
+// Parse CHARSET subnegotiation buffers
+func (me *Telnet) SubnegotiateCharset(buffer []byte) {
+	if len(buffer) < 1 {
+		monolog.Warning("telopt CHARSET subneg empty")
+		return
+	}
+	command := buffer[0]
+	rest := buffer[1:]
+	var charsets []string
+
+	switch command {
+	case TELNET_CHARSET_REQUEST:
+		// Skip the optional translation table version.
+		if bytes.HasPrefix(rest, []byte("[TTABLE]")) && len(rest) > 8 {
+			rest = rest[9:]
+		}
+		if len(rest) < 2 {
+			monolog.Warning("telopt CHARSET request without character sets")
+			return
+		}
+		// The first byte is the separator.
+		for _, name := range strings.Split(string(rest[1:]), string(rest[0:1])) {
+			if name != "" {
+				charsets = append(charsets, name)
+			}
+		}
+	case TELNET_CHARSET_ACCEPTED:
+		charsets = append(charsets, string(rest))
+	case TELNET_CHARSET_REJECTED, TELNET_CHARSET_TTABLE_REJECTED:
+	default:
+		monolog.Info("telopt CHARSET subneg %d not supported", command)
+		return
+	}
+	me.SendEvent(&CharsetEvent{command, charsets})
+}
+
+// Offers the character sets to the client, in order of preference.
+func (me *Telnet) TelnetCharsetRequest(charsets ...string) {
+	buf := []byte{TELNET_CHARSET_REQUEST, ';'}
+	buf = append(buf, strings.Join(charsets, ";")...)
+	me.TelnetSubnegotiation(TELNET_TELOPT_CHARSET, buf)
+}
+
+// Accepts one of the character sets the client offered.
+func (me *Telnet) TelnetCharsetAccept(charset string) {
+	buf := []byte{TELNET_CHARSET_ACCEPTED}
+	buf = append(buf, charset...)
+	me.TelnetSubnegotiation(TELNET_TELOPT_CHARSET, buf)
+}
+
+// Rejects the character sets the client offered.
+func (me *Telnet) TelnetCharsetReject() {
+	me.TelnetSubnegotiation(TELNET_TELOPT_CHARSET, []byte{TELNET_CHARSET_REJECTED})
+}
+
+// A character set text can be transcoded to. Apart from UTF-8, only single
+// byte character sets are supported. high maps the bytes 128 to 255 to
+// runes, if it is empty those bytes can't be used at all.
+type Charset struct {
+	Name    string
+	Aliases []string
+	utf8    bool
+	high    []rune
+}
+
+// Upper half of code page 437, the original IBM PC character set.
+const cp437High = "ÇüéâäàåçêëèïîìÄÅ" +
+	"ÉæÆôöòûùÿÖÜ¢£¥₧ƒ" +
+	"áíóúñÑªº¿⌐¬½¼¡«»" +
+	"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+	"└┴┬├─┼╞╟╚╔╩╦╠═╬╧" +
+	"╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"αßΓπΣσµτΦΘΩδ∞φε∩" +
+	"≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00a0"
+
+// Returns the upper half of ISO-8859-1, which maps directly to Unicode.
+func latin1High() []rune {
+	high := make([]rune, 128)
+	for index := range high {
+		high[index] = rune(128 + index)
+	}
+	return high
+}
+
+// The supported character sets, in order of preference.
+var Charsets = []*Charset{
+	{"UTF-8", []string{"UTF8"}, true, nil},
+	{"ISO-8859-1", []string{"ISO8859-1", "ISO_8859-1", "LATIN1", "LATIN-1"}, false, latin1High()},
+	{"CP437", []string{"IBM437", "437"}, false, []rune(cp437High)},
+	{"US-ASCII", []string{"ASCII", "ANSI_X3.4-1968"}, false, nil},
+}
+
+// Returns the names of the supported character sets.
+func CharsetNames() []string {
+	names := make([]string, 0, len(Charsets))
+	for _, charset := range Charsets {
+		names = append(names, charset.Name)
+	}
+	return names
+}
+
+// Finds a supported character set by name or alias, ignoring case.
+// Returns nil if not supported.
+func FindCharset(name string) *Charset {
+	for _, charset := range Charsets {
+		if strings.EqualFold(charset.Name, name) {
+			return charset
+		}
+		for _, alias := range charset.Aliases {
+			if strings.EqualFold(alias, name) {
+				return charset
+			}
+		}
+	}
+	return nil
+}
+
+// Returns true if this is UTF-8, which needs no transcoding.
+func (me *Charset) IsUTF8() bool {
+	return me == nil || me.utf8
+}
+
+// Encodes UTF-8 text into this character set. Characters that
+// can't be encoded are replaced by a question mark.
+func (me *Charset) Encode(text string) []byte {
+	if me.IsUTF8() {
+		return []byte(text)
+	}
+	out := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r < 128 {
+			out = append(out, byte(r))
+			continue
+		}
+		c := byte('?')
+		for index, h := range me.high {
+			if h == r {
+				c = byte(128 + index)
+				break
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// Decodes text in this character set into UTF-8. Bytes that
+// can't be decoded are replaced by the Unicode replacement character.
+func (me *Charset) Decode(data []byte) []byte {
+	if me.IsUTF8() {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for _, c := range data {
+		r := rune(c)
+		if c >= 128 {
+			r = utf8.RuneError
+			if int(c-128) < len(me.high) {
+				r = me.high[c-128]
+			}
+		}
+		out = append(out, string(r)...)
+	}
+	return out
+}
@@ -64,6 +64,7 @@ const (
     TELNET_TELOPT_AUTHENTICATION = 37
     TELNET_TELOPT_ENCRYPT = 38
     TELNET_TELOPT_NEW_ENVIRON = 39
+    TELNET_TELOPT_CHARSET = 42
     TELNET_TELOPT_MSDP = 69
     TELNET_TELOPT_MSSP = 70
     TELNET_TELOPT_COMPRESS = 85
@@ -77,6 +78,7 @@ const (
 
 
     TELNET_TELOPT_ZMP = 93
+    TELNET_TELOPT_GMCP = 201
     TELNET_TELOPT_EXOPL = 255
 
     TELNET_TELOPT_MCCP2 = 86
@@ -105,6 +107,15 @@ const (
     TELNET_ENVIRON_ESC = 2
     TELNET_ENVIRON_USERVAR = 3
 
+    // CHARSET codes.
+    TELNET_CHARSET_REQUEST = 1
+    TELNET_CHARSET_ACCEPTED = 2
+    TELNET_CHARSET_REJECTED = 3
+    TELNET_CHARSET_TTABLE_IS = 4
+    TELNET_CHARSET_TTABLE_REJECTED = 5
+    TELNET_CHARSET_TTABLE_ACK = 6
+    TELNET_CHARSET_TTABLE_NAK = 7
+
     // MSSP codes. 
     TELNET_MSSP_VAR = 1
     TELNET_MSSP_VAL = 2
@@ -0,0 +1,85 @@
+package telnet
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "github.com/beoran/woe/monolog"
+
+// This file implements GMCP, the Generic MUD Communication Protocol.
+// A GMCP message is sent as a subnegotiation of the form
+// IAC SB GMCP <Package.SubPackage.Message> [<JSON data>] IAC SE
+
+// GMCP message received from the client.
+type GMCPEvent struct {
+	// Name of the message, like "Core.Supports.Set"
+	Name string
+	// JSON data of the message, may be empty.
+	Data []byte
+}
+
+func (me GMCPEvent) Type() EventType { return TELNET_GMCP_EVENT }
+
+// Unmarshals the JSON data of the GMCP message into value.
+func (me GMCPEvent) Decode(value interface{}) error {
+	if len(me.Data) < 1 {
+		return errors.New("GMCP message has no data")
+	}
+	return json.Unmarshal(me.Data, value)
+}
+
+// Encodes a GMCP message with the given name and data as a subnegotiation
+// payload. If data is nil, only the name is encoded.
+func EncodeGMCP(name string, data interface{}) ([]byte, error) {
+	if name == "" || bytes.ContainsAny([]byte(name), " \t") {
+		return nil, errors.New("GMCP message name not valid")
+	}
+	buf := []byte(name)
+	if data == nil {
+		return buf, nil
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, ' ')
+	buf = append(buf, encoded...)
+	return buf, nil
+}
+
+// Decodes a GMCP subnegotiation payload into its name and JSON data.
+func DecodeGMCP(buffer []byte) (name string, data []byte, err error) {
+	trimmed := bytes.TrimSpace(buffer)
+	if len(trimmed) < 1 {
+		return "", nil, errors.New("Empty GMCP message")
+	}
+	index := bytes.IndexAny(trimmed, " \t")
+	if index < 0 {
+		return string(trimmed), nil, nil
+	}
+	name = string(trimmed[:index])
+	data = bytes.TrimSpace(trimmed[index+1:])
+	if len(data) > 0 && !json.Valid(data) {
+		return name, nil, errors.New("GMCP message data is not valid JSON")
+	}
+	return name, data, nil
+}
+
+// Parse GMCP subnegotiation buffers
+func (me *Telnet) SubnegotiateGMCP(buffer []byte) {
+	name, data, err := DecodeGMCP(buffer)
+	if err != nil {
+		monolog.Warning("Bad GMCP message %q: %v", buffer, err)
+		return
+	}
+	me.SendEvent(&GMCPEvent{name, data})
+}
+
+// Send a GMCP message to the client
+func (me *Telnet) TelnetSendGMCP(name string, data interface{}) error {
+	buf, err := EncodeGMCP(name, data)
+	if err != nil {
+		return err
+	}
+	me.TelnetSubnegotiation(TELNET_TELOPT_GMCP, buf)
+	return nil
+}
@@ -0,0 +1,238 @@
+package telnet
+
+import "errors"
+import "sort"
+import "github.com/beoran/woe/monolog"
+
+// This file implements MSDP, the Mud Server Data Protocol.
+// MSDP values are represented with plain Go values: a string, an MSDPTable
+// for MSDP_TABLE_OPEN ... MSDP_TABLE_CLOSE or an MSDPArray for
+// MSDP_ARRAY_OPEN ... MSDP_ARRAY_CLOSE. Tables and arrays may be nested.
+
+// An MSDP table, a map of names to values.
+type MSDPTable map[string]interface{}
+
+// An MSDP array, a list of values.
+type MSDPArray []interface{}
+
+// An MSDP variable with its value.
+type MSDPVar struct {
+	Name  string
+	Value interface{}
+}
+
+// MSDP variables received from the client.
+type MSDPEvent struct {
+	Vars []MSDPVar
+}
+
+func (me MSDPEvent) Type() EventType { return TELNET_MSDP_EVENT }
+
+// Returns the value of the variable as a list of strings. A string value
+// becomes a list of one, arrays of strings are returned as is.
+// Anything else is ignored.
+func (me MSDPVar) Strings() []string {
+	switch value := me.Value.(type) {
+	case string:
+		return []string{value}
+	case MSDPArray:
+		var result []string
+		for _, elt := range value {
+			if str, ok := elt.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// Encodes an MSDP value and appends it to buf.
+func encodeMSDPValue(buf []byte, value interface{}) ([]byte, error) {
+	switch value := value.(type) {
+	case string:
+		buf = append(buf, value...)
+	case MSDPTable:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		// Sort for a stable output
+		sort.Strings(keys)
+		buf = append(buf, TELNET_MSDP_TABLE_OPEN)
+		for _, key := range keys {
+			var err error
+			buf, err = encodeMSDPVar(buf, MSDPVar{key, value[key]})
+			if err != nil {
+				return nil, err
+			}
+		}
+		buf = append(buf, TELNET_MSDP_TABLE_CLOSE)
+	case MSDPArray:
+		buf = append(buf, TELNET_MSDP_ARRAY_OPEN)
+		for _, elt := range value {
+			var err error
+			buf = append(buf, TELNET_MSDP_VAL)
+			buf, err = encodeMSDPValue(buf, elt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		buf = append(buf, TELNET_MSDP_ARRAY_CLOSE)
+	default:
+		return nil, errors.New("Unsupported MSDP value type")
+	}
+	return buf, nil
+}
+
+// Encodes an MSDP variable and appends it to buf.
+func encodeMSDPVar(buf []byte, variable MSDPVar) ([]byte, error) {
+	buf = append(buf, TELNET_MSDP_VAR)
+	buf = append(buf, variable.Name...)
+	buf = append(buf, TELNET_MSDP_VAL)
+	return encodeMSDPValue(buf, variable.Value)
+}
+
+// Encodes MSDP variables as a subnegotiation payload.
+func EncodeMSDP(vars ...MSDPVar) ([]byte, error) {
+	var buf []byte
+	for _, variable := range vars {
+		var err error
+		buf, err = encodeMSDPVar(buf, variable)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// Decoder state for MSDP.
+type msdpDecoder struct {
+	buffer []byte
+	index  int
+}
+
+func (me *msdpDecoder) done() bool {
+	return me.index >= len(me.buffer)
+}
+
+func (me *msdpDecoder) peek() byte {
+	return me.buffer[me.index]
+}
+
+// Returns true if c is one of the MSDP control bytes.
+func isMSDPControl(c byte) bool {
+	return c >= TELNET_MSDP_VAR && c <= TELNET_MSDP_ARRAY_CLOSE
+}
+
+// Reads bytes up to the next MSDP control byte.
+func (me *msdpDecoder) text() string {
+	start := me.index
+	for !me.done() && !isMSDPControl(me.peek()) {
+		me.index++
+	}
+	return string(me.buffer[start:me.index])
+}
+
+// Decodes a single value after MSDP_VAL.
+func (me *msdpDecoder) value() (interface{}, error) {
+	if me.done() {
+		return "", nil
+	}
+	switch me.peek() {
+	case TELNET_MSDP_TABLE_OPEN:
+		me.index++
+		table := make(MSDPTable)
+		for !me.done() && me.peek() != TELNET_MSDP_TABLE_CLOSE {
+			variable, err := me.variable()
+			if err != nil {
+				return nil, err
+			}
+			table[variable.Name] = variable.Value
+		}
+		if me.done() {
+			return nil, errors.New("MSDP table not closed")
+		}
+		me.index++
+		return table, nil
+	case TELNET_MSDP_ARRAY_OPEN:
+		me.index++
+		var array MSDPArray
+		for !me.done() && me.peek() == TELNET_MSDP_VAL {
+			me.index++
+			elt, err := me.value()
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, elt)
+		}
+		if me.done() || me.peek() != TELNET_MSDP_ARRAY_CLOSE {
+			return nil, errors.New("MSDP array not closed")
+		}
+		me.index++
+		return array, nil
+	}
+	return me.text(), nil
+}
+
+// Decodes a variable, starting at MSDP_VAR. Several values for the same
+// variable are returned as an array.
+func (me *msdpDecoder) variable() (variable MSDPVar, err error) {
+	if me.done() || me.peek() != TELNET_MSDP_VAR {
+		return variable, errors.New("MSDP variable expected")
+	}
+	me.index++
+	variable.Name = me.text()
+	var values MSDPArray
+	for !me.done() && me.peek() == TELNET_MSDP_VAL {
+		me.index++
+		value, err := me.value()
+		if err != nil {
+			return variable, err
+		}
+		values = append(values, value)
+	}
+	switch len(values) {
+	case 0:
+		variable.Value = ""
+	case 1:
+		variable.Value = values[0]
+	default:
+		variable.Value = values
+	}
+	return variable, nil
+}
+
+// Decodes an MSDP subnegotiation payload into variables.
+func DecodeMSDP(buffer []byte) ([]MSDPVar, error) {
+	decoder := &msdpDecoder{buffer, 0}
+	var vars []MSDPVar
+	for !decoder.done() {
+		variable, err := decoder.variable()
+		if err != nil {
+			return vars, err
+		}
+		vars = append(vars, variable)
+	}
+	return vars, nil
+}
+
+// Parse MSDP subnegotiation buffers
+func (me *Telnet) SubnegotiateMSDP(buffer []byte) {
+	vars, err := DecodeMSDP(buffer)
+	if err != nil {
+		monolog.Warning("Bad MSDP subnegotiation %v: %v", buffer, err)
+		return
+	}
+	me.SendEvent(&MSDPEvent{vars})
+}
+
+// Send MSDP variables to the client
+func (me *Telnet) TelnetSendMSDP(vars ...MSDPVar) error {
+	buf, err := EncodeMSDP(vars...)
+	if err != nil {
+		return err
+	}
+	me.TelnetSubnegotiation(TELNET_TELOPT_MSDP, buf)
+	return nil
+}
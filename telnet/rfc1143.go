@@ -1,3 +1,244 @@
 package telnet
 
-// RFC 1143 is not implemented yet.
+import "github.com/beoran/woe/monolog"
+
+// This file implements the RFC 1143 "Q method" of telnet option negotiation.
+// For every option the state of both sides is tracked, our side ("us") and
+// the client's side ("him"), so negotiation loops can't happen and
+// unsolicited requests get answered according to a policy.
+
+// Q method states of one side of an option. The OPPOSITE variants mean the
+// opposite request was queued while negotiating.
+const (
+	Q_NO               = 0
+	Q_YES              = 1
+	Q_WANTNO           = 2
+	Q_WANTYES          = 3
+	Q_WANTNO_OPPOSITE  = 4
+	Q_WANTYES_OPPOSITE = 5
+)
+
+// Returns the negotiation state of an option, creating it if needed.
+// Must be called with the qlock held.
+func (me *Telnet) getTelopt(telopt byte) Telopt {
+	opt, ok := me.telopts[telopt]
+	if !ok {
+		opt = Telopt{telopt: telopt}
+	}
+	return opt
+}
+
+// Stores the negotiation state of an option.
+// Must be called with the qlock held.
+func (me *Telnet) putTelopt(opt Telopt) {
+	me.telopts[opt.telopt] = opt
+}
+
+// Sets the policy for unsolicited requests from the client for telopt.
+// If us is true, a DO from the client will be accepted, if him is true,
+// a WILL from the client will be accepted. Anything else is refused.
+// Answers to our own requests are always accepted.
+func (me *Telnet) SetPolicy(telopt byte, us bool, him bool) {
+	me.qlock.Lock()
+	defer me.qlock.Unlock()
+	opt := me.getTelopt(telopt)
+	opt.acceptUs = us
+	opt.acceptHim = him
+	me.putTelopt(opt)
+}
+
+// Returns true if the option is enabled on our (the server's) side.
+func (me *Telnet) UsEnabled(telopt byte) bool {
+	me.qlock.Lock()
+	defer me.qlock.Unlock()
+	return me.getTelopt(telopt).us == Q_YES
+}
+
+// Returns true if the option is enabled on his (the client's) side.
+func (me *Telnet) HimEnabled(telopt byte) bool {
+	me.qlock.Lock()
+	defer me.qlock.Unlock()
+	return me.getTelopt(telopt).him == Q_YES
+}
+
+// Returns true if the option is enabled on the side that the negotiation
+// command cmd applies to: our side for WILL and WONT, his for DO and DONT.
+func (me *Telnet) IsEnabled(cmd byte, telopt byte) bool {
+	switch cmd {
+	case TELNET_WILL, TELNET_WONT:
+		return me.UsEnabled(telopt)
+	case TELNET_DO, TELNET_DONT:
+		return me.HimEnabled(telopt)
+	}
+	return false
+}
+
+// Asks to enable or disable an option on one side. Changes the state
+// of the side q, sending negotiation yes or no as needed.
+// Returns the new state. Must be called with the qlock held.
+func (me *Telnet) request(q byte, enable bool, yes byte, no byte, telopt byte) byte {
+	switch q {
+	case Q_NO:
+		if enable {
+			me.SendNegotiate(yes, telopt)
+			return Q_WANTYES
+		}
+		monolog.Log("TELNET", "Option %d already disabled.", telopt)
+	case Q_YES:
+		if !enable {
+			me.SendNegotiate(no, telopt)
+			return Q_WANTNO
+		}
+		monolog.Log("TELNET", "Option %d already enabled.", telopt)
+	case Q_WANTNO:
+		if enable {
+			return Q_WANTNO_OPPOSITE
+		}
+		monolog.Log("TELNET", "Option %d already being disabled.", telopt)
+	case Q_WANTNO_OPPOSITE:
+		if !enable {
+			return Q_WANTNO
+		}
+		monolog.Log("TELNET", "Option %d already queued for enabling.", telopt)
+	case Q_WANTYES:
+		if !enable {
+			return Q_WANTYES_OPPOSITE
+		}
+		monolog.Log("TELNET", "Option %d already being enabled.", telopt)
+	case Q_WANTYES_OPPOSITE:
+		if enable {
+			return Q_WANTYES
+		}
+		monolog.Log("TELNET", "Option %d already queued for disabling.", telopt)
+	}
+	return q
+}
+
+// Sends a negotiation request through the Q method. WILL and WONT ask to
+// enable or disable the option on our side, DO and DONT on the client's side.
+// Requests that are redundant with the current state are not sent.
+func (me *Telnet) RequestNegotiate(cmd byte, telopt byte) {
+	me.qlock.Lock()
+	defer me.qlock.Unlock()
+	opt := me.getTelopt(telopt)
+	switch cmd {
+	case TELNET_WILL:
+		opt.us = me.request(opt.us, true, TELNET_WILL, TELNET_WONT, telopt)
+	case TELNET_WONT:
+		opt.us = me.request(opt.us, false, TELNET_WILL, TELNET_WONT, telopt)
+	case TELNET_DO:
+		opt.him = me.request(opt.him, true, TELNET_DO, TELNET_DONT, telopt)
+	case TELNET_DONT:
+		opt.him = me.request(opt.him, false, TELNET_DO, TELNET_DONT, telopt)
+	default:
+		monolog.Warning("Not a negotiation command: %d", cmd)
+	}
+	me.putTelopt(opt)
+}
+
+// Handles a received positive negotiation (WILL or DO) for the side q.
+// accept is the policy for unsolicited requests. yes and no are the answers
+// to send. Returns the new state and whether the option became enabled.
+// Must be called with the qlock held.
+func (me *Telnet) receiveYes(q byte, accept bool, yes byte, no byte, telopt byte) (byte, bool) {
+	switch q {
+	case Q_NO:
+		if accept {
+			me.SendNegotiate(yes, telopt)
+			return Q_YES, true
+		}
+		me.SendNegotiate(no, telopt)
+		monolog.Log("TELNET", "Refused option %d.", telopt)
+		return Q_NO, false
+	case Q_YES:
+		// Already enabled, ignore to avoid loops.
+		return Q_YES, false
+	case Q_WANTNO:
+		monolog.Warning("Option %d: disable answered by enable.", telopt)
+		return Q_NO, false
+	case Q_WANTNO_OPPOSITE:
+		monolog.Warning("Option %d: disable answered by enable.", telopt)
+		return Q_YES, true
+	case Q_WANTYES:
+		return Q_YES, true
+	case Q_WANTYES_OPPOSITE:
+		me.SendNegotiate(no, telopt)
+		return Q_WANTNO, false
+	}
+	return q, false
+}
+
+// Handles a received negative negotiation (WONT or DONT) for the side q.
+// Returns the new state and whether the option became or stays disabled
+// as a result of this answer.
+// Must be called with the qlock held.
+func (me *Telnet) receiveNo(q byte, yes byte, no byte, telopt byte) (byte, bool) {
+	switch q {
+	case Q_NO:
+		// Already disabled, ignore to avoid loops.
+		return Q_NO, false
+	case Q_YES:
+		me.SendNegotiate(no, telopt)
+		return Q_NO, true
+	case Q_WANTNO:
+		return Q_NO, true
+	case Q_WANTNO_OPPOSITE:
+		me.SendNegotiate(yes, telopt)
+		return Q_WANTYES, false
+	case Q_WANTYES, Q_WANTYES_OPPOSITE:
+		return Q_NO, true
+	}
+	return q, false
+}
+
+// Handles a received WILL.
+func (me *Telnet) receiveWill(telopt byte) {
+	me.qlock.Lock()
+	opt := me.getTelopt(telopt)
+	var changed bool
+	opt.him, changed = me.receiveYes(opt.him, opt.acceptHim, TELNET_DO, TELNET_DONT, telopt)
+	me.putTelopt(opt)
+	me.qlock.Unlock()
+	if changed {
+		me.SendEvent(&WillEvent{telopt})
+	}
+}
+
+// Handles a received WONT.
+func (me *Telnet) receiveWont(telopt byte) {
+	me.qlock.Lock()
+	opt := me.getTelopt(telopt)
+	var changed bool
+	opt.him, changed = me.receiveNo(opt.him, TELNET_DO, TELNET_DONT, telopt)
+	me.putTelopt(opt)
+	me.qlock.Unlock()
+	if changed {
+		me.SendEvent(&WontEvent{telopt})
+	}
+}
+
+// Handles a received DO.
+func (me *Telnet) receiveDo(telopt byte) {
+	me.qlock.Lock()
+	opt := me.getTelopt(telopt)
+	var changed bool
+	opt.us, changed = me.receiveYes(opt.us, opt.acceptUs, TELNET_WILL, TELNET_WONT, telopt)
+	me.putTelopt(opt)
+	me.qlock.Unlock()
+	if changed {
+		me.SendEvent(&DoEvent{telopt})
+	}
+}
+
+// Handles a received DONT.
+func (me *Telnet) receiveDont(telopt byte) {
+	me.qlock.Lock()
+	opt := me.getTelopt(telopt)
+	var changed bool
+	opt.us, changed = me.receiveNo(opt.us, TELNET_WILL, TELNET_WONT, telopt)
+	me.putTelopt(opt)
+	me.qlock.Unlock()
+	if changed {
+		me.SendEvent(&DontEvent{telopt})
+	}
+}
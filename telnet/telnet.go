@@ -1,9 +1,10 @@
 package telnet
 
-// import "bytes"
-import "io"
+import "bytes"
+import "errors"
 import "strings"
 import "fmt"
+import "sync"
 import "compress/zlib"
 import "github.com/beoran/woe/monolog"
 
@@ -37,6 +38,9 @@ const (
 	TELNET_ENVIRONMENT_EVENT  EventType = iota
 	TELNET_MSSP_EVENT         EventType = iota
 	TELNET_ZMP_EVENT          EventType = iota
+	TELNET_GMCP_EVENT         EventType = iota
+	TELNET_MSDP_EVENT         EventType = iota
+	TELNET_CHARSET_EVENT      EventType = iota
 	TELNET_WILL_EVENT         EventType = iota
 	TELNET_WONT_EVENT         EventType = iota
 	TELNET_DO_EVENT           EventType = iota
@@ -91,9 +95,11 @@ type CompressEvent struct {
 
 func (me CompressEvent) Type() EventType { return TELNET_COMPRESS_EVENT }
 
-// Storage for environment values
+// Storage for environment values. Type is TELNET_ENVIRON_VAR or
+// TELNET_ENVIRON_USERVAR.
 type Environment struct {
 	Type  byte
+	Name  string
 	Value string
 }
 
@@ -163,10 +169,14 @@ func IsEventType(event Event, typ EventType) bool {
 
 type EventChannel chan (Event)
 
+// Negotiation state of a telnet option, see rfc1143.go.
 type Telopt struct {
 	telopt byte
 	us     byte
 	him    byte
+	// Policy for unsolicited requests from the client.
+	acceptUs  bool
+	acceptHim bool
 }
 
 type Telnet struct {
@@ -175,45 +185,148 @@ type Telnet struct {
 	telopts   map[byte]Telopt
 	state     TelnetState
 	compress  bool
-	zwriter   zlib.Writer
-	zreader   io.ReadCloser
+	zwriter   *zlib.Writer
+	zbuffer   bytes.Buffer
 	buffer    []byte
 	sb_telopt byte
+	closed    bool
+	// Data waiting to be sent on ToClient, in order.
+	pending [][]byte
+	// Protects the compression state, closed and pending. It is never
+	// held while sending on ToClient, which may block.
+	lock sync.Mutex
+	// Held while sending pending data on ToClient, so it keeps its order.
+	sendlock sync.Mutex
+	// Protects the option negotiation state in telopts.
+	qlock sync.Mutex
 }
 
 func New() (telnet *Telnet) {
-	events := make(EventChannel, 64)
-	toclient := make(chan ([]byte), 64)
-	telopts := make(map[byte]Telopt)
-	state := data_state
-	compress := false
-	var zwriter zlib.Writer
-	var zreader io.ReadCloser
-	var buffer []byte = nil
-	sb_telopt := byte(0)
-	telnet = &Telnet{events, toclient, telopts, state, compress, zwriter, zreader, buffer, sb_telopt}
+	telnet = &Telnet{}
+	telnet.Events = make(EventChannel, 64)
+	telnet.ToClient = make(chan ([]byte), 64)
+	telnet.telopts = make(map[byte]Telopt)
+	telnet.state = data_state
 	return telnet
 }
 
-// Starts compresssion
+// Starts MCCP2 compression of all data sent to the client from now on.
+// Every write is flushed so the client can decompress it immediately.
 func (me *Telnet) StartCompression() {
-	// XXX implement compression.
-	// var zwbuf  bytes.Buffer
-	// me.zwriter = zlib.NewWriter(&zwbuf);
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.compress || me.closed {
+		return
+	}
+	me.zbuffer.Reset()
+	me.zwriter = zlib.NewWriter(&me.zbuffer)
+	me.compress = true
+}
+
+// Returns true if the data sent to the client is being compressed.
+func (me *Telnet) IsCompressing() bool {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.compress
+}
+
+// Takes out the compressed data that is waiting in the zlib buffer.
+// Must be called with the lock held.
+func (me *Telnet) takeCompressed() []byte {
+	if me.zbuffer.Len() < 1 {
+		return nil
+	}
+	out := make([]byte, me.zbuffer.Len())
+	copy(out, me.zbuffer.Bytes())
+	me.zbuffer.Reset()
+	return out
+}
+
+// Stops compression, terminating the zlib stream cleanly. The end of the
+// stream is added to the pending data. Must be called with the lock held.
+func (me *Telnet) stopCompression() {
+	if !me.compress {
+		return
+	}
+	if err := me.zwriter.Close(); err != nil {
+		monolog.Warning("Could not end compression: %v", err)
+	}
+	if out := me.takeCompressed(); out != nil {
+		me.pending = append(me.pending, out)
+	}
+	me.zwriter = nil
+	me.compress = false
 }
 
 // Closes the telnet connection, send last compressed data if needed.
+// After this, ToClient is closed and nothing more will be sent.
 func (me *Telnet) Close() {
-	if me.compress {
-		me.zwriter.Close()
-		me.zreader.Close()
+	me.lock.Lock()
+	if me.closed {
+		me.lock.Unlock()
+		return
+	}
+	me.stopCompression()
+	me.closed = true
+	me.lock.Unlock()
+	me.flush()
+	me.sendlock.Lock()
+	defer me.sendlock.Unlock()
+	close(me.ToClient)
+}
+
+// Sends the pending data on ToClient. This blocks while ToClient is full.
+func (me *Telnet) flush() {
+	me.sendlock.Lock()
+	defer me.sendlock.Unlock()
+	for {
+		me.lock.Lock()
+		pending := me.pending
+		me.pending = nil
+		me.lock.Unlock()
+		if len(pending) < 1 {
+			return
+		}
+		for _, out := range pending {
+			me.ToClient <- out
+		}
 	}
 }
 
 // Filters raw text, only compressing it if needed.
 func (me *Telnet) SendRaw(in []byte) {
-	// XXX Handle compression here later
-	me.ToClient <- in
+	if me.queue(in) {
+		me.flush()
+	}
+}
+
+// Compresses the data if needed and adds it to the pending data.
+// Returns false if nothing was added.
+func (me *Telnet) queue(in []byte) bool {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.closed {
+		monolog.Log("TELNET", "Dropping data sent after close: %v", in)
+		return false
+	}
+	if !me.compress {
+		me.pending = append(me.pending, in)
+		return true
+	}
+	if _, err := me.zwriter.Write(in); err != nil {
+		monolog.Warning("Compression failed: %v", err)
+		return false
+	}
+	if err := me.zwriter.Flush(); err != nil {
+		monolog.Warning("Compression flush failed: %v", err)
+		return false
+	}
+	out := me.takeCompressed()
+	if out == nil {
+		return false
+	}
+	me.pending = append(me.pending, out)
+	return true
 }
 
 // Filters text, escaping IAC bytes.
@@ -230,7 +343,7 @@ func (me *Telnet) SendEscaped(in []byte) {
 		buffer[outdex] = now
 		outdex++
 	}
-	me.SendRaw(buffer)
+	me.SendRaw(buffer[:outdex])
 }
 
 // Send negotiation bytes
@@ -260,68 +373,82 @@ func (me *Telnet) SubnegotiateNAWS(buffer []byte) {
 
 // process an ENVIRON/NEW-ENVIRON subnegotiation buffer
 func (me *Telnet) SubnegotiateEnviron(buffer []byte) {
-	var vars []Environment
-	var cmd []byte
+	if len(buffer) < 1 {
+		monolog.Warning("telopt environment subneg empty")
+		return
+	}
 	fb := buffer[0]
 	// First byte must be a valid command
 	if fb != TELNET_ENVIRON_SEND && fb != TELNET_ENVIRON_IS && fb != TELNET_ENVIRON_INFO {
 		monolog.Warning("telopt environment subneg command not valid")
+		return
 	}
 
-	cmd = append(cmd, fb)
-
-	if len(buffer) == 1 {
-		me.SendEvent(&EnvironmentEvent{fb, vars})
+	vars, err := DecodeEnviron(buffer[1:])
+	if err != nil {
+		monolog.Warning("telopt environment subneg %v", err)
 		return
 	}
+	me.SendEvent(&EnvironmentEvent{fb, vars})
+}
 
-	// Second byte must be VAR or USERVAR, if present
-	sb := buffer[1]
-	if sb != TELNET_ENVIRON_VAR && fb != TELNET_ENVIRON_USERVAR {
-		monolog.Warning("telopt environment subneg missing variable type")
-		return
+// Decodes the variables of an ENVIRON/NEW-ENVIRON subnegotiation buffer,
+// after the IS, SEND or INFO command byte. A variable without VALUE gets
+// an empty value, as is the case for SEND.
+func DecodeEnviron(buffer []byte) (vars []Environment, err error) {
+	if len(buffer) < 1 {
+		return vars, nil
+	}
+	// First byte must be VAR or USERVAR
+	if buffer[0] != TELNET_ENVIRON_VAR && buffer[0] != TELNET_ENVIRON_USERVAR {
+		return nil, errors.New("missing variable type")
+	}
+	// ensure last byte is not an escape byte (makes parsing easier)
+	if buffer[len(buffer)-1] == TELNET_ENVIRON_ESC {
+		return nil, errors.New("ends with ESC")
 	}
 
-	// ensure last byte is not an escape byte (makes parsing later easier)
-	lb := buffer[len(buffer)-1]
-	if lb == TELNET_ENVIRON_ESC {
-		monolog.Warning("telopt environment subneg ends with ESC")
-		return
+	var variable *Environment
+	var text []byte
+	inValue := false
+	// Stores the name or value read so far in the current variable.
+	store := func() {
+		if variable == nil {
+			return
+		}
+		if inValue {
+			variable.Value = string(text)
+		} else {
+			variable.Name = string(text)
+		}
+		text = nil
 	}
 
-	/* XXX : not implemented yet
-	   var variable * Environment = nil
-	   index           := 1
-	   escape          := false
-
-	   for index := 1 ; index < len(buffer) ; index++ {
-	     c := buffer[index]
-	     switch c {
-	       case TELNET_ENVIRON_VAR:
-	           fallthrough
-	       case TELNET_ENVIRON_VALUE:
-	           fallthrough
-	       case TELNET_ENVIRON_USERVAR:
-	           if escape {
-	               escape = false
-	               variable.Value  = append(variable.Value, c)
-	           } else if (variable != nil) {
-	               vars            = append(vars, variable)
-	               variable        = new(Environment)
-	               variable.Type   = c
-	           } else {
-	               variable        = new(Environment)
-	               variable.Type   = c
-	           }
-	     case TELNET_ENVIRON_ESC:
-	       escape = true
-	     default:
-	       variable.Value = append(variable.Value, c)
-	     }
-	   }
-	   // Finally send event
-	   me.SendEvent(&EnvironmentEvent{fb, vars})
-	*/
+	for index := 0; index < len(buffer); index++ {
+		c := buffer[index]
+		switch c {
+		case TELNET_ENVIRON_VAR, TELNET_ENVIRON_USERVAR:
+			store()
+			if variable != nil {
+				vars = append(vars, *variable)
+			}
+			variable = &Environment{Type: c}
+			inValue = false
+		case TELNET_ENVIRON_VALUE:
+			store()
+			inValue = true
+		case TELNET_ENVIRON_ESC:
+			index++
+			text = append(text, buffer[index])
+		default:
+			text = append(text, c)
+		}
+	}
+	store()
+	if variable != nil {
+		vars = append(vars, *variable)
+	}
+	return vars, nil
 }
 
 const (
@@ -412,11 +539,10 @@ func (me *Telnet) SubnegotiateTType(buffer []byte) {
 func (me *Telnet) DoSubnegotiate(buffer []byte) bool {
 	switch me.sb_telopt {
 	case TELNET_TELOPT_COMPRESS2:
-		// received COMPRESS2 begin marker, setup our zlib box and
-		// start handling the compressed stream if it's not already.
-		me.compress = true
-		me.SendEvent(&CompressEvent{me.compress})
-		return true
+		// MCCP2 only compresses the server's output, so a client that sends
+		// the COMPRESS2 begin marker is confused. Ignore it.
+		monolog.Warning("Client sent COMPRESS2 begin marker, ignored.")
+		return false
 	// specially handled subnegotiation telopt types
 	case TELNET_TELOPT_TTYPE:
 		me.SubnegotiateTType(buffer)
@@ -430,6 +556,12 @@ func (me *Telnet) DoSubnegotiate(buffer []byte) bool {
 		me.SubnegotiateNAWS(buffer)
 	case TELNET_TELOPT_ZMP:
 		me.SubnegotiateZMP(buffer)
+	case TELNET_TELOPT_GMCP:
+		me.SubnegotiateGMCP(buffer)
+	case TELNET_TELOPT_MSDP:
+		me.SubnegotiateMSDP(buffer)
+	case TELNET_TELOPT_CHARSET:
+		me.SubnegotiateCharset(buffer)
 	default:
 		// Send catch all subnegotiation event
 		me.SendEvent(&SubnegotiateEvent{me.sb_telopt, buffer})
@@ -440,13 +572,17 @@ func (me *Telnet) DoSubnegotiate(buffer []byte) bool {
 func (me *Telnet) DoNegotiate(state TelnetState, telopt byte) bool {
 	switch me.state {
 	case will_state:
-		me.SendEvent(&WillEvent{telopt})
+		me.receiveWill(telopt)
 	case wont_state:
-		me.SendEvent(&WontEvent{telopt})
+		me.receiveWont(telopt)
 	case do_state:
-		me.SendEvent(&DoEvent{telopt})
+		me.receiveDo(telopt)
 	case dont_state:
-		me.SendEvent(&DontEvent{telopt})
+		// A client may refuse compression at any time, even after it started.
+		if telopt == TELNET_TELOPT_COMPRESS2 {
+			me.EndCompress2()
+		}
+		me.receiveDont(telopt)
 	default:
 		monolog.Warning("State not vvalid in  telnet negotiation.")
 	}
@@ -599,13 +735,7 @@ func (me *Telnet) ProcessByte(bin byte) bool {
 func (me *Telnet) ProcessBytes(bytes []byte) {
 	for index := 0; index < len(bytes); {
 		bin := bytes[index]
-		compress := me.ProcessByte(bin)
-		if compress {
-			// paper over this for a while...
-			// new_bytes = Zlib.inflate(arr.pack('c*')) rescue nil
-			// if new_bytes
-			//arr = new_bytes.bytes.to_a
-		}
+		me.ProcessByte(bin)
 		index++
 	}
 	me.maybeSendDataEventAndEmptyBuffer()
@@ -629,9 +759,8 @@ func (me *Telnet) TelnetSendIac(cmd byte) {
 	me.TelnetSendBytes(TELNET_IAC, cmd)
 }
 
-// Send negotiation. Currently rfc1143 is not implemented, so beware of
-// server client loops. The simplest way to avoid those is to never answer any
-// client requests, only send server requests.
+// Send negotiation bytes directly, bypassing the RFC 1143 state machine.
+// Beware of server client loops, use RequestNegotiate in stead if possible.
 func (me *Telnet) TelnetSendNegotiate(cmd byte, telopt byte) {
 	me.TelnetSendBytes(TELNET_IAC, cmd, telopt)
 }
@@ -660,10 +789,20 @@ func (me *Telnet) TelnetSubnegotiation(telopt byte, buffer []byte) {
 	me.TelnetEndSubnegotiation()
 }
 
-// Ask client to start accepting compress2 compression
+// Ask client to start accepting compress2 compression. The marker itself is
+// sent uncompressed, everything after it is compressed.
 func (me *Telnet) TelnetBeginCompress2() {
 	me.TelnetSendBytes(TELNET_IAC, TELNET_SB, TELNET_TELOPT_COMPRESS2, TELNET_IAC, TELNET_SE)
-	me.compress = true
+	me.StartCompression()
+}
+
+// Ends compress2 compression, if it was active, by terminating the zlib
+// stream. Data sent afterwards is uncompressed again.
+func (me *Telnet) EndCompress2() {
+	me.lock.Lock()
+	me.stopCompression()
+	me.lock.Unlock()
+	me.flush()
 }
 
 // Send formatted data to the client
@@ -689,6 +828,35 @@ func (me *Telnet) TelnetNewenviron(cmd []byte) {
 	me.TelnetSubnegotiation(TELNET_TELOPT_NEW_ENVIRON, cmd)
 }
 
+// Escapes an ENVIRON/NEW-ENVIRON name or value and appends it to buf.
+func appendEnvironEscaped(buf []byte, text string) []byte {
+	for index := 0; index < len(text); index++ {
+		c := text[index]
+		switch c {
+		case TELNET_ENVIRON_VAR, TELNET_ENVIRON_VALUE, TELNET_ENVIRON_ESC, TELNET_ENVIRON_USERVAR:
+			buf = append(buf, TELNET_ENVIRON_ESC)
+		}
+		buf = append(buf, c)
+	}
+	return buf
+}
+
+// Asks the client for the values of NEW-ENVIRON variables.
+// vars are the well known VAR names, uservars the USERVAR names.
+// If both are empty the client is asked for all its variables.
+func (me *Telnet) TelnetNewenvironSend(vars []string, uservars []string) {
+	cmd := []byte{TELNET_ENVIRON_SEND}
+	for _, name := range vars {
+		cmd = append(cmd, TELNET_ENVIRON_VAR)
+		cmd = appendEnvironEscaped(cmd, name)
+	}
+	for _, name := range uservars {
+		cmd = append(cmd, TELNET_ENVIRON_USERVAR)
+		cmd = appendEnvironEscaped(cmd, name)
+	}
+	me.TelnetNewenviron(cmd)
+}
+
 // send TERMINAL-TYPE SEND command
 func (me *Telnet) TelnetTTypeSend() {
 	me.TelnetSendBytes(TELNET_IAC, TELNET_SB, TELNET_TELOPT_TTYPE, TELNET_TTYPE_SEND, TELNET_IAC, TELNET_SE)
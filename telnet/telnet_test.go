@@ -0,0 +1,370 @@
+package telnet
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Collects everything the telnet sent to the client so far.
+func HelperDrainToClient(me *Telnet) []byte {
+	var out []byte
+	for {
+		select {
+		case data, ok := <-me.ToClient:
+			if !ok {
+				return out
+			}
+			out = append(out, data...)
+		default:
+			return out
+		}
+	}
+}
+
+// Decompresses as much of the stream as possible, returns the data and
+// the error that ended the reading.
+func HelperInflate(test *testing.T, data []byte) ([]byte, error) {
+	zreader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		test.Fatalf("Could not start decompression: %v", err)
+	}
+	var out bytes.Buffer
+	_, err = io.Copy(&out, zreader)
+	return out.Bytes(), err
+}
+
+func TestCompress2(test *testing.T) {
+	tn := New()
+	tn.TelnetBeginCompress2()
+	marker := []byte{TELNET_IAC, TELNET_SB, TELNET_TELOPT_COMPRESS2, TELNET_IAC, TELNET_SE}
+	sent := HelperDrainToClient(tn)
+	if !bytes.Equal(sent, marker) {
+		test.Fatalf("COMPRESS2 marker not sent uncompressed: %v", sent)
+	}
+	if !tn.IsCompressing() {
+		test.Fatalf("Compression not started.")
+	}
+
+	tn.SendRaw([]byte("Hello "))
+	tn.TelnetSend([]byte{'W', TELNET_IAC, 'o'})
+	stream := HelperDrainToClient(tn)
+	// Every write is flushed, so all of it must be readable already.
+	got, err := HelperInflate(test, stream)
+	expect := []byte{'H', 'e', 'l', 'l', 'o', ' ', 'W', TELNET_IAC, TELNET_IAC, 'o'}
+	if !bytes.Equal(got, expect) {
+		test.Errorf("Flushed data not correct: %v %v (%v)", got, expect, err)
+	}
+	if err != io.ErrUnexpectedEOF {
+		test.Errorf("Stream should not have ended yet: %v", err)
+	}
+
+	tn.Close()
+	stream = append(stream, HelperDrainToClient(tn)...)
+	got, err = HelperInflate(test, stream)
+	if err != nil {
+		test.Errorf("Stream not terminated cleanly: %v", err)
+	}
+	if !bytes.Equal(got, expect) {
+		test.Errorf("Data not correct after close: %v %v", got, expect)
+	}
+	// Sending after close must not panic.
+	tn.SendRaw([]byte("late"))
+}
+
+func TestCompress2Dont(test *testing.T) {
+	tn := New()
+	tn.RequestNegotiate(TELNET_WILL, TELNET_TELOPT_COMPRESS2)
+	tn.ProcessBytes([]byte{TELNET_IAC, TELNET_DO, TELNET_TELOPT_COMPRESS2})
+	if ev := <-tn.Events; !IsEventType(ev, TELNET_DO_EVENT) {
+		test.Fatalf("Expected DO event: %v", ev)
+	}
+	tn.TelnetBeginCompress2()
+	HelperDrainToClient(tn)
+	tn.TelnetPrintf("compressed\n")
+	// Client refuses compression after the fact.
+	tn.ProcessBytes([]byte{TELNET_IAC, TELNET_DONT, TELNET_TELOPT_COMPRESS2})
+	if tn.IsCompressing() {
+		test.Fatalf("Compression not stopped after DONT COMPRESS2.")
+	}
+	stream := HelperDrainToClient(tn)
+	// The stream ends with the uncompressed IAC WONT COMPRESS2 answer.
+	wont := []byte{TELNET_IAC, TELNET_WONT, TELNET_TELOPT_COMPRESS2}
+	if !bytes.HasSuffix(stream, wont) {
+		test.Fatalf("DONT not answered with WONT: %v", stream)
+	}
+	got, err := HelperInflate(test, bytes.TrimSuffix(stream, wont))
+	if err != nil || string(got) != "compressed\r\n" {
+		test.Errorf("Stream not terminated cleanly: %q %v", got, err)
+	}
+	tn.SendRaw([]byte("plain"))
+	if sent := HelperDrainToClient(tn); string(sent) != "plain" {
+		test.Errorf("Data not plain after compression ended: %q", sent)
+	}
+	ev := <-tn.Events
+	if !IsEventType(ev, TELNET_DONT_EVENT) {
+		test.Errorf("Expected DONT event: %v", ev)
+	}
+}
+
+func TestQMethodRequest(test *testing.T) {
+	tn := New()
+	tn.RequestNegotiate(TELNET_DO, TELNET_TELOPT_NAWS)
+	tn.RequestNegotiate(TELNET_DO, TELNET_TELOPT_NAWS)
+	sent := HelperDrainToClient(tn)
+	if !bytes.Equal(sent, []byte{TELNET_IAC, TELNET_DO, TELNET_TELOPT_NAWS}) {
+		test.Errorf("Repeated request should be sent only once: %v", sent)
+	}
+	tn.ProcessBytes([]byte{TELNET_IAC, TELNET_WILL, TELNET_TELOPT_NAWS})
+	if !tn.HimEnabled(TELNET_TELOPT_NAWS) {
+		test.Errorf("NAWS should be enabled.")
+	}
+	if ev := <-tn.Events; !IsEventType(ev, TELNET_WILL_EVENT) {
+		test.Errorf("Expected WILL event: %v", ev)
+	}
+	// An answer to our own request must not be answered again,
+	// and repeated WILLs must be ignored, to avoid loops.
+	tn.ProcessBytes([]byte{TELNET_IAC, TELNET_WILL, TELNET_TELOPT_NAWS})
+	if sent := HelperDrainToClient(tn); len(sent) > 0 {
+		test.Errorf("Loop: answered WILL after it was acknowledged: %v", sent)
+	}
+	if len(tn.Events) > 0 {
+		test.Errorf("Repeated WILL should not generate an event.")
+	}
+	tn.ProcessBytes([]byte{TELNET_IAC, TELNET_WONT, TELNET_TELOPT_NAWS})
+	if sent := HelperDrainToClient(tn); !bytes.Equal(sent, []byte{TELNET_IAC, TELNET_DONT, TELNET_TELOPT_NAWS}) {
+		test.Errorf("WONT must be acknowledged with DONT: %v", sent)
+	}
+	if tn.HimEnabled(TELNET_TELOPT_NAWS) {
+		test.Errorf("NAWS should be disabled.")
+	}
+}
+
+func TestQMethodPolicy(test *testing.T) {
+	tn := New()
+	tn.SetPolicy(TELNET_TELOPT_TTYPE, false, true)
+	tn.ProcessBytes([]byte{TELNET_IAC, TELNET_WILL, TELNET_TELOPT_TTYPE,
+		TELNET_IAC, TELNET_WILL, TELNET_TELOPT_LINEMODE,
+		TELNET_IAC, TELNET_DO, TELNET_TELOPT_TTYPE})
+	expect := []byte{TELNET_IAC, TELNET_DO, TELNET_TELOPT_TTYPE,
+		TELNET_IAC, TELNET_DONT, TELNET_TELOPT_LINEMODE,
+		TELNET_IAC, TELNET_WONT, TELNET_TELOPT_TTYPE}
+	if sent := HelperDrainToClient(tn); !bytes.Equal(sent, expect) {
+		test.Errorf("Policy not applied: %v %v", sent, expect)
+	}
+	if !tn.HimEnabled(TELNET_TELOPT_TTYPE) || tn.UsEnabled(TELNET_TELOPT_TTYPE) {
+		test.Errorf("TTYPE state not correct.")
+	}
+	if tn.HimEnabled(TELNET_TELOPT_LINEMODE) {
+		test.Errorf("LINEMODE should have been refused.")
+	}
+	if ev := <-tn.Events; !IsEventType(ev, TELNET_WILL_EVENT) {
+		test.Errorf("Expected WILL event: %v", ev)
+	}
+	if len(tn.Events) > 0 {
+		test.Errorf("Refused requests should not generate events.")
+	}
+}
+
+func TestGMCP(test *testing.T) {
+	tn := New()
+	msg := []byte(`Core.Supports.Set [ "Char 1", "Room 1" ]`)
+	input := []byte{TELNET_IAC, TELNET_SB, TELNET_TELOPT_GMCP}
+	input = append(input, msg...)
+	input = append(input, TELNET_IAC, TELNET_SE)
+	tn.ProcessBytes(input)
+	ev, ok := (<-tn.Events).(*GMCPEvent)
+	if !ok || ev.Name != "Core.Supports.Set" {
+		test.Fatalf("Expected GMCP event: %v", ev)
+	}
+	var supports []string
+	if err := ev.Decode(&supports); err != nil || len(supports) != 2 || supports[1] != "Room 1" {
+		test.Errorf("GMCP data not decoded: %v %v", supports, err)
+	}
+
+	vitals := struct {
+		HP int `json:"hp"`
+	}{7}
+	if err := tn.TelnetSendGMCP("Char.Vitals", vitals); err != nil {
+		test.Fatalf("Could not send GMCP: %v", err)
+	}
+	sent := HelperDrainToClient(tn)
+	expect := []byte{TELNET_IAC, TELNET_SB, TELNET_TELOPT_GMCP}
+	expect = append(expect, `Char.Vitals {"hp":7}`...)
+	expect = append(expect, TELNET_IAC, TELNET_SE)
+	if !bytes.Equal(sent, expect) {
+		test.Errorf("GMCP not encoded correctly: %q %q", sent, expect)
+	}
+
+	if _, _, err := DecodeGMCP([]byte("Char.Vitals {broken")); err == nil {
+		test.Errorf("Invalid JSON should not decode.")
+	}
+	if name, data, err := DecodeGMCP([]byte("Core.Ping")); err != nil || name != "Core.Ping" || data != nil {
+		test.Errorf("Message without data not decoded: %s %v %v", name, data, err)
+	}
+}
+
+func TestMSDP(test *testing.T) {
+	vars := []MSDPVar{
+		{"HEALTH", "10"},
+		{"ROOM", MSDPTable{"VNUM": "6008", "EXITS": MSDPTable{"n": "6011"}}},
+		{"REPORT", MSDPArray{"HEALTH", "MANA"}},
+	}
+	encoded, err := EncodeMSDP(vars...)
+	if err != nil {
+		test.Fatalf("Could not encode MSDP: %v", err)
+	}
+	expect := []byte("\x01HEALTH\x0210" +
+		"\x01ROOM\x02\x03\x01EXITS\x02\x03\x01n\x026011\x04\x01VNUM\x026008\x04" +
+		"\x01REPORT\x02\x05\x02HEALTH\x02MANA\x06")
+	if !bytes.Equal(encoded, expect) {
+		test.Errorf("MSDP not encoded correctly: %q %q", encoded, expect)
+	}
+
+	tn := New()
+	input := []byte{TELNET_IAC, TELNET_SB, TELNET_TELOPT_MSDP}
+	input = append(input, encoded...)
+	// Several values for one variable are also an array.
+	input = append(input, "\x01SEND\x02LEVEL\x02ROOM"...)
+	input = append(input, TELNET_IAC, TELNET_SE)
+	tn.ProcessBytes(input)
+	ev, ok := (<-tn.Events).(*MSDPEvent)
+	if !ok || len(ev.Vars) != 4 {
+		test.Fatalf("Expected MSDP event with 4 variables: %v", ev)
+	}
+	if ev.Vars[0].Name != "HEALTH" || ev.Vars[0].Value != "10" {
+		test.Errorf("MSDP string not decoded: %v", ev.Vars[0])
+	}
+	room, ok := ev.Vars[1].Value.(MSDPTable)
+	if !ok || room["VNUM"] != "6008" || room["EXITS"].(MSDPTable)["n"] != "6011" {
+		test.Errorf("MSDP table not decoded: %v", ev.Vars[1])
+	}
+	if names := ev.Vars[2].Strings(); len(names) != 2 || names[1] != "MANA" {
+		test.Errorf("MSDP array not decoded: %v", ev.Vars[2])
+	}
+	if names := ev.Vars[3].Strings(); len(names) != 2 || names[0] != "LEVEL" {
+		test.Errorf("MSDP multiple values not decoded: %v", ev.Vars[3])
+	}
+
+	if _, err := DecodeMSDP([]byte("\x01ROOM\x02\x03\x01VNUM\x021")); err == nil {
+		test.Errorf("Unclosed table should not decode.")
+	}
+}
+
+func TestNewEnviron(test *testing.T) {
+	tn := New()
+	buf := []byte{TELNET_IAC, TELNET_SB, TELNET_TELOPT_NEW_ENVIRON, TELNET_ENVIRON_IS,
+		TELNET_ENVIRON_VAR}
+	buf = append(buf, "CLIENT_NAME"...)
+	buf = append(buf, TELNET_ENVIRON_VALUE)
+	buf = append(buf, "Mudlet"...)
+	buf = append(buf, TELNET_ENVIRON_USERVAR)
+	buf = append(buf, "ODD"...)
+	buf = append(buf, TELNET_ENVIRON_VALUE, 'a', TELNET_ENVIRON_ESC, TELNET_ENVIRON_VAR, 'b')
+	buf = append(buf, TELNET_ENVIRON_VAR)
+	buf = append(buf, "EMPTY"...)
+	buf = append(buf, TELNET_IAC, TELNET_SE)
+	tn.ProcessBytes(buf)
+
+	ev, ok := (<-tn.Events).(*EnvironmentEvent)
+	if !ok {
+		test.Fatalf("Expected environment event.")
+	}
+	expected := []Environment{
+		{TELNET_ENVIRON_VAR, "CLIENT_NAME", "Mudlet"},
+		{TELNET_ENVIRON_USERVAR, "ODD", "a\x00b"},
+		{TELNET_ENVIRON_VAR, "EMPTY", ""},
+	}
+	if ev.Telopt != TELNET_ENVIRON_IS || len(ev.Vars) != len(expected) {
+		test.Fatalf("Wrong environment event: %v", ev)
+	}
+	for index, env := range expected {
+		if ev.Vars[index] != env {
+			test.Errorf("Variable %d: %v, expected %v", index, ev.Vars[index], env)
+		}
+	}
+
+	tn.TelnetNewenvironSend([]string{"CHARSET"}, nil)
+	sent := HelperDrainToClient(tn)
+	request := []byte{TELNET_IAC, TELNET_SB, TELNET_TELOPT_NEW_ENVIRON, TELNET_ENVIRON_SEND,
+		TELNET_ENVIRON_VAR, 'C', 'H', 'A', 'R', 'S', 'E', 'T', TELNET_IAC, TELNET_SE}
+	if !bytes.Equal(sent, request) {
+		test.Errorf("Wrong NEW-ENVIRON request: %v", sent)
+	}
+}
+
+func TestCharset(test *testing.T) {
+	tn := New()
+	tn.ProcessBytes([]byte{TELNET_IAC, TELNET_SB, TELNET_TELOPT_CHARSET, TELNET_CHARSET_REQUEST,
+		' ', 'C', 'P', '4', '3', '7', ' ', 'U', 'T', 'F', '-', '8', TELNET_IAC, TELNET_SE})
+	ev, ok := (<-tn.Events).(*CharsetEvent)
+	if !ok || ev.Command != TELNET_CHARSET_REQUEST || len(ev.Charsets) != 2 ||
+		ev.Charsets[0] != "CP437" || ev.Charsets[1] != "UTF-8" {
+		test.Fatalf("Wrong CHARSET request event: %v", ev)
+	}
+
+	cp437 := FindCharset("ibm437")
+	if cp437 == nil || cp437.Name != "CP437" || len(cp437.high) != 128 {
+		test.Fatalf("CP437 not found or wrong: %v", cp437)
+	}
+	text := "Café ░▒▓  世"
+	encoded := cp437.Encode(text)
+	expected := []byte{'C', 'a', 'f', 0x82, ' ', 0xb0, 0xb1, 0xb2, ' ', 0xff, '?'}
+	if !bytes.Equal(encoded, expected) {
+		test.Errorf("Wrong CP437 encoding: %v", encoded)
+	}
+	if decoded := string(cp437.Decode(expected[:10])); decoded != text[:len(text)-3] {
+		test.Errorf("Wrong CP437 decoding: %q", decoded)
+	}
+
+	latin1 := FindCharset("Latin1")
+	if decoded := string(latin1.Decode([]byte{'n', 0xe9, 'e'})); decoded != "née" {
+		test.Errorf("Wrong Latin-1 decoding: %q", decoded)
+	}
+	if encoded := latin1.Encode("née"); !bytes.Equal(encoded, []byte{'n', 0xe9, 'e'}) {
+		test.Errorf("Wrong Latin-1 encoding: %v", encoded)
+	}
+}
+
+// A client that doesn't read fills ToClient. Whoever sends to it blocks,
+// but must not block the rest of the telnet, and Close must finish once
+// the output is drained.
+func TestSendRawFull(test *testing.T) {
+	tn := New()
+	for index := 0; index < cap(tn.ToClient); index++ {
+		tn.SendRaw([]byte{'x'})
+	}
+	sent := make(chan bool)
+	go func() {
+		tn.SendRaw([]byte("late"))
+		close(sent)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	checked := make(chan bool)
+	go func() {
+		tn.IsCompressing()
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(time.Second):
+		test.Fatalf("Telnet blocked while the output was full.")
+	}
+	closed := make(chan bool)
+	go func() {
+		tn.Close()
+		close(closed)
+	}()
+	var stream []byte
+	for data := range tn.ToClient {
+		stream = append(stream, data...)
+	}
+	<-sent
+	<-closed
+	if string(stream) != strings.Repeat("x", cap(tn.ToClient))+"late" {
+		test.Errorf("Output out of order: %q", stream)
+	}
+}
@@ -4,9 +4,14 @@ package main
 import "github.com/beoran/woe/server"
 import "github.com/beoran/woe/monolog"
 import "github.com/beoran/woe/raku"
+import "github.com/beoran/woe/sitef"
+import "github.com/beoran/woe/world"
 import "os"
 import "os/exec"
 import "flag"
+import "path/filepath"
+import "strings"
+import "time"
 import "fmt"
 
 type serverLogLevels []string
@@ -21,27 +26,52 @@ var raku_mode = flag.Bool("r", false, "Run in Raku interpreter mode")
 var server_tcpip = flag.String("l", ":7000", "TCP/IP Address where the server will listen")
 var enable_logs = flag.String("el", "FATAL,ERROR,WARNING,INFO", "Log levels to enable")
 var disable_logs = flag.String("dl", "", "Log levels to disable")
+var check_data = flag.Bool("check-data", false, "Check all data files in data/var and exit")
+var storage = flag.String("storage", world.STORAGE_FILES, "Storage backend for the world data: files or kv")
+var migrate = flag.String("migrate", "", "Copy all world data from the -storage backend to this backend and exit")
+var autosave = flag.Duration("autosave", server.DEFAULT_AUTOSAVE, "How often to save what changed in the world, 0 to turn off")
+var backups = flag.Int("backups", sitef.Backups, "Number of backups to keep of every saved data file")
+var log_max_size = flag.Int64("log-max-size", 16, "Rotate the log when it grows larger than this many MiB, 0 for no limit")
+var log_rotate = flag.Duration("log-rotate", 24*time.Hour, "Rotate the log when a new period of this length starts, 0 to not rotate by time")
+var log_keep = flag.Int("log-keep", 10, "Number of rotated logs to keep, 0 to keep all")
+var log_json = flag.String("log-json", "", "Also log as JSON lines to this file")
+var log_ring = flag.Int("log-ring", 1000, "Number of recent log lines to keep in memory for /tail, 0 for none")
 
 func enableDisableLogs() {
 	monolog.EnableLevels(*enable_logs)
 	monolog.DisableLevels(*disable_logs)
 }
 
+func logRotation() monolog.Rotation {
+	return monolog.Rotation{*log_max_size * 1024 * 1024, *log_rotate, *log_keep}
+}
+
 /* Need to restart the server or not? */
 var server_restart = true
 
 func runServer() (status int) {
-	monolog.Setup("woe.log", true, false)
+	monolog.SetupRotating("woe.log", logRotation(), true, false)
+	if *log_json != "" {
+		monolog.AddLogger(monolog.NewJSONLogger(*log_json, logRotation()))
+	}
+	var ring *monolog.RingLogger
+	if *log_ring > 0 {
+		ring = monolog.NewRingLogger(*log_ring)
+		monolog.AddLogger(ring, nil)
+	}
 	defer monolog.Close()
 	enableDisableLogs()
+	sitef.Backups = *backups
 	monolog.Info("Starting WOE server...")
 	monolog.Info("Server will run at %s.", *server_tcpip)
-	woe, err := server.NewServer(*server_tcpip)
+	woe, err := server.NewServer(*server_tcpip, *storage)
 	if err != nil {
 		monolog.Error("Could not initialize server!")
 		monolog.Error(err.Error())
 		panic(err)
 	}
+	woe.SetAutosave(*autosave)
+	woe.SetLogRing(ring)
 	monolog.Info("Server at %s init ok.", *server_tcpip)
 	defer woe.Close()
 	status, err = woe.Serve()
@@ -55,6 +85,7 @@ func runServer() (status int) {
 }
 
 func runSupervisor() (status int) {
+	// Only the server rotates the log, the supervisor follows it.
 	monolog.Setup("woe.log", true, false)
 	defer monolog.Close()
 	enableDisableLogs()
@@ -65,7 +96,16 @@ func runSupervisor() (status int) {
 		argp := fmt.Sprintf("-l=%s", *server_tcpip)
 		argel := fmt.Sprintf("-el=%s", *enable_logs)
 		argdl := fmt.Sprintf("-dl=%s", *disable_logs)
-		cmd := exec.Command(exe, "-s=true", argp, argel, argdl)
+		argbk := fmt.Sprintf("-backups=%d", *backups)
+		argst := fmt.Sprintf("-storage=%s", *storage)
+		argas := fmt.Sprintf("-autosave=%s", *autosave)
+		arglm := fmt.Sprintf("-log-max-size=%d", *log_max_size)
+		arglr := fmt.Sprintf("-log-rotate=%s", *log_rotate)
+		arglk := fmt.Sprintf("-log-keep=%d", *log_keep)
+		arglj := fmt.Sprintf("-log-json=%s", *log_json)
+		argrg := fmt.Sprintf("-log-ring=%d", *log_ring)
+		cmd := exec.Command(exe, "-s=true", argp, argel, argdl, argbk, argst, argas,
+			arglm, arglr, arglk, arglj, argrg)
 		monolog.Info("Starting server %s at %s.", exe, *server_tcpip)
 		cmd.Stderr = os.Stderr
 		cmd.Stdout = os.Stdout
@@ -81,6 +121,75 @@ func runSupervisor() (status int) {
 	return 0
 }
 
+/* Checks the syntax of all sitef files in data/var strictly, and reports
+ * the problems found. Returns 1 if there were any. */
+func runCheckData() (status int) {
+	files, problems := 0, 0
+	err := filepath.Walk(filepath.Join("data", "var"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".sitef") {
+			return nil
+		}
+		files++
+		if _, err := sitef.ParseFilenameStrict(path); err != nil {
+			if list, ok := err.(sitef.ErrorList); ok {
+				for _, problem := range list {
+					fmt.Println(problem.Error())
+				}
+				problems += len(list)
+			} else {
+				fmt.Println(err.Error())
+				problems++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Printf("Checked %d files, found %d problems.\n", files, problems)
+	if problems > 0 {
+		return 1
+	}
+	return 0
+}
+
+/* Copies all world data in data/var from one storage backend to another. */
+func runMigrate() (status int) {
+	dirname := filepath.Join("data", "var")
+	from, err := world.OpenStorage(*storage, dirname)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer from.Close()
+	to, err := world.OpenStorage(*migrate, dirname)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	copied, skipped, err := world.MigrateStorage(from, to)
+	if cerr := to.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Printf("Copied %d records from %s to %s storage.\n", copied, *storage, *migrate)
+	if len(skipped) > 0 {
+		fmt.Printf("Could not load %d records, the migration is incomplete:\n", len(skipped))
+		for _, name := range skipped {
+			fmt.Printf("\t%s\n", name)
+		}
+		return 1
+	}
+	return 0
+}
+
 func runRaku() (status int) {
 	lexer := raku.OpenLexer(os.Stdin)
 	_ = lexer
@@ -91,6 +200,8 @@ func runRaku() (status int) {
  * Server mode is the mode in which the real server is run. In supervisor mode,
  * woe runs a single woe server in server mode using os/exec. This is used to
  * be able to restart the server gracefully on recompile of the sources.
+ * With -check-data, woe only checks the data files and exits, and with
+ * -migrate it only copies the world data to another storage backend.
  */
 func main() {
 	defer func() {
@@ -102,7 +213,11 @@ func main() {
 	}()
 
 	flag.Parse()
-	if *server_mode {
+	if *check_data {
+		os.Exit(runCheckData())
+	} else if *migrate != "" {
+		os.Exit(runMigrate())
+	} else if *server_mode {
 		os.Exit(runServer())
 	} else if *raku_mode {
 		os.Exit(runRaku())
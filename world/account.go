@@ -5,6 +5,8 @@ import "github.com/beoran/woe/sitef"
 import "github.com/beoran/woe/monolog"
 import "fmt"
 import "errors"
+import "strconv"
+import "strings"
 
 type Privilege int
 
@@ -16,6 +18,36 @@ const (
     PRIVILEGE_IMPLEMENTOR
 )
 
+var PrivilegeNames = map[Privilege] string {
+    PRIVILEGE_ZERO          : "zero",
+    PRIVILEGE_NORMAL        : "normal",
+    PRIVILEGE_MASTER        : "master",
+    PRIVILEGE_LORD          : "lord",
+    PRIVILEGE_IMPLEMENTOR   : "implementor",
+}
+
+func (me Privilege) String() string {
+    name, ok := PrivilegeNames[me]
+    if ok {
+        return name
+    }
+    return strconv.Itoa(int(me))
+}
+
+// Parses a privilege by name or number.
+func ParsePrivilege(text string) (privilege Privilege, ok bool) {
+    for privilege, name := range PrivilegeNames {
+        if strings.EqualFold(name, text) {
+            return privilege, true
+        }
+    }
+    value, err := strconv.Atoi(text)
+    if err != nil {
+        return PRIVILEGE_ZERO, false
+    }
+    return Privilege(value), true
+}
+
 
 type Named struct {
     Name string
@@ -29,8 +61,14 @@ type Account struct {
     Email             string
     Points            int
     Privilege         Privilege
-    CharacterNames  []string
+    // Character set the player chose for their client, or "" to negotiate.
+    Charset           string
+    // True if the player turned off MSP sounds.
+    Mute              bool              `sitef:",omitempty"`
+    // Saved as the IDs of the characters.
+    CharacterNames  []string        `sitef:"-"`
     characters      [] * Character
+    Dirty
 }
 
 func SavePathForXML(dirname string, typename string, name string) string {
@@ -45,7 +83,7 @@ func SavePathFor(dirname string, typename string, name string) string {
 
 func NewAccount(name string, pass string, email string, points int) (*Account) {    
     hash := WoeCryptPassword(pass, "")
-    return &Account{name, hash, "woe", email, points, PRIVILEGE_NORMAL, nil, nil}    
+    return &Account{name, hash, "woe", email, points, PRIVILEGE_NORMAL, "", false, nil, nil, Dirty{}}    
     // return &Account{name, pass, "plain", email, points, PRIVILEGE_NORMAL, nil, nil}
 }
 
@@ -69,37 +107,43 @@ func (me * Account) Challenge(challenge string) bool {
 
 // Add a character to an account.
 func (me * Account) AddCharacter(chara * Character) {
+    me.Lock()
     me.characters = append(me.characters, chara)
+    me.Unlock()
+    me.MarkDirty()
 }
 
 
-// Save an account as a sitef file.
-func (me * Account) Save(dirname string) (err error) {
-    path := SavePathFor(dirname, "account", me.Name)
-    
-    rec                := sitef.NewRecord()
-    rec.Put("name",         me.Name)
-    rec.Put("hash",         me.Hash)
-    rec.Put("algo",         me.Algo)
-    rec.Put("email",        me.Email)
-    rec.PutInt("points",    me.Points)
-    rec.PutInt("privilege", int(me.Privilege))
-    rec.PutInt("characters",len(me.characters))
-    for i, chara   := range me.characters {
-        key        := fmt.Sprintf("characters[%d]", i)
-        rec.Put(key, chara.ID)
-        
+// Schema of account files.
+var AccountDescriptor = sitef.NewDescriptor("Account").WithKey("name").
+    WithMandatory("hash", "algo").
+    WithTypes("points,privilege,characters int", "mute bool", "characters[] line")
+
+// Save an account to storage.
+func (me * Account) Save(store Storage) (err error) {
+    rec, err := me.marshalClean(func() (* sitef.Record, error) {
+        rec, err           := sitef.Marshal(me)
+        if err != nil {
+            return nil, err
+        }
+        rec.PutInt("characters",len(me.characters))
+        for i, chara   := range me.characters {
+            key        := fmt.Sprintf("characters[%d]", i)
+            rec.Put(key, chara.ID)
+        }
+        return rec, nil
+    })
+    if err != nil {
+        return err
     }
-    monolog.Debug("Saving Acccount record: %s %v", path, rec)
-    return sitef.SaveRecord(path, *rec)
+    monolog.Debug("Saving Acccount record: %s %v", me.Name, rec)
+    return saveDescribed(store, "account", me.Name, AccountDescriptor, rec, &me.Dirty)
 }
 
-// Load an account from a sitef file.
-func LoadAccount(dirname string, name string) (account *Account, err error) {
-    
-    path := SavePathFor(dirname, "account", name)
+// Load an account from storage.
+func LoadAccount(store Storage, name string) (account *Account, err error) {
     
-    records, err := sitef.ParseFilename(path)
+    records, err := store.Load("account", name)
     if err != nil {
         return nil, err
     }
@@ -109,16 +153,13 @@ func LoadAccount(dirname string, name string) (account *Account, err error) {
     }
     
     record := records[0]
-    monolog.Info("Loading Account record: %s %v", path, record)
+    monolog.Info("Loading Account record: %s %v", name, record)
     
     account = new(Account)
-    account.Name            = record.Get("name")
-    account.Hash            = record.Get("hash")
-    account.Algo            = record.Get("algo")
-    account.Email           = record.Get("email")
-    account.Points          = record.GetIntDefault("points", 0)
-    account.Privilege       = Privilege(record.GetIntDefault("privilege", 
-                                int(PRIVILEGE_NORMAL)))
+    account.Privilege       = PRIVILEGE_NORMAL
+    if err = sitef.Unmarshal(*record, account); err != nil {
+        return nil, err
+    }
     
     nchars                 := record.GetIntDefault("characters", 0)
     account.characters      = make([] * Character, 0, nchars)
@@ -128,7 +169,7 @@ func LoadAccount(dirname string, name string) (account *Account, err error) {
         chid := record.GetArrayIndex("characters", index)
         monolog.Info("Loading character: %d %s\n", index, chid)
         
-        ch, err := account.LoadCharacter(dirname, chid);
+        ch, err := account.LoadCharacter(store, chid);
         if err != nil {
             monolog.Error("Could not load character %s: %s", chid, err.Error())
             // return nil, err
@@ -139,7 +180,7 @@ func LoadAccount(dirname string, name string) (account *Account, err error) {
     
     
     /* Todo: load characters here... */    
-    monolog.Info("Loaded Account: %s %v", path, account)
+    monolog.Info("Loaded Account: %s %v", name, account)
     return account, nil
 }
 
@@ -162,21 +203,23 @@ func (me * Account) FindCharacter(character * Character) (index int) {
 } 
 
 // Delete a character from this account.
-func (me * Account) DeleteCharacter(dirname string, character * Character) bool {
+func (me * Account) DeleteCharacter(store Storage, character * Character) bool {
     
     if i:= me.FindCharacter(character) ; i < 0 {
         monolog.Warning("Could not find character: %v %d", character, i)
         return false;  
     } else {
+        me.Lock()
         copy(me.characters[i:], me.characters[i+1:])
         newlen := len(me.characters) - 1 
         me.characters[newlen] = nil
         me.characters = me.characters[:newlen]
+        me.Unlock()
     }
     /// Save self so the deletion is correctly recorded.
-    me.Save(dirname)
+    me.Save(store)
     
-    return character.Delete(dirname)
+    return character.Delete(store)
 } 
 
 
@@ -0,0 +1,203 @@
+package world
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beoran/woe/monolog"
+	"github.com/beoran/woe/sitef"
+)
+
+/* Kinds of bans. */
+const (
+	BAN_ACCOUNT = "account"
+	BAN_ADDRESS = "address"
+)
+
+/* A ban of an account, or of an IP address or range in CIDR notation. */
+type Ban struct {
+	Kind   string
+	Target string
+	// Name of the account that made the ban.
+	By     string
+	Reason string
+	Time   time.Time
+	// Parsed IP range, for address bans.
+	network *net.IPNet
+}
+
+/* Makes a new ban. If the target is an IP address or range the ban is an
+ * address ban, otherwise it is an account ban. */
+func NewBan(target string, by string, reason string) *Ban {
+	ban := &Ban{BAN_ACCOUNT, target, by, reason, time.Now(), nil}
+	if network := ParseNetwork(target); network != nil {
+		ban.Kind = BAN_ADDRESS
+		ban.Target = network.String()
+		ban.network = network
+	}
+	return ban
+}
+
+/* Parses an IP address or range in CIDR notation. A single address is
+ * treated as a range of one address. Returns nil if it is neither. */
+func ParseNetwork(text string) *net.IPNet {
+	if _, network, err := net.ParseCIDR(text); err == nil {
+		return network
+	}
+	ip := net.ParseIP(text)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+/* Returns true if the ban matches the account name or IP address. */
+func (me *Ban) Matches(account string, address string) bool {
+	switch me.Kind {
+	case BAN_ACCOUNT:
+		return account != "" && strings.EqualFold(me.Target, account)
+	case BAN_ADDRESS:
+		ip := net.ParseIP(address)
+		return ip != nil && me.network != nil && me.network.Contains(ip)
+	}
+	return false
+}
+
+// Load a ban from a sitef record.
+func (me *Ban) LoadSitef(rec sitef.Record) (err error) {
+	me.Kind = rec.Get("kind")
+	me.Target = rec.Get("target")
+	me.By = rec.Get("by")
+	me.Reason = rec.Get("reason")
+	me.Time, err = time.Parse(time.RFC3339, rec.Get("time"))
+	if me.Kind == BAN_ADDRESS {
+		me.network = ParseNetwork(me.Target)
+	}
+	return err
+}
+
+// Save a ban to a sitef record.
+func (me *Ban) SaveSitef(rec *sitef.Record) (err error) {
+	rec.Put("kind", me.Kind)
+	rec.Put("target", me.Target)
+	rec.Put("by", me.By)
+	rec.Put("reason", me.Reason)
+	rec.Put("time", me.Time.Format(time.RFC3339))
+	return nil
+}
+
+/* The bans of a world. It is safe to use from several goroutines. */
+type BanList struct {
+	bans  []*Ban
+	mutex sync.RWMutex
+}
+
+func NewBanList() *BanList {
+	return &BanList{}
+}
+
+/* Adds a ban, replacing an existing ban of the same target. */
+func (me *BanList) Add(ban *Ban) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.remove(ban.Target)
+	me.bans = append(me.bans, ban)
+}
+
+/* Removes the ban of the target. Returns false if there was none. */
+func (me *BanList) Remove(target string) bool {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.remove(target)
+}
+
+func (me *BanList) remove(target string) bool {
+	if network := ParseNetwork(target); network != nil {
+		target = network.String()
+	}
+	for index, ban := range me.bans {
+		if strings.EqualFold(ban.Target, target) {
+			me.bans = append(me.bans[:index], me.bans[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/* Returns the first ban that matches the account name or IP address,
+ * or nil if they are not banned. */
+func (me *BanList) Find(account string, address string) *Ban {
+	if me == nil {
+		return nil
+	}
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+	for _, ban := range me.bans {
+		if ban.Matches(account, address) {
+			return ban
+		}
+	}
+	return nil
+}
+
+/* Returns a copy of all bans. */
+func (me *BanList) Bans() []*Ban {
+	if me == nil {
+		return nil
+	}
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+	return append([]*Ban(nil), me.bans...)
+}
+
+// Schema of the ban file.
+var BanDescriptor = sitef.NewDescriptor("Ban").WithKey("target").
+	WithMandatory("kind", "time").
+	WithTypes("kind enum "+BAN_ACCOUNT+" "+BAN_ADDRESS, "time date")
+
+// Saves the bans to storage, one ban per record.
+func (me *BanList) Save(store Storage) (err error) {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+	records := make(sitef.RecordList, 0, len(me.bans)+1)
+	records = append(records, BanDescriptor.Record())
+	for _, ban := range me.bans {
+		record := sitef.NewRecord()
+		ban.SaveSitef(record)
+		records = append(records, record)
+	}
+	return store.Save("ban", "bans", records)
+}
+
+// Loads the bans from storage. If there are none stored,
+// there are no bans.
+func LoadBanList(store Storage) (list *BanList, err error) {
+	list = NewBanList()
+	path := "ban/bans"
+
+	records, err := store.Load("ban", "bans")
+	if os.IsNotExist(err) {
+		return list, nil
+	} else if err != nil {
+		return list, err
+	}
+
+	for _, record := range records {
+		ban := &Ban{}
+		if err := ban.LoadSitef(*record); err != nil && ban.Target != "" {
+			monolog.Warning("Ban of %s in %s has no valid time: %v", ban.Target, path, err)
+		}
+		if ban.Target == "" {
+			continue
+		}
+		list.bans = append(list.bans, ban)
+	}
+	monolog.Info("Loaded %d bans from %s", len(list.bans), path)
+	return list, nil
+}
@@ -0,0 +1,52 @@
+package world
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestBanMatches(test *testing.T) {
+	cases := []struct {
+		target  string
+		account string
+		address string
+		matches bool
+	}{
+		{"Troll", "troll", "10.0.0.1", true},
+		{"Troll", "elf", "10.0.0.1", false},
+		{"10.0.0.0/8", "elf", "10.1.2.3", true},
+		{"10.0.0.0/8", "elf", "192.168.1.1", false},
+		{"192.168.1.1", "", "192.168.1.1", true},
+		{"2001:db8::/32", "", "2001:db8::1", true},
+	}
+	for _, c := range cases {
+		ban := NewBan(c.target, "lord", "test")
+		if ban.Matches(c.account, c.address) != c.matches {
+			test.Errorf("Ban %s matches %s %s: expected %v", c.target, c.account, c.address, c.matches)
+		}
+	}
+}
+
+// Run with -race to check that bans can be changed while they are used.
+func TestBanListConcurrent(test *testing.T) {
+	list := NewBanList()
+	var group sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		group.Add(1)
+		go func(worker int) {
+			defer group.Done()
+			for index := 0; index < 100; index++ {
+				target := fmt.Sprintf("troll%d", index%10)
+				list.Add(NewBan(target, "lord", "test"))
+				list.Find(target, "10.0.0.1")
+				list.Bans()
+				list.Remove(target)
+			}
+		}(worker)
+	}
+	group.Wait()
+	if bans := list.Bans(); len(bans) > 10 {
+		test.Errorf("Too many bans left: %d", len(bans))
+	}
+}
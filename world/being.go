@@ -797,11 +797,11 @@ type EquipmentValues struct {
 type Being struct {
 	Entity
 
-	// Essentials
-	*Gender
-	*Kin
-	*Job
-	Level int
+	// Essentials, saved by their ID.
+	*Gender `sitef:"-"`
+	*Kin    `sitef:"-"`
+	*Job    `sitef:"-"`
+	Level   int
 
 	// A being has talents.
 	Talents
@@ -810,7 +810,7 @@ type Being struct {
 	// A being has Equipment values
 	EquipmentValues
 	// A being has aptitudes
-	Aptitudes
+	Aptitudes `sitef:"-"`
 
 	// Skills       map[string]BeingSkill
 
@@ -820,13 +820,13 @@ type Being struct {
 	// Affects      []Affect
 
 	// Equipment
-	Equipment
+	Equipment `sitef:"-"`
 
 	// Inventory
-	Inventory
+	Inventory `sitef:"-"`
 
-	// Location pointer
-	Room *Room
+	// Location pointer, saved by its ID.
+	Room *Room `sitef:"-"`
 }
 
 var BasicTalent Talents = Talents{
@@ -1116,18 +1116,15 @@ func LoadBeing(datadir string, nameid string) *Being {
 }
 
 func (me *Talents) SaveSitef(rec *sitef.Record) (err error) {
-	rec.PutStruct("", *me)
-	return nil
+	return sitef.MarshalRecord(rec, me)
 }
 
 func (me *Vitals) SaveSitef(rec *sitef.Record) (err error) {
-	rec.PutStruct("", *me)
-	return nil
+	return sitef.MarshalRecord(rec, me)
 }
 
 func (me *EquipmentValues) SaveSitef(rec *sitef.Record) (err error) {
-	rec.PutStruct("", *me)
-	return nil
+	return sitef.MarshalRecord(rec, me)
 }
 
 func (me *Aptitudes) SaveSitef(rec *sitef.Record) (err error) {
@@ -1147,9 +1144,14 @@ func (me *Inventory) SaveSitef(rec *sitef.Record) (err error) {
 
 // Save a being to a sitef record.
 func (me *Being) SaveSitef(rec *sitef.Record) (err error) {
-	me.Entity.SaveSitef(rec)
-	rec.PutInt("level", me.Level)
+	if err = sitef.MarshalRecord(rec, me); err != nil {
+		return err
+	}
+	return me.SaveLinks(rec)
+}
 
+// Save the IDs of the things the being refers to into a sitef record.
+func (me *Being) SaveLinks(rec *sitef.Record) (err error) {
 	if me.Gender != nil {
 		rec.Put("gender", me.Gender.ID)
 	}
@@ -1162,9 +1164,6 @@ func (me *Being) SaveSitef(rec *sitef.Record) (err error) {
 		rec.Put("kin", me.Kin.ID)
 	}
 
-	me.Talents.SaveSitef(rec)
-	me.Vitals.SaveSitef(rec)
-	me.EquipmentValues.SaveSitef(rec)
 	me.Aptitudes.SaveSitef(rec)
 	me.Inventory.SaveSitef(rec)
 
@@ -1176,18 +1175,15 @@ func (me *Being) SaveSitef(rec *sitef.Record) (err error) {
 }
 
 func (me *Talents) LoadSitef(rec sitef.Record) (err error) {
-	rec.GetStruct("", me)
-	return nil
+	return sitef.Unmarshal(rec, me)
 }
 
 func (me *Vitals) LoadSitef(rec sitef.Record) (err error) {
-	rec.GetStruct("", me)
-	return nil
+	return sitef.Unmarshal(rec, me)
 }
 
 func (me *EquipmentValues) LoadSitef(rec sitef.Record) (err error) {
-	rec.GetStruct("", me)
-	return nil
+	return sitef.Unmarshal(rec, me)
 }
 
 func (me *Aptitudes) LoadSitef(rec sitef.Record) (err error) {
@@ -1202,17 +1198,19 @@ func (me *Inventory) LoadSitef(rec sitef.Record) (err error) {
 
 // Load a being from a sitef record.
 func (me *Being) LoadSitef(rec sitef.Record) (err error) {
-	me.Entity.LoadSitef(rec)
-
-	me.Level = rec.GetIntDefault("level", 1)
+	me.Level = 1
+	if err = sitef.Unmarshal(rec, me); err != nil {
+		return err
+	}
+	return me.LoadLinks(rec)
+}
 
+// Load the things the being refers to by ID from a sitef record.
+func (me *Being) LoadLinks(rec sitef.Record) (err error) {
 	me.Gender = EntitylikeToGender(GenderEntityList.FindID(rec.Get("gender")))
 	me.Job = EntitylikeToJob(JobEntityList.FindID(rec.Get("job")))
 	me.Kin = EntitylikeToKin(KinEntityList.FindID(rec.Get("kin")))
 
-	me.Talents.LoadSitef(rec)
-	me.Vitals.LoadSitef(rec)
-	me.EquipmentValues.LoadSitef(rec)
 	me.Aptitudes.LoadSitef(rec)
 	me.Inventory.LoadSitef(rec)
 
@@ -1,7 +1,9 @@
 package world
 
 import "fmt"
-import "os"
+import "regexp"
+import "sort"
+import "strings"
 // import "strconv"
 import "github.com/beoran/woe/monolog"
 import "github.com/beoran/woe/sitef"
@@ -11,12 +13,72 @@ import "github.com/beoran/woe/sitef"
 
 type Character struct {
     Being       
-    Account * Account
+    Account * Account           `sitef:"-"`
+    // Command aliases of the player, by alias name.
+    Aliases   map[string]string `sitef:"alias,omitempty"`
+    Dirty
 }
 
 
 func NewCharacterFromBeing(being Being, account * Account) (*Character) {
-    return &Character{being, account}
+    return &Character{being, account, nil, Dirty{}}
+}
+
+// Alias names are saved as alias[name], so they are restricted.
+var aliasNameRe = regexp.MustCompile("^[A-Za-z0-9_]+$")
+
+// Returns true if the name may be used for an alias.
+func ValidAliasName(name string) bool {
+    return aliasNameRe.MatchString(name)
+}
+
+// Sets an alias, or removes it if expansion is empty. Returns an error
+// if the name is not valid.
+func (me * Character) SetAlias(name string, expansion string) error {
+    me.Lock()
+    defer me.Unlock()
+    if expansion == "" {
+        if _, ok := me.Aliases[name] ; ok {
+            delete(me.Aliases, name)
+            me.MarkDirty()
+        }
+        return nil
+    }
+    if !ValidAliasName(name) {
+        return fmt.Errorf("alias name %q may only have letters, digits and _", name)
+    }
+    if me.Aliases == nil {
+        me.Aliases = make(map[string]string)
+    }
+    me.Aliases[name] = expansion
+    me.MarkDirty()
+    return nil
+}
+
+// Returns the names of the aliases of the character, sorted.
+func (me * Character) AliasNames() []string {
+    names := make([]string, 0, len(me.Aliases))
+    for name := range me.Aliases {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Load aliases that were saved as a list of "name expansion" pairs,
+// by older versions.
+func (me * Character) LoadAliases(rec sitef.Record) {
+    naliases := rec.GetIntDefault("aliases", 0)
+    for index := 0 ; index < naliases ; index++ {
+        parts := strings.SplitN(rec.GetArrayIndex("aliases", index), " ", 2)
+        if len(parts) < 2 {
+            monolog.Warning("Bad alias %d for %s: %v", index, me.ID, parts)
+            continue
+        }
+        if err := me.SetAlias(parts[0], parts[1]) ; err != nil {
+            monolog.Warning("Bad alias %d for %s: %v", index, me.ID, err)
+        }
+    }
 }
 
 func (me * Character) Init(account * Account, name string, 
@@ -35,8 +97,20 @@ func NewCharacter(account * Account, name string,
 // Save a character into a a sitef record.
 func (me * Character) SaveSirec(rec * sitef.Record) (err error) {
     rec.Put("accountname", me.Account.Name)
-    me.Being.SaveSitef(rec)
-    return nil
+    if err = sitef.MarshalRecord(rec, me); err != nil {
+        return err
+    }
+    return me.Being.SaveLinks(rec)
+}
+
+// Load the fields of a character from a sitef record.
+func (me * Character) loadSitef(rec sitef.Record) (err error) {
+    me.Level = 1
+    if err = sitef.Unmarshal(rec, me); err != nil {
+        return err
+    }
+    me.LoadAliases(rec)
+    return me.Being.LoadLinks(rec)
 }
 
 // Load a character from a sitef record.
@@ -47,28 +121,33 @@ func (me * Character) LoadSirec(rec sitef.Record) (err error) {
         return err
     } 
     me.Account = account
-    me.Being.LoadSitef(rec)
-    return nil
+    return me.loadSitef(rec)
 }
 
 
-// Save a character as a sitef file.
-func (me * Character) Save(dirname string) (err error) {
-    path := SavePathFor(dirname, "character", me.ID)
-    
-    rec                := sitef.NewRecord()
-    me.SaveSirec(rec)
-    monolog.Debug("Saving Character record: %s %v", path, rec)
-    return sitef.SaveRecord(path, *rec)
+// Schema of character files.
+var CharacterDescriptor = sitef.NewDescriptor("Character").WithKey("id").
+    WithMandatory("accountname", "name").
+    WithTypes("level,skills int", "alias[] line")
+
+// Save a character to storage.
+func (me * Character) Save(store Storage) (err error) {
+    rec, err := me.marshalClean(func() (* sitef.Record, error) {
+        rec            := sitef.NewRecord()
+        return rec, me.SaveSirec(rec)
+    })
+    if err != nil {
+        return err
+    }
+    monolog.Debug("Saving Character record: %s %v", me.ID, rec)
+    return saveDescribed(store, "character", me.ID, CharacterDescriptor, rec, &me.Dirty)
 }
 
 
-// Load a character from a sitef file. Does no account checking, but returns the account name.
-func LoadCharacter(dirname string, id string) (character *Character, aname string, err error) {
+// Load a character from storage. Does no account checking, but returns the account name.
+func LoadCharacter(store Storage, id string) (character *Character, aname string, err error) {
     
-    path := SavePathFor(dirname, "character", id)
-    
-    records, err := sitef.ParseFilename(path)
+    records, err := store.Load("character", id)
     if err != nil {
         return nil, "", err
     }
@@ -78,26 +157,28 @@ func LoadCharacter(dirname string, id string) (character *Character, aname strin
     }
     
     record := records[0]
-    monolog.Info("Loading Character record: %s %v", path, record)
+    monolog.Info("Loading Character record: %s %v", id, record)
     
     character               = new(Character)
     aname                   = record.Get("accountname")
-    character.Being.LoadSitef(*record);
+    if err = character.loadSitef(*record); err != nil {
+        return nil, aname, err
+    }
     
     return character, aname, nil
 }
 
-// Load a character WITH A GIVEN NAME from a sitef file. Does no account checking, but returns the account name.
-func LoadCharacterByName(dirname string, name string) (character *Character, aname string, err error) {
+// Load a character WITH A GIVEN NAME from storage. Does no account checking, but returns the account name.
+func LoadCharacterByName(store Storage, name string) (character *Character, aname string, err error) {
     id := EntityNameToID("character", name)
-    return LoadCharacter(dirname, id)
+    return LoadCharacter(store, id)
 }
 
 
-// Load an character from a sitef file for the given account.
-func (account * Account) LoadCharacter(dirname string, id string) (character *Character, err error) {
+// Load an character from storage for the given account.
+func (account * Account) LoadCharacter(store Storage, id string) (character *Character, err error) {
     
-    character, aname, err := LoadCharacter(dirname, id)
+    character, aname, err := LoadCharacter(store, id)
     if character == nil {
         return character, err
     }
@@ -114,13 +195,11 @@ func (account * Account) LoadCharacter(dirname string, id string) (character *Ch
 
 
 
-// Deletes the character itself from disk
-func (me * Character) Delete(dirname string) bool {
-    path := SavePathFor(dirname, "character", me.ID)
-    
-    if err := os.Remove(path) ; err != nil {
+// Deletes the character itself from storage
+func (me * Character) Delete(store Storage) bool {
+    if err := store.Remove("character", me.ID) ; err != nil {
         monolog.Warning("Could not delete character: %v %s: %s", 
-            me, path, err.Error())
+            me, me.ID, err.Error())
         return false
     }
     
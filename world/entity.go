@@ -2,6 +2,8 @@ package world
 import "strings"
 import "os"
 import "sort"
+import "sync"
+import "sync/atomic"
 import "encoding/xml"
 import "github.com/beoran/woe/sitef"
 
@@ -19,15 +21,72 @@ type Typed interface {
 }
 
 
+// Dirty tracks whether something changed since it was last saved, so
+// autosave only saves what changed. It is embedded in what is saved.
+// Autosave marshals on its own goroutine, so Dirty also has a lock, that
+// must be held while changing the saved fields and while marshalling them.
+// Mark the change dirty after making it, so a save that was already
+// marshalled doesn't mark it clean.
+type Dirty struct {
+    mutex               sync.Mutex
+    dirty               atomic.Bool
+}
+
+// Locks what Dirty is embedded in against saving it.
+func (me * Dirty) Lock() {
+    me.mutex.Lock()
+}
+
+// Unlocks what Dirty is embedded in.
+func (me * Dirty) Unlock() {
+    me.mutex.Unlock()
+}
+
+// Marks that something changed that still has to be saved.
+func (me * Dirty) MarkDirty() {
+    me.dirty.Store(true)
+}
+
+// Marks that everything was saved.
+func (me * Dirty) MarkClean() {
+    me.dirty.Store(false)
+}
+
+// Returns true if something changed since it was last saved.
+func (me * Dirty) IsDirty() bool {
+    return me.dirty.Load()
+}
+
+// Makes a change to the saved fields under the lock, then marks it dirty.
+func (me * Dirty) Change(change func()) {
+    me.Lock()
+    change()
+    me.Unlock()
+    me.MarkDirty()
+}
+
+// Marshals under the lock, with marshal. It is marked clean first, so a
+// change made after marshalling is saved the next time.
+func (me * Dirty) marshalClean(marshal func() (* sitef.Record, error)) (* sitef.Record, error) {
+    me.Lock()
+    defer me.Unlock()
+    me.MarkClean()
+    rec, err := marshal()
+    if err != nil {
+        me.MarkDirty()
+    }
+    return rec, err
+}
+
 // An entity is anything that can exist in a World
 type Entity struct {
-    ID                  string      `xml:"id,attr"`
+    ID                  string      `xml:"id,attr" sitef:"id"`
     Name                string      `xml:"name,attr"`
     Short               string      `xml:"short,attr"`
     Long                string
-    Aliases           []string    
+    Aliases           []string      `sitef:"-"`
     // Privilege level needed to use/interact with/enter/... this Entity
-    Privilege           Privilege
+    Privilege           Privilege   `sitef:",omitempty"`
 }
 
 
@@ -242,20 +301,12 @@ func (me * LabeledList) Index(index int) Labeled {
 
 // Save an entity to a sitef record.
 func (me * Entity) SaveSitef(rec * sitef.Record) (err error) {
-    rec.Put("id", me.ID)
-    rec.Put("name", me.Name)
-    rec.Put("short", me.Short)
-    rec.Put("long",  me.Long)
-    return nil
+    return sitef.MarshalRecord(rec, me)
 }
 
 // Load an entity from a sitef record.
 func (me * Entity) LoadSitef(rec sitef.Record) (err error) {
-    me.ID       = rec.Get("id")
-    me.Name     = rec.Get("name")
-    me.Short    = rec.Get("short")
-    me.Long     = rec.Get("long")
-    return nil
+    return sitef.Unmarshal(rec, me)
 }
 
 
@@ -0,0 +1,307 @@
+package world
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/beoran/woe/monolog"
+	"github.com/beoran/woe/sitef"
+)
+
+/* A help entry. It can be found by any of its keywords. */
+type Help struct {
+	Keywords []string
+	// Privilege needed to read this help entry.
+	Privilege Privilege
+	Body      string
+	// Keywords of related help entries.
+	SeeAlso []string
+}
+
+/* Help entries, indexed by their lower case keywords. */
+type HelpIndex struct {
+	helps    []*Help
+	keywords map[string]*Help
+}
+
+func NewHelpIndex() *HelpIndex {
+	return &HelpIndex{nil, make(map[string]*Help)}
+}
+
+/* Returns the first keyword, which is the name of the help entry. */
+func (me Help) AskName() string {
+	if len(me.Keywords) < 1 {
+		return ""
+	}
+	return me.Keywords[0]
+}
+
+/* Returns the first line of the body. */
+func (me Help) AskShort() string {
+	return strings.SplitN(me.Body, "\n", 2)[0]
+}
+
+func (me Help) AskLong() string {
+	return me.Body
+}
+
+func (me Help) AskPrivilege() Privilege {
+	return me.Privilege
+}
+
+/* Adds a help entry. Keywords that are already in use by an earlier entry
+ * are not overwritten, so entries from the help files have precedence over
+ * generated ones if they are added first. */
+func (me *HelpIndex) Add(help *Help) {
+	me.helps = append(me.helps, help)
+	for _, keyword := range help.Keywords {
+		keyword = strings.ToLower(keyword)
+		if _, ok := me.keywords[keyword]; ok {
+			monolog.Debug("Help keyword %s already in use.", keyword)
+			continue
+		}
+		me.keywords[keyword] = help
+	}
+}
+
+/* Returns the amount of help entries. */
+func (me *HelpIndex) Len() int {
+	if me == nil {
+		return 0
+	}
+	return len(me.helps)
+}
+
+/* Looks up the help entry for the topic. An exact keyword match is used
+ * first, otherwise a keyword that starts with the topic, as long as it is
+ * unambiguous. If it is ambiguous the matching keywords are returned as
+ * candidates. Only entries the privilege allows are considered. */
+func (me *HelpIndex) Lookup(topic string, privilege Privilege) (help *Help, candidates []string) {
+	if me == nil {
+		return nil, nil
+	}
+	topic = strings.ToLower(strings.TrimSpace(topic))
+	if topic == "" {
+		return nil, nil
+	}
+	if help, ok := me.keywords[topic]; ok && help.Privilege <= privilege {
+		return help, nil
+	}
+	var found []*Help
+	for _, keyword := range me.sortedKeywords() {
+		help := me.keywords[keyword]
+		if help.Privilege > privilege || !strings.HasPrefix(keyword, topic) {
+			continue
+		}
+		if helpIn(found, help) {
+			continue
+		}
+		found = append(found, help)
+		candidates = append(candidates, keyword)
+	}
+	if len(found) == 1 {
+		return found[0], nil
+	}
+	return nil, candidates
+}
+
+/* Searches for help entries with a keyword that contains the topic or is
+ * similar to it. Better matches are returned first. */
+func (me *HelpIndex) Search(topic string, privilege Privilege) (helps []*Help) {
+	if me == nil {
+		return nil
+	}
+	topic = strings.ToLower(strings.TrimSpace(topic))
+	if topic == "" {
+		return nil
+	}
+	limit := len(topic)/4 + 1
+	best := make(map[*Help]int)
+	for keyword, help := range me.keywords {
+		if help.Privilege > privilege {
+			continue
+		}
+		distance := EditDistance(topic, keyword)
+		if strings.Contains(keyword, topic) {
+			distance = 0
+		} else if distance > limit {
+			continue
+		}
+		if old, ok := best[help]; !ok || distance < old {
+			best[help] = distance
+		}
+	}
+	for help := range best {
+		helps = append(helps, help)
+	}
+	sort.Slice(helps, func(i, j int) bool {
+		if best[helps[i]] != best[helps[j]] {
+			return best[helps[i]] < best[helps[j]]
+		}
+		return helps[i].AskName() < helps[j].AskName()
+	})
+	return helps
+}
+
+func helpIn(helps []*Help, help *Help) bool {
+	for _, other := range helps {
+		if other == help {
+			return true
+		}
+	}
+	return false
+}
+
+func (me *HelpIndex) sortedKeywords() []string {
+	keywords := make([]string, 0, len(me.keywords))
+	for keyword := range me.keywords {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	return keywords
+}
+
+/* Returns the Levenshtein distance between two strings. */
+func EditDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	row := make([]int, len(rb)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			next := prev + cost
+			if row[j]+1 < next {
+				next = row[j] + 1
+			}
+			if row[j-1]+1 < next {
+				next = row[j-1] + 1
+			}
+			prev, row[j] = row[j], next
+		}
+	}
+	return row[len(rb)]
+}
+
+// Load a help entry from a sitef record. Keywords and see also are
+// separated by spaces.
+func (me *Help) LoadSitef(rec sitef.Record) (err error) {
+	me.Keywords = strings.Fields(rec.Get("keywords"))
+	me.Privilege = Privilege(rec.GetIntDefault("privilege", int(PRIVILEGE_ZERO)))
+	me.Body = strings.TrimSpace(rec.Get("body"))
+	me.SeeAlso = strings.Fields(rec.Get("see"))
+	return nil
+}
+
+// Something that help can be generated for, such as a skill or a kin.
+type HelpTopic interface {
+	AskName() string
+	AskShort() string
+	AskLong() string
+	AskPrivilege() Privilege
+}
+
+// Generates a help entry for the topic, with the kind as see also.
+func NewHelpFor(topic HelpTopic, kind string) *Help {
+	body := topic.AskShort()
+	if long := topic.AskLong(); long != "" && long != body {
+		body += "\n\n" + long
+	}
+	keywords := []string{topic.AskName()}
+	if strings.ContainsRune(topic.AskName(), ' ') {
+		keywords = append(keywords, strings.Replace(topic.AskName(), " ", "_", -1))
+	}
+	return &Help{keywords, topic.AskPrivilege(), body, []string{kind}}
+}
+
+// Generates a help entry that lists the topics of a kind, and one
+// entry for each of the topics.
+func (me *HelpIndex) AddGenerated(kind string, intro string, topics []HelpTopic) {
+	names := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if topic.AskName() == "" {
+			continue
+		}
+		names = append(names, topic.AskName())
+		me.Add(NewHelpFor(topic, kind))
+	}
+	body := intro + "\n\n" + strings.Join(names, ", ")
+	me.Add(&Help{[]string{kind}, PRIVILEGE_ZERO, body, nil})
+}
+
+// Generates help entries for the skills, techniques, arts, kins and jobs.
+func (me *HelpIndex) AddWoeDefaults() {
+	var topics []HelpTopic
+	for _, skill := range SkillList {
+		topics = append(topics, skill)
+	}
+	me.AddGenerated("skills", "The skills that beings can learn:", topics)
+
+	topics = nil
+	for _, technique := range TechniqueList {
+		topics = append(topics, technique)
+	}
+	me.AddGenerated("techniques", "The techniques that beings can use:", topics)
+
+	topics = nil
+	for _, art := range ArtList {
+		topics = append(topics, art)
+	}
+	me.AddGenerated("arts", "The arts that beings can use:", topics)
+
+	topics = nil
+	for _, kin := range KinList {
+		topics = append(topics, kin)
+	}
+	me.AddGenerated("kins", "The kins a character can be:", topics)
+
+	topics = nil
+	for _, job := range JobList {
+		topics = append(topics, job)
+	}
+	me.AddGenerated("jobs", "The jobs a character can have:", topics)
+}
+
+// Schema of the help file.
+var HelpDescriptor = sitef.NewDescriptor("Help").WithMandatory("keywords", "body").
+	WithTypes("privilege int")
+
+// Loads the help index from storage, one help entry per record,
+// and adds the generated help entries. If there is no help stored, only
+// the generated entries are available.
+func LoadHelpIndex(store Storage) (index *HelpIndex, err error) {
+	index = NewHelpIndex()
+	path := "help/help"
+
+	records, err := store.Load("help", "help")
+	if os.IsNotExist(err) {
+		monolog.Info("No help found at %s", path)
+		err = nil
+	} else if err != nil {
+		index.AddWoeDefaults()
+		return index, err
+	}
+
+	for _, record := range records {
+		help := &Help{}
+		help.LoadSitef(*record)
+		if len(help.Keywords) < 1 && help.Body == "" {
+			continue
+		} else if len(help.Keywords) < 1 || help.Body == "" {
+			monolog.Warning("Help without keywords or body in %s: %v", path, record)
+			continue
+		}
+		index.Add(help)
+	}
+	loaded := index.Len()
+	index.AddWoeDefaults()
+	monolog.Info("Loaded %d help entries from %s, %d generated", loaded, path, index.Len()-loaded)
+	return index, nil
+}
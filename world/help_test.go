@@ -0,0 +1,105 @@
+package world
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEditDistance(test *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"look", "look", 0},
+		{"", "look", 4},
+		{"look", "", 4},
+		{"lok", "look", 1},
+		{"loko", "look", 2},
+		{"kitten", "sitting", 3},
+		{"café", "cafe", 1},
+	}
+	for _, c := range cases {
+		if distance := EditDistance(c.a, c.b); distance != c.expected {
+			test.Errorf("EditDistance(%q, %q): %d, expected %d", c.a, c.b, distance, c.expected)
+		}
+	}
+}
+
+// Returns a help index with a few entries, one of them for lords only.
+func testHelpIndex() *HelpIndex {
+	index := NewHelpIndex()
+	index.Add(&Help{[]string{"Look", "examine"}, PRIVILEGE_ZERO, "Looking around.", nil})
+	index.Add(&Help{[]string{"login"}, PRIVILEGE_ZERO, "Logging in.", nil})
+	index.Add(&Help{[]string{"lord", "shutdown"}, PRIVILEGE_LORD, "For lords.", nil})
+	index.Add(&Help{[]string{"combat"}, PRIVILEGE_ZERO, "Fighting.", nil})
+	// The keyword look is already in use, so this one is found as looking.
+	index.Add(&Help{[]string{"look", "looking"}, PRIVILEGE_ZERO, "Generated.", nil})
+	return index
+}
+
+func TestHelpLookup(test *testing.T) {
+	index := testHelpIndex()
+	cases := []struct {
+		topic      string
+		privilege  Privilege
+		expected   string
+		candidates string
+	}{
+		{"look", PRIVILEGE_ZERO, "Looking around.", ""},
+		{" LOOK ", PRIVILEGE_ZERO, "Looking around.", ""},
+		{"exa", PRIVILEGE_ZERO, "Looking around.", ""},
+		{"looki", PRIVILEGE_ZERO, "Generated.", ""},
+		{"lo", PRIVILEGE_ZERO, "", "login look looking"},
+		{"lo", PRIVILEGE_LORD, "", "login look looking lord"},
+		{"lor", PRIVILEGE_ZERO, "", ""},
+		{"lor", PRIVILEGE_LORD, "For lords.", ""},
+		{"shutdown", PRIVILEGE_NORMAL, "", ""},
+		{"shutdown", PRIVILEGE_IMPLEMENTOR, "For lords.", ""},
+		{"", PRIVILEGE_ZERO, "", ""},
+		{"xyzzy", PRIVILEGE_ZERO, "", ""},
+	}
+	for _, c := range cases {
+		help, candidates := index.Lookup(c.topic, c.privilege)
+		body := ""
+		if help != nil {
+			body = help.Body
+		}
+		if body != c.expected || strings.Join(candidates, " ") != c.candidates {
+			test.Errorf("Lookup(%q, %s): %q %v, expected %q %q",
+				c.topic, c.privilege, body, candidates, c.expected, c.candidates)
+		}
+	}
+	var missing *HelpIndex
+	if help, _ := missing.Lookup("look", PRIVILEGE_ZERO); help != nil {
+		test.Errorf("Lookup on a nil index found %v", help)
+	}
+}
+
+func TestHelpSearch(test *testing.T) {
+	index := testHelpIndex()
+	cases := []struct {
+		topic     string
+		privilege Privilege
+		expected  string
+	}{
+		{"ok", PRIVILEGE_ZERO, "Look look"},
+		{"lokk", PRIVILEGE_ZERO, "Look"},
+		{"combta", PRIVILEGE_ZERO, "combat"},
+		{"lrd", PRIVILEGE_ZERO, ""},
+		{"lrd", PRIVILEGE_LORD, "lord"},
+		{"down", PRIVILEGE_NORMAL, ""},
+		{"down", PRIVILEGE_LORD, "lord"},
+		{"zzzzzz", PRIVILEGE_ZERO, ""},
+		{"", PRIVILEGE_ZERO, ""},
+	}
+	for _, c := range cases {
+		names := []string{}
+		for _, help := range index.Search(c.topic, c.privilege) {
+			names = append(names, help.AskName())
+		}
+		if strings.Join(names, " ") != c.expected {
+			test.Errorf("Search(%q, %s): %v, expected %q", c.topic, c.privilege, names, c.expected)
+		}
+	}
+}
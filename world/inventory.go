@@ -8,3 +8,8 @@ type Inventory struct {
 }
 
 
+// Returns the items in the inventory.
+func (me * Inventory) Items() [] * Item {
+    return me.items
+}
+
@@ -199,14 +199,29 @@ type Item struct {
     Teaches       string
      // ID of skill needed to craft this item   
     Craft         string
+    Dirty
 }
 
-// Load an item from a sitef file.
-func LoadItem(dirname string, id string) (item *Item, err error) {
-    
-    path := SavePathFor(dirname, "item", id)
+// Schema of item files.
+var ItemDescriptor = sitef.NewDescriptor("Item").WithKey("id").
+    WithMandatory("name").WithTypes("price,level,quality int")
+
+// Save an item to storage.
+func (me * Item) Save(store Storage) (err error) {
+    rec, err := me.marshalClean(func() (* sitef.Record, error) {
+        return sitef.Marshal(me)
+    })
+    if err != nil {
+        return err
+    }
+    monolog.Debug("Saving Item record: %s %v", me.ID, rec)
+    return saveDescribed(store, "item", me.ID, ItemDescriptor, rec, &me.Dirty)
+}
+
+// Load an item from storage.
+func LoadItem(store Storage, id string) (item *Item, err error) {
     
-    records, err := sitef.ParseFilename(path)
+    records, err := store.Load("item", id)
     if err != nil {
         return nil, err
     }
@@ -216,29 +231,16 @@ func LoadItem(dirname string, id string) (item *Item, err error) {
     }
     
     record := records[0]
-    monolog.Info("Loading Item record: %s %v", path, record)
+    monolog.Info("Loading Item record: %s %v", id, record)
     
     item            = new(Item)
-    item.Entity.LoadSitef(*record)
-    item.Quality    = record.GetIntDefault("quality", 0)
-    item.Price      = record.GetIntDefault("price", -1)
-    item.Level      = record.GetIntDefault("level", -1)
-    item.Kind       = ItemKind(record.Get("kind"))
-    item.Damage     = DamageKind(record.Get("damage"))
-    item.Equip      = EquipWhere(record.Get("equip"))
-    item.Upgrade    = record.Get("upgrade")
-    item.Degrade    = record.Get("degrade")
-    item.Teaches    = record.Get("teaches")
-    item.Craft      = record.Get("craft")
-    
-    ningredients   := record.GetIntDefault("ingredients", 0)
-    
-    for i := 0; i < ningredients; i++ {
-        ingr := record.GetArrayIndex("ingredients", i)
-        item.Ingredients = append(item.Ingredients, ingr) 
+    item.Price      = -1
+    item.Level      = -1
+    if err = sitef.Unmarshal(*record, item); err != nil {
+        return nil, err
     }
     
-    monolog.Info("Loaded Item: %s %v", path, item)
+    monolog.Info("Loaded Item: %s %v", id, item)
     return item, nil
 }
 
@@ -2,30 +2,102 @@ package world
 
 import "github.com/beoran/woe/sitef"
 import "github.com/beoran/woe/monolog"
-// import "fmt"
 import "errors"
+import "sort"
+import "strings"
 
 
 
 type Direction  string
 
+const (
+    DIRECTION_NORTH     = Direction("north")
+    DIRECTION_EAST      = Direction("east")
+    DIRECTION_SOUTH     = Direction("south")
+    DIRECTION_WEST      = Direction("west")
+    DIRECTION_NORTHEAST = Direction("northeast")
+    DIRECTION_SOUTHEAST = Direction("southeast")
+    DIRECTION_SOUTHWEST = Direction("southwest")
+    DIRECTION_NORTHWEST = Direction("northwest")
+    DIRECTION_UP        = Direction("up")
+    DIRECTION_DOWN      = Direction("down")
+)
+
+// The opposite of each direction, for two way exits.
+var OppositeDirections = map[Direction] Direction {
+    DIRECTION_NORTH     : DIRECTION_SOUTH,
+    DIRECTION_EAST      : DIRECTION_WEST,
+    DIRECTION_SOUTH     : DIRECTION_NORTH,
+    DIRECTION_WEST      : DIRECTION_EAST,
+    DIRECTION_NORTHEAST : DIRECTION_SOUTHWEST,
+    DIRECTION_SOUTHEAST : DIRECTION_NORTHWEST,
+    DIRECTION_SOUTHWEST : DIRECTION_NORTHEAST,
+    DIRECTION_NORTHWEST : DIRECTION_SOUTHEAST,
+    DIRECTION_UP        : DIRECTION_DOWN,
+    DIRECTION_DOWN      : DIRECTION_UP,
+}
+
+// Short forms of the directions.
+var DirectionAbbreviations = map[string] Direction {
+    "n"  : DIRECTION_NORTH,
+    "e"  : DIRECTION_EAST,
+    "s"  : DIRECTION_SOUTH,
+    "w"  : DIRECTION_WEST,
+    "ne" : DIRECTION_NORTHEAST,
+    "se" : DIRECTION_SOUTHEAST,
+    "sw" : DIRECTION_SOUTHWEST,
+    "nw" : DIRECTION_NORTHWEST,
+    "u"  : DIRECTION_UP,
+    "d"  : DIRECTION_DOWN,
+}
+
+// Parses a direction or its short form. 
+func ParseDirection(text string) (direction Direction, ok bool) {
+    text = strings.ToLower(text)
+    if direction, ok = DirectionAbbreviations[text]; ok {
+        return direction, ok
+    }
+    direction = Direction(text)
+    _, ok = OppositeDirections[direction]
+    return direction, ok
+}
+
+// Returns the opposite direction, or "" if there is none.
+func (me Direction) Opposite() Direction {
+    return OppositeDirections[me]
+}
+
 type Exit struct {
     Direction
-    ToRoomID    int
+    ToRoomID    string
     toRoom    * Room
 }
 
+// Exits are saved as the ID of the room they lead to.
+func (me Exit) MarshalText() ([]byte, error) {
+    return []byte(me.ToRoomID), nil
+}
+
+func (me * Exit) UnmarshalText(text []byte) error {
+    me.ToRoomID = strings.TrimSpace(string(text))
+    return nil
+}
+
 type Room struct {
     Entity
-    Exits   map[Direction]Exit
+    // Saved as exits[direction]:roomid
+    Exits   map[Direction]Exit  `sitef:"exits"`
+    // ID of the zone the room is in, used for zone specific sounds.
+    ZoneID  string              `sitef:"zone"`
+    Dirty
 }
 
-// Load a room from a sitef file.
-func LoadRoom(dirname string, id string) (room * Room, err error) {
+// Load a room from storage.
+func LoadRoom(store Storage, id string) (room * Room, err error) {
     
-    path := SavePathFor(dirname, "room", id)
+    path := "room/" + id
     
-    records, err := sitef.ParseFilename(path)
+    records, err := store.Load("room", id)
     if err != nil {
         return nil, err
     }
@@ -38,7 +110,9 @@ func LoadRoom(dirname string, id string) (room * Room, err error) {
     monolog.Info("Loading Room record: %s %v", path, record)
     
     room = new(Room)
-    room.Entity.LoadSitef(*record)
+    if err = room.LoadSitef(*record); err != nil {
+        return nil, err
+    }
     /*
     account.Name            = record.Get("name")
     account.Hash            = record.Get("hash")
@@ -55,3 +129,93 @@ func LoadRoom(dirname string, id string) (room * Room, err error) {
     monolog.Info("Loaded Room: %s %v", path, room)
     return room, nil
 }
+
+// Makes a new room in the zone.
+func NewRoom(id string, name string, zoneid string) (* Room) {
+    room       := &Room{}
+    room.ID     = id
+    room.Name   = name
+    room.Short  = name
+    room.Long   = name
+    room.ZoneID = zoneid
+    room.Exits  = make(map[Direction]Exit)
+    return room
+}
+
+// Sets an exit to another room, replacing any exit in that direction.
+func (me * Room) SetExit(direction Direction, to * Room) {
+    me.Lock()
+    if me.Exits == nil {
+        me.Exits = make(map[Direction]Exit)
+    }
+    me.Exits[direction] = Exit{direction, to.ID, to}
+    me.Unlock()
+    me.MarkDirty()
+}
+
+// Removes the exit in the direction. Returns false if there was none.
+func (me * Room) RemoveExit(direction Direction) bool {
+    me.Lock()
+    _, ok := me.Exits[direction]
+    delete(me.Exits, direction)
+    me.Unlock()
+    if ok {
+        me.MarkDirty()
+    }
+    return ok
+}
+
+// Returns the directions of the exits, sorted.
+func (me * Room) ExitDirections() []string {
+    directions := make([]string, 0, len(me.Exits))
+    for direction := range me.Exits {
+        directions = append(directions, string(direction))
+    }
+    sort.Strings(directions)
+    return directions
+}
+
+// Returns the room the exit leads to, loading it if needed.
+func (me * Exit) ToRoom(world * World) (room * Room, err error) {
+    if me.toRoom == nil {
+        me.toRoom, err = world.LoadRoom(me.ToRoomID)
+    }
+    return me.toRoom, err
+}
+
+// Load a room from a sitef record.
+func (me * Room) LoadSitef(rec sitef.Record) (err error) {
+    if err = sitef.Unmarshal(rec, me); err != nil {
+        return err
+    }
+    if me.Exits == nil {
+        me.Exits = make(map[Direction]Exit)
+    }
+    for direction, exit := range me.Exits {
+        exit.Direction = direction
+        me.Exits[direction] = exit
+    }
+    return nil
+}
+
+// Saves the room to a sitef record.
+func (me * Room) SaveSitef(rec * sitef.Record) (err error) {
+    return sitef.MarshalRecord(rec, me)
+}
+
+// Schema of room files.
+var RoomDescriptor = sitef.NewDescriptor("Room").WithKey("id").
+    WithMandatory("name").WithTypes("zone,exits[] line")
+
+// Saves the room to storage.
+func (me * Room) Save(store Storage) (err error) {
+    rec, err := me.marshalClean(func() (* sitef.Record, error) {
+        rec  := sitef.NewRecord()
+        return rec, me.SaveSitef(rec)
+    })
+    if err != nil {
+        return err
+    }
+    monolog.Debug("Saving Room record: %s %v", me.ID, rec)
+    return saveDescribed(store, "room", me.ID, RoomDescriptor, rec, &me.Dirty)
+}
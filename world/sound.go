@@ -0,0 +1,124 @@
+package world
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/beoran/woe/monolog"
+	"github.com/beoran/woe/sitef"
+)
+
+/* Sound events that can be played for the player, for example with MSP.
+ * Combat and weather sounds will be added together with combat and
+ * weather. */
+const (
+	SOUND_EVENT_CHANNEL = "channel"
+	SOUND_EVENT_ENTER   = "enter"
+)
+
+/* A sound or music that is played for an event in a zone.
+ * A sound with an empty zone is the default for all zones. */
+type Sound struct {
+	Zone  string
+	Event string
+	// File name of the sound, relative to the sound directory of the client.
+	File string
+	// True if this is background music in stead of a sound effect.
+	Music bool
+	// Volume in % and priority from 0 to 100, -1 if not set.
+	Volume   int
+	Priority int
+	// Amount of times to play, -1 for looping forever, 0 if not set.
+	Loops int
+	// Sound type or subdirectory, for example "combat" or "weather".
+	Kind string
+	// URL where the client can download the sound if it doesn't have it.
+	URL string
+}
+
+/* Sounds indexed by zone and event. */
+type SoundTable struct {
+	sounds map[string]map[string]Sound
+}
+
+func NewSoundTable() *SoundTable {
+	return &SoundTable{make(map[string]map[string]Sound)}
+}
+
+func (me *SoundTable) Add(sound Sound) {
+	events, ok := me.sounds[sound.Zone]
+	if !ok {
+		events = make(map[string]Sound)
+		me.sounds[sound.Zone] = events
+	}
+	events[sound.Event] = sound
+}
+
+/* Looks up the sound for the event in the zone. Falls back to the default
+ * sound for the event if the zone has none. */
+func (me *SoundTable) Lookup(zone string, event string) (sound Sound, ok bool) {
+	if me == nil {
+		return sound, false
+	}
+	if events, have := me.sounds[zone]; have {
+		if sound, ok = events[event]; ok {
+			return sound, ok
+		}
+	}
+	if events, have := me.sounds[""]; have {
+		sound, ok = events[event]
+	}
+	return sound, ok
+}
+
+/* Returns the amount of sounds in the table. */
+func (me *SoundTable) Len() int {
+	count := 0
+	for _, events := range me.sounds {
+		count += len(events)
+	}
+	return count
+}
+
+// Load a sound from a sitef record.
+func (me *Sound) LoadSitef(rec sitef.Record) (err error) {
+	me.Zone = rec.Get("zone")
+	me.Event = rec.Get("event")
+	me.File = rec.Get("file")
+	me.Music, _ = strconv.ParseBool(rec.Get("music"))
+	me.Volume = rec.GetIntDefault("volume", -1)
+	me.Priority = rec.GetIntDefault("priority", -1)
+	me.Loops = rec.GetIntDefault("loops", 0)
+	me.Kind = rec.Get("kind")
+	me.URL = rec.Get("url")
+	return nil
+}
+
+// Loads the sound table from storage, one sound per record.
+// If there is none stored, an empty table is returned.
+func LoadSoundTable(store Storage) (table *SoundTable, err error) {
+	table = NewSoundTable()
+	path := "sound/sounds"
+
+	records, err := store.Load("sound", "sounds")
+	if os.IsNotExist(err) {
+		monolog.Info("No sound table found at %s", path)
+		return table, nil
+	} else if err != nil {
+		return table, err
+	}
+
+	for _, record := range records {
+		var sound Sound
+		sound.LoadSitef(*record)
+		if sound.Event == "" && sound.File == "" {
+			continue
+		} else if sound.Event == "" || sound.File == "" {
+			monolog.Warning("Sound without event or file in %s: %v", path, record)
+			continue
+		}
+		table.Add(sound)
+	}
+	monolog.Info("Loaded %d sounds from %s", table.Len(), path)
+	return table, nil
+}
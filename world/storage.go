@@ -0,0 +1,258 @@
+package world
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/beoran/woe/kv"
+	"github.com/beoran/woe/monolog"
+	"github.com/beoran/woe/sitef"
+)
+
+/* Storage keeps the sitef records of the world, by kind and ID. The kind
+ * is the type of data, such as "account" or "room". Loaders and savers
+ * only marshal the records, so they work with every Storage. Load returns
+ * an error for which os.IsNotExist is true if there are no such records. */
+type Storage interface {
+	Load(kind string, id string) (sitef.RecordList, error)
+	Save(kind string, id string, records sitef.RecordList) error
+	Remove(kind string, id string) error
+	// Returns the IDs of all records of the kind, sorted.
+	IDs(kind string) ([]string, error)
+	// Returns when the records were last saved.
+	Modified(kind string, id string) (time.Time, error)
+	Close() error
+}
+
+/* The kinds of data that are kept in storage. */
+var StorageKinds = []string{
+	"world", "account", "character", "item", "room", "zone", "ban", "help", "sound",
+}
+
+/* Names of the storage backends, for OpenStorage. */
+const (
+	STORAGE_FILES = "files"
+	STORAGE_KV    = "kv"
+)
+
+// File name of the key-value store in the data directory.
+const KV_FILENAME = "woe.kv"
+
+func notExist(kind string, id string) error {
+	return &os.PathError{Op: "load", Path: kind + "/" + id, Err: os.ErrNotExist}
+}
+
+/* Storage with one sitef file per ID, in a directory per kind. */
+type FileStorage struct {
+	dirname string
+}
+
+func NewFileStorage(dirname string) *FileStorage {
+	return &FileStorage{dirname}
+}
+
+func (me *FileStorage) Load(kind string, id string) (sitef.RecordList, error) {
+	return sitef.ParseFilename(SavePathFor(me.dirname, kind, id))
+}
+
+func (me *FileStorage) Save(kind string, id string, records sitef.RecordList) error {
+	path := SavePathFor(me.dirname, kind, id)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return sitef.SaveRecordList(path, records)
+}
+
+func (me *FileStorage) Remove(kind string, id string) error {
+	return os.Remove(SavePathFor(me.dirname, kind, id))
+}
+
+func (me *FileStorage) IDs(kind string) (ids []string, err error) {
+	paths, err := filepath.Glob(SavePathFor(me.dirname, kind, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(path), ".sitef"))
+	}
+	return ids, nil
+}
+
+func (me *FileStorage) Modified(kind string, id string) (time.Time, error) {
+	info, err := os.Stat(SavePathFor(me.dirname, kind, id))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Sets when the records were last saved, by changing the time of the file.
+func (me *FileStorage) SetModified(kind string, id string, modified time.Time) error {
+	return os.Chtimes(SavePathFor(me.dirname, kind, id), modified, modified)
+}
+
+func (me *FileStorage) Close() error {
+	return nil
+}
+
+/* Storage in a single key-value store file. The records are kept as sitef
+ * text under the key kind/id, and the time they were saved under
+ * the key time/kind/id. */
+type KVStorage struct {
+	store *kv.Store
+}
+
+func OpenKVStorage(path string) (*KVStorage, error) {
+	store, err := kv.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &KVStorage{store}, nil
+}
+
+func (me *KVStorage) Load(kind string, id string) (sitef.RecordList, error) {
+	value, ok := me.store.Get(kind + "/" + id)
+	if !ok {
+		return nil, notExist(kind, id)
+	}
+	parser := sitef.NewParser(kind+"/"+id, false)
+	return parser.Parse(bytes.NewReader(value))
+}
+
+func (me *KVStorage) Save(kind string, id string, records sitef.RecordList) error {
+	var buffer bytes.Buffer
+	if err := sitef.WriteRecordList(&buffer, records); err != nil {
+		return err
+	}
+	if err := me.store.Put(kind+"/"+id, buffer.Bytes()); err != nil {
+		return err
+	}
+	now := time.Now().Format(time.RFC3339)
+	return me.store.Put("time/"+kind+"/"+id, []byte(now))
+}
+
+func (me *KVStorage) Remove(kind string, id string) error {
+	if _, ok := me.store.Get(kind + "/" + id); !ok {
+		return notExist(kind, id)
+	}
+	if err := me.store.Delete(kind + "/" + id); err != nil {
+		return err
+	}
+	return me.store.Delete("time/" + kind + "/" + id)
+}
+
+func (me *KVStorage) IDs(kind string) (ids []string, err error) {
+	for _, key := range me.store.Keys(kind + "/") {
+		ids = append(ids, strings.TrimPrefix(key, kind+"/"))
+	}
+	return ids, nil
+}
+
+func (me *KVStorage) Modified(kind string, id string) (time.Time, error) {
+	value, ok := me.store.Get("time/" + kind + "/" + id)
+	if !ok {
+		return time.Time{}, notExist(kind, id)
+	}
+	return time.Parse(time.RFC3339, string(value))
+}
+
+// Sets when the records were last saved.
+func (me *KVStorage) SetModified(kind string, id string, modified time.Time) error {
+	return me.store.Put("time/"+kind+"/"+id, []byte(modified.Format(time.RFC3339)))
+}
+
+func (me *KVStorage) Close() error {
+	return me.store.Close()
+}
+
+/* Saves a record after its descriptor, so the data declares its schema.
+ * Dirty was marked clean when the record was marshalled, so if it isn't
+ * nil it is marked dirty again when the save fails. */
+func saveDescribed(store Storage, kind string, id string, descriptor *sitef.Descriptor,
+	record *sitef.Record, dirty *Dirty) error {
+	err := store.Save(kind, id, sitef.RecordList{descriptor.Record(), record})
+	if err != nil && dirty != nil {
+		dirty.MarkDirty()
+	}
+	return err
+}
+
+/* Opens the storage backend with the given name for the data directory. */
+func OpenStorage(backend string, dirname string) (Storage, error) {
+	switch backend {
+	case STORAGE_FILES:
+		return NewFileStorage(dirname), nil
+	case STORAGE_KV:
+		return OpenKVStorage(filepath.Join(dirname, KV_FILENAME))
+	}
+	return nil, fmt.Errorf("unknown storage backend %s", backend)
+}
+
+/* The descriptors of the kinds of data. Loading drops the descriptors,
+ * so they are added again when data is copied. */
+func KindDescriptor(kind string) *sitef.Descriptor {
+	switch kind {
+	case "world":
+		return WorldDescriptor
+	case "account":
+		return AccountDescriptor
+	case "character":
+		return CharacterDescriptor
+	case "item":
+		return ItemDescriptor
+	case "room":
+		return RoomDescriptor
+	case "zone":
+		return ZoneDescriptor
+	case "ban":
+		return BanDescriptor
+	case "help":
+		return HelpDescriptor
+	}
+	return nil
+}
+
+/* Storage that can set when records were last saved. */
+type ModifiedSetter interface {
+	SetModified(kind string, id string, modified time.Time) error
+}
+
+/* Copies all data from one storage to another, keeping the times they
+ * were last saved if the target can set them. Returns how many IDs were
+ * copied. Records that can't be loaded are skipped, so one damaged file
+ * doesn't stop the migration, and returned as "kind id" in skipped. The
+ * migration is only complete if skipped is empty. */
+func MigrateStorage(from Storage, to Storage) (copied int, skipped []string, err error) {
+	for _, kind := range StorageKinds {
+		ids, err := from.IDs(kind)
+		if err != nil {
+			return copied, skipped, err
+		}
+		for _, id := range ids {
+			records, err := from.Load(kind, id)
+			if err != nil {
+				monolog.Error("Could not migrate %s %s: %v", kind, id, err)
+				skipped = append(skipped, kind+" "+id)
+				continue
+			}
+			if descriptor := KindDescriptor(kind); descriptor != nil {
+				records = append(sitef.RecordList{descriptor.Record()}, records...)
+			}
+			if err = to.Save(kind, id, records); err != nil {
+				return copied, skipped, err
+			}
+			setter, ok := to.(ModifiedSetter)
+			if modified, merr := from.Modified(kind, id); ok && merr == nil {
+				if err = setter.SetModified(kind, id, modified); err != nil {
+					return copied, skipped, err
+				}
+			}
+			copied++
+		}
+	}
+	return copied, skipped, nil
+}
@@ -0,0 +1,92 @@
+package world
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Copies the data from files to a key-value store and back to files, and
+// checks that the records and the times they were saved survive.
+func TestMigrateStorage(test *testing.T) {
+	dirname := test.TempDir()
+	files := NewFileStorage(filepath.Join(dirname, "from"))
+	account := NewAccount("alice", "secret", "alice@example.com", 7)
+	account.Privilege = PRIVILEGE_LORD
+	room := NewRoom("town_square", "Town Square", "town")
+	room.Long = "A busy square.\nWith two lines."
+	if err := account.Save(files); err != nil {
+		test.Fatalf("Save account: %v", err)
+	}
+	if err := room.Save(files); err != nil {
+		test.Fatalf("Save room: %v", err)
+	}
+	saved := time.Date(2016, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, kind := range []string{"account", "room"} {
+		id := map[string]string{"account": "alice", "room": "town_square"}[kind]
+		if err := files.SetModified(kind, id, saved); err != nil {
+			test.Fatalf("SetModified: %v", err)
+		}
+	}
+
+	store, err := OpenKVStorage(filepath.Join(dirname, KV_FILENAME))
+	if err != nil {
+		test.Fatalf("OpenKVStorage: %v", err)
+	}
+	defer store.Close()
+	back := NewFileStorage(filepath.Join(dirname, "back"))
+	if copied, skipped, err := MigrateStorage(files, store); err != nil || copied != 2 || skipped != nil {
+		test.Fatalf("MigrateStorage to kv: %d %v %v", copied, skipped, err)
+	}
+	if copied, skipped, err := MigrateStorage(store, back); err != nil || copied != 2 || skipped != nil {
+		test.Fatalf("MigrateStorage to files: %d %v %v", copied, skipped, err)
+	}
+
+	for _, target := range []Storage{store, back} {
+		loaded, err := LoadAccount(target, "alice")
+		if err != nil {
+			test.Fatalf("LoadAccount: %v", err)
+		}
+		if loaded.Name != "alice" || loaded.Hash != account.Hash || loaded.Email != account.Email ||
+			loaded.Points != 7 || loaded.Privilege != PRIVILEGE_LORD {
+			test.Errorf("Wrong account %+v, expected %+v", loaded, account)
+		}
+		loadedRoom, err := LoadRoom(target, "town_square")
+		if err != nil {
+			test.Fatalf("LoadRoom: %v", err)
+		}
+		if loadedRoom.Name != room.Name || loadedRoom.Long != room.Long || loadedRoom.ZoneID != "town" {
+			test.Errorf("Wrong room %+v, expected %+v", loadedRoom, room)
+		}
+		for _, kind := range []string{"account", "room"} {
+			ids, _ := target.IDs(kind)
+			if len(ids) != 1 {
+				test.Fatalf("Wrong %s IDs %v", kind, ids)
+			}
+			if modified, err := target.Modified(kind, ids[0]); err != nil || !modified.Equal(saved) {
+				test.Errorf("Wrong modification time of %s %s: %v %v", kind, ids[0], modified, err)
+			}
+		}
+	}
+}
+
+// A record that can't be loaded is skipped, but it must be reported.
+func TestMigrateStorageSkipped(test *testing.T) {
+	dirname := test.TempDir()
+	files := NewFileStorage(filepath.Join(dirname, "from"))
+	if err := NewAccount("alice", "secret", "alice@example.com", 7).Save(files); err != nil {
+		test.Fatalf("Save account: %v", err)
+	}
+	// A directory where a file should be can't be read.
+	if err := os.MkdirAll(SavePathFor(files.dirname, "account", "bob"), 0700); err != nil {
+		test.Fatalf("MkdirAll: %v", err)
+	}
+
+	back := NewFileStorage(filepath.Join(dirname, "back"))
+	copied, skipped, err := MigrateStorage(files, back)
+	if err != nil || copied != 1 || !reflect.DeepEqual(skipped, []string{"account bob"}) {
+		test.Errorf("MigrateStorage: %d %v %v", copied, skipped, err)
+	}
+}
@@ -3,6 +3,9 @@ package world
 import "github.com/beoran/woe/monolog"
 import "github.com/beoran/woe/sitef"
 import "errors"
+import "fmt"
+import "sort"
+import "sync"
 
 /* Elements of the WOE game world.  
  * Only Zones, Rooms and their Exits, Items, 
@@ -15,7 +18,7 @@ import "errors"
 type World struct {
     Name                      string
     MOTD                      string
-    dirname                   string
+    storage                   Storage
     entitymap       map[string] * Entity
     zonemap         map[string] * Zone
     zones                [] * Zone
@@ -29,6 +32,12 @@ type World struct {
     mobiles              []   Mobile
     accounts             [] * Account
     accountmap      map[string] * Account
+    sounds              * SoundTable
+    helps               * HelpIndex
+    bans                * BanList
+    // Guards the maps of what is loaded, since the clients and the
+    // autosave use them from their own goroutines.
+    mutex                 sync.RWMutex
 }
 
 
@@ -43,15 +52,22 @@ func (me * World) AddWoeDefaults() {
     */
 }
 
-func NewWorld(name string, motd string, dirname string) (*World) {
+func NewWorld(name string, motd string, store Storage) (*World) {
     world := new(World)
     world.Name          = name
     world.MOTD          = motd
-    world.dirname       = dirname
+    world.storage       = store
     world.accountmap    = make(map[string] * Account)
     world.itemmap       = make(map[string] * Item)
     world.roommap       = make(map[string] * Room)
     world.charactermap  = make(map[string] * Character)
+    world.entitymap     = make(map[string] * Entity)
+    world.zonemap       = make(map[string] * Zone)
+    world.mobilemap     = make(map[string] * Mobile)
+    world.sounds        = NewSoundTable()
+    world.helps         = NewHelpIndex()
+    world.helps.AddWoeDefaults()
+    world.bans          = NewBanList()
 
     world.AddWoeDefaults()
     return world;
@@ -66,32 +82,42 @@ func HaveID(ids [] string, id string) bool {
 }
 
 func (me * World) AddEntity(entity * Entity) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
     me.entitymap[entity.ID] = entity;
 }
 
 func (me * World) AddZone(zone * Zone) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
     me.zones = append(me.zones, zone)
     me.zonemap[zone.ID] = zone;
-    me.AddEntity(&zone.Entity);
+    me.entitymap[zone.ID] = &zone.Entity;
 }
 
-// Save an account as a sitef file.
-func (me * World) Save(dirname string) (err error) {
-    path := SavePathFor(dirname, "world", me.Name)
-    
+// Schema of world files.
+var WorldDescriptor = sitef.NewDescriptor("World").WithKey("name")
+
+// Returns the storage of the world.
+func (me * World) Storage() Storage {
+    return me.storage
+}
+
+// Save the world to its storage.
+func (me * World) Save() (err error) {
     rec                  := sitef.NewRecord()
     rec.Put("name",         me.Name)
     rec.Put("motd",         me.MOTD)
-    monolog.Debug("Saving World record: %s %v", path, rec)
-    return sitef.SaveRecord(path, *rec)
+    monolog.Debug("Saving World record: %s %v", me.Name, rec)
+    return saveDescribed(me.storage, "world", me.Name, WorldDescriptor, rec, nil)
 }
 
-// Load a world from a sitef file.
-func LoadWorld(dirname string, name string) (world * World, err error) {
+// Load a world from storage.
+func LoadWorld(store Storage, name string) (world * World, err error) {
     
-    path := SavePathFor(dirname, "world", name)
+    path := "world/" + name
     
-    records, err := sitef.ParseFilename(path)
+    records, err := store.Load("world", name)
     if err != nil {
         return nil, err
     }
@@ -103,14 +129,87 @@ func LoadWorld(dirname string, name string) (world * World, err error) {
     record := records[0]
     monolog.Info("Loading World record: %s %v", path, record)
     
-    world = NewWorld(record.Get("name"), record.Get("motd"), dirname)
+    world = NewWorld(record.Get("name"), record.Get("motd"), store)
     monolog.Info("Loaded World: %s %v", path, world)
+    
+    err = world.LoadSounds()
+    if err != nil {
+        monolog.Error("Could not load sounds: %v", err)
+    }
+    err = world.LoadHelp()
+    if err != nil {
+        monolog.Error("Could not load help: %v", err)
+    }
+    err = world.LoadBans()
+    if err != nil {
+        monolog.Error("Could not load bans: %v", err)
+    }
+    err = world.LoadZones()
+    if err != nil {
+        monolog.Error("Could not load zones: %v", err)
+    }
     return world, nil
 }
 
+// (Re)loads the sound table of this world.
+func (me * World) LoadSounds() (err error) {
+    sounds, err := LoadSoundTable(me.storage)
+    if err != nil {
+        return err
+    }
+    me.sounds = sounds
+    return nil
+}
+
+// Returns the sound to play for the event in the zone, if any.
+func (me * World) Sound(zone string, event string) (Sound, bool) {
+    return me.sounds.Lookup(zone, event)
+}
+
+// Loads the help entries of the world.
+func (me * World) LoadHelp() (err error) {
+    helps, err := LoadHelpIndex(me.storage)
+    me.helps = helps
+    return err
+}
+
+// Looks up the help entry for the topic. See HelpIndex.Lookup.
+func (me * World) Help(topic string, privilege Privilege) (* Help, []string) {
+    return me.helps.Lookup(topic, privilege)
+}
+
+// Searches the help entries for the topic. See HelpIndex.Search.
+func (me * World) SearchHelp(topic string, privilege Privilege) ([] * Help) {
+    return me.helps.Search(topic, privilege)
+}
+
+// Loads the bans of the world.
+func (me * World) LoadBans() (err error) {
+    bans, err := LoadBanList(me.storage)
+    me.bans = bans
+    return err
+}
+
+// Returns the bans of the world.
+func (me * World) Bans() (* BanList) {
+    return me.bans
+}
+
+// Saves the bans of the world.
+func (me * World) SaveBans() (err error) {
+    return me.bans.Save(me.storage)
+}
+
+// Returns the amount of help entries.
+func (me * World) HelpCount() int {
+    return me.helps.Len()
+}
+
 
 // Returns an acccount that has already been loaded or nil if not found
 func (me * World) GetAccount(name string) (account * Account) {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
     account, ok := me.accountmap[name];
     if !ok {
         return nil
@@ -126,16 +225,24 @@ func (me * World) LoadAccount(name string) (account *Account, err error) {
         return account, nil
     }
     
-    account, err = LoadAccount(me.dirname, name);
+    account, err = LoadAccount(me.storage, name);
     if err != nil {
         return account, err
     }
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    // Another client may have loaded it in the mean time.
+    if loaded, ok := me.accountmap[account.Name]; ok {
+        return loaded, nil
+    }
     me.accountmap[account.Name] = account
     return account, nil
 }
 
 // Removes an account from this world by name.
 func (me * World) RemoveAccount(name string) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
     _, have := me.accountmap[name]
     if (!have) {
         return
@@ -149,6 +256,8 @@ var DefaultWorld * World
 
 // Returns an item that has already been loaded or nil if not found
 func (me * World) GetItem(id string) (item * Item) {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
     item, ok := me.itemmap[id]
     if !ok {
         return nil
@@ -165,16 +274,24 @@ func (me * World) LoadItem(id string) (item *Item, err error) {
         return item, nil
     }
     
-    item, err = LoadItem(me.dirname, id);
+    item, err = LoadItem(me.storage, id);
     if err != nil {
         return item, err
     }
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    // Another client may have loaded it in the mean time.
+    if loaded, ok := me.itemmap[item.ID]; ok {
+        return loaded, nil
+    }
     me.itemmap[item.ID] = item
     return item, nil
 }
 
 // Removes an item from this world by ID.
 func (me * World) RemoveItem(id string) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
     _, have := me.itemmap[id]
     if (!have) {
         return
@@ -185,6 +302,8 @@ func (me * World) RemoveItem(id string) {
 
 // Returns a Room that has already been loaded or nil if not found
 func (me * World) GetRoom(id string) (room * Room) {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
     room, ok := me.roommap[id]
     if !ok {
         return nil
@@ -203,16 +322,24 @@ func (me * World) LoadRoom(id string) (room *Room, err error) {
         return room, nil
     }
     
-    room, err = LoadRoom(me.dirname, id);
+    room, err = LoadRoom(me.storage, id);
     if err != nil {
         return room, err
     }
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    // Another client may have loaded it in the mean time.
+    if loaded, ok := me.roommap[room.ID]; ok {
+        return loaded, nil
+    }
     me.roommap[room.ID] = room
     return room, nil
 }
 
 // Removes an item from this world by ID.
 func (me * World) RemoveRoom(id string) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
     _, have := me.roommap[id]
     if (!have) {
         return
@@ -220,5 +347,144 @@ func (me * World) RemoveRoom(id string) {
     delete(me.roommap, id)
 }
 
+// Adds a room to this world, for example a room that was just built.
+func (me * World) AddRoom(room * Room) {
+    me.mutex.Lock()
+    defer me.mutex.Unlock()
+    me.roommap[room.ID] = room
+}
+
+// Saves a room of this world.
+func (me * World) SaveRoom(room * Room) (err error) {
+    return room.Save(me.storage)
+}
+
+// Returns true if a room with the ID exists, loaded or not.
+func (me * World) HaveRoom(id string) bool {
+    if me.GetRoom(id) != nil {
+        return true
+    }
+    _, err := me.storage.Modified("room", id)
+    return err == nil
+}
+
+// Returns an ID for a new room in the zone that isn't used yet.
+func (me * World) NewRoomID(zoneid string) string {
+    for index := 1; ; index++ {
+        id := fmt.Sprintf("room_%s_%d", zoneid, index)
+        if !me.HaveRoom(id) {
+            return id
+        }
+    }
+}
+
+// Returns a zone or nil if not found. All zones are loaded with the world.
+func (me * World) GetZone(id string) (zone * Zone) {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    return me.zonemap[id]
+}
+
+// Returns all zones, sorted by ID.
+func (me * World) Zones() (zones [] * Zone) {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    ids := make([]string, 0, len(me.zonemap))
+    for id := range me.zonemap {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    for _, id := range ids {
+        zones = append(zones, me.zonemap[id])
+    }
+    return zones
+}
+
+// Saves a zone of this world.
+func (me * World) SaveZone(zone * Zone) (err error) {
+    return zone.Save(me.storage)
+}
+
+// Loads all zones of this world.
+func (me * World) LoadZones() (err error) {
+    ids, err := ZoneIDs(me.storage)
+    if err != nil {
+        return err
+    }
+    for _, id := range ids {
+        zone, err := LoadZone(me.storage, id)
+        if err != nil {
+            monolog.Error("Could not load zone %s: %v", id, err)
+            continue
+        }
+        me.AddZone(zone)
+    }
+    return nil
+}
+
+// Saves the accounts, their characters, and the rooms, zones and items
+// that changed since they were last saved. Returns how many were saved.
+// If saving one fails, the others are still saved, and the first error
+// is returned.
+func (me * World) SaveDirty() (saved int, err error) {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    save := func(dirty * Dirty, saver func(Storage) error) {
+        if !dirty.IsDirty() {
+            return
+        }
+        if serr := saver(me.storage) ; serr != nil {
+            monolog.Error("Could not save: %v", serr)
+            if err == nil {
+                err = serr
+            }
+            return
+        }
+        saved++
+    }
+
+    for _, account := range me.accountmap {
+        save(&account.Dirty, account.Save)
+        for _, character := range account.characters {
+            save(&character.Dirty, character.Save)
+        }
+    }
+    for _, room := range me.roommap {
+        save(&room.Dirty, room.Save)
+    }
+    for _, zone := range me.zonemap {
+        save(&zone.Dirty, zone.Save)
+    }
+    for _, item := range me.itemmap {
+        save(&item.Dirty, item.Save)
+    }
+    return saved, err
+}
 
+// Returns the amount of rooms loaded in this world.
+func (me * World) RoomCount() int {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    return len(me.roommap)
+}
 
+// Returns the amount of zones loaded in this world.
+func (me * World) ZoneCount() int {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    return len(me.zonemap)
+}
+
+// Returns the amount of items loaded in this world.
+func (me * World) ItemCount() int {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    return len(me.itemmap)
+}
+
+// Returns the amount of mobiles loaded in this world.
+func (me * World) MobileCount() int {
+    me.mutex.RLock()
+    defer me.mutex.RUnlock()
+    return len(me.mobilemap)
+}
@@ -0,0 +1,135 @@
+package world
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/beoran/woe/sitef"
+)
+
+// Storage that calls a hook when saving, and can fail.
+type hookStorage struct {
+	*FileStorage
+	hook func()
+	fail bool
+}
+
+func (me *hookStorage) Save(kind string, id string, records sitef.RecordList) error {
+	if me.hook != nil {
+		me.hook()
+	}
+	if me.fail {
+		return errors.New("disk full")
+	}
+	return me.FileStorage.Save(kind, id, records)
+}
+
+func newDirtyWorld(test *testing.T) (*World, *hookStorage, *Room, *Room) {
+	store := &hookStorage{FileStorage: NewFileStorage(test.TempDir())}
+	world := NewWorld("test", "", store)
+	town := NewRoom("town", "Town", "zone")
+	field := NewRoom("field", "Field", "zone")
+	world.AddRoom(town)
+	world.AddRoom(field)
+	return world, store, town, field
+}
+
+func TestDirty(test *testing.T) {
+	room := NewRoom("town", "Town", "zone")
+	if room.IsDirty() {
+		test.Errorf("A new room should be clean")
+	}
+	room.Change(func() { room.Name = "City" })
+	if !room.IsDirty() {
+		test.Errorf("Change should mark the room dirty")
+	}
+	room.MarkClean()
+	if room.RemoveExit(DIRECTION_NORTH) || room.IsDirty() {
+		test.Errorf("Removing a missing exit should not mark the room dirty")
+	}
+	room.SetExit(DIRECTION_NORTH, room)
+	if !room.IsDirty() {
+		test.Errorf("SetExit should mark the room dirty")
+	}
+}
+
+func TestSaveDirty(test *testing.T) {
+	world, store, town, field := newDirtyWorld(test)
+	town.SetExit(DIRECTION_NORTH, field)
+
+	if saved, err := world.SaveDirty(); err != nil || saved != 1 {
+		test.Fatalf("SaveDirty: %d %v, expected 1 room saved", saved, err)
+	}
+	if town.IsDirty() {
+		test.Errorf("A saved room should be clean")
+	}
+	if saved, err := world.SaveDirty(); err != nil || saved != 0 {
+		test.Errorf("SaveDirty: %d %v, expected nothing to save", saved, err)
+	}
+	loaded, err := LoadRoom(store, "town")
+	if err != nil {
+		test.Fatalf("LoadRoom: %v", err)
+	}
+	if exit, ok := loaded.Exits[DIRECTION_NORTH]; !ok || exit.ToRoomID != "field" {
+		test.Errorf("Exit was not saved: %v", loaded.Exits)
+	}
+
+	store.fail = true
+	field.Change(func() { field.Long = "Grass." })
+	if saved, err := world.SaveDirty(); err == nil || saved != 0 {
+		test.Errorf("SaveDirty: %d %v, expected an error", saved, err)
+	}
+	if !field.IsDirty() {
+		test.Errorf("A room that could not be saved should stay dirty")
+	}
+}
+
+// A change made after the room was marshalled must be saved next time.
+func TestSaveDirtyChangeDuringSave(test *testing.T) {
+	world, store, town, _ := newDirtyWorld(test)
+	town.Change(func() { town.Name = "Town" })
+	store.hook = func() {
+		store.hook = nil
+		town.Change(func() { town.Name = "City" })
+	}
+	if _, err := world.SaveDirty(); err != nil {
+		test.Fatalf("SaveDirty: %v", err)
+	}
+	if !town.IsDirty() {
+		test.Errorf("A change made while saving was marked clean")
+	}
+	world.SaveDirty()
+	if loaded, err := LoadRoom(store, "town"); err != nil || loaded.Name != "City" {
+		test.Errorf("Change made while saving was lost: %v", err)
+	}
+}
+
+// Run with -race: autosave must not race with changes to the rooms.
+func TestSaveDirtyConcurrent(test *testing.T) {
+	world, _, town, field := newDirtyWorld(test)
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			town.SetExit(DIRECTION_NORTH, field)
+			town.RemoveExit(DIRECTION_NORTH)
+			field.Change(func() { field.Name = "Field" })
+		}
+	}()
+	for total := 0; total < 20; {
+		saved, err := world.SaveDirty()
+		if err != nil {
+			test.Errorf("SaveDirty: %v", err)
+			break
+		}
+		total += saved
+	}
+	close(stop)
+	<-done
+}
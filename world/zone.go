@@ -1,10 +1,101 @@
 package world
 
+import "github.com/beoran/woe/sitef"
+import "github.com/beoran/woe/monolog"
+import "errors"
+
 type Zone struct {
     Entity
-    RoomIDS []int
+    RoomIDS []string    `sitef:"rooms"`
     rooms   []Room
+    Dirty
+}
+
+// Makes a new, empty zone.
+func NewZone(id string, name string) (* Zone) {
+    zone       := &Zone{}
+    zone.ID     = id
+    zone.Name   = name
+    zone.Short  = name
+    zone.Long   = name
+    return zone
+}
+
+// Adds the ID of a room to the zone, if it is not there yet.
+func (me * Zone) AddRoomID(id string) {
+    me.Lock()
+    defer me.Unlock()
+    for _, have := range me.RoomIDS {
+        if have == id {
+            return
+        }
+    }
+    me.RoomIDS = append(me.RoomIDS, id)
+    me.MarkDirty()
 }
 
+// Removes the ID of a room from the zone.
+func (me * Zone) RemoveRoomID(id string) {
+    me.Lock()
+    defer me.Unlock()
+    for index, have := range me.RoomIDS {
+        if have == id {
+            me.RoomIDS = append(me.RoomIDS[:index], me.RoomIDS[index+1:]...)
+            me.MarkDirty()
+            return
+        }
+    }
+}
 
+// Saves the zone to a sitef record.
+func (me * Zone) SaveSitef(rec * sitef.Record) (err error) {
+    return sitef.MarshalRecord(rec, me)
+}
 
+// Load a zone from a sitef record.
+func (me * Zone) LoadSitef(rec sitef.Record) (err error) {
+    return sitef.Unmarshal(rec, me)
+}
+
+// Schema of zone files.
+var ZoneDescriptor = sitef.NewDescriptor("Zone").WithKey("id").
+    WithMandatory("name").WithTypes("rooms int", "rooms[] line")
+
+// Saves the zone to storage.
+func (me * Zone) Save(store Storage) (err error) {
+    rec, err := me.marshalClean(func() (* sitef.Record, error) {
+        rec  := sitef.NewRecord()
+        return rec, me.SaveSitef(rec)
+    })
+    if err != nil {
+        return err
+    }
+    monolog.Debug("Saving Zone record: %s %v", me.ID, rec)
+    return saveDescribed(store, "zone", me.ID, ZoneDescriptor, rec, &me.Dirty)
+}
+
+// Load a zone from storage.
+func LoadZone(store Storage, id string) (zone * Zone, err error) {
+    path := "zone/" + id
+    
+    records, err := store.Load("zone", id)
+    if err != nil {
+        return nil, err
+    }
+    
+    if len(records) < 1 {
+        return nil, errors.New("No zone found!")
+    }
+    
+    zone = new(Zone)
+    if err = zone.LoadSitef(*records[0]); err != nil {
+        return nil, err
+    }
+    monolog.Info("Loaded Zone: %s %v", path, zone)
+    return zone, nil
+}
+
+// Returns the IDs of all zones that are saved in storage.
+func ZoneIDs(store Storage) (ids []string, err error) {
+    return store.IDs("zone")
+}